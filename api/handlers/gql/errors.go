@@ -0,0 +1,47 @@
+package gql
+
+import (
+	v1 "myproject/api-gateway/api/handlers/v1"
+)
+
+// resolverError carries the same status codes as the REST error model in the
+// "extensions" of a GraphQL error.
+type resolverError struct {
+	message    string
+	extensions map[string]interface{}
+}
+
+func (e *resolverError) Error() string {
+	return e.message
+}
+
+func (e *resolverError) Extensions() map[string]interface{} {
+	return e.extensions
+}
+
+var errPermissionDenied = &resolverError{
+	message:    "This operation is not allowed to you",
+	extensions: map[string]interface{}{"code": v1.StatusMethodNotAllowed},
+}
+
+func newResolverError(code, message string) error {
+	return &resolverError{
+		message:    message,
+		extensions: map[string]interface{}{"code": code},
+	}
+}
+
+// fromGrpcError translates a backend error the way the REST handlers do.
+func fromGrpcError(err error) error {
+	_, model, _ := v1.TranslateGrpcError(err)
+
+	extensions := map[string]interface{}{"code": model.Status}
+	if len(model.Violations) > 0 {
+		extensions["violations"] = model.Violations
+	}
+
+	return &resolverError{
+		message:    model.Message,
+		extensions: extensions,
+	}
+}
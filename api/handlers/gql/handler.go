@@ -0,0 +1,156 @@
+package gql
+
+import (
+	"context"
+	"github.com/casbin/casbin/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/privacy"
+	"myproject/api-gateway/services"
+	"myproject/api-gateway/storage/repo"
+	"net/http"
+	"time"
+)
+
+type handlerGQL struct {
+	schema          graphql.Schema
+	inMemoryStorage repo.InMemoryStorageI
+	log             logger.Logger
+	serviceManager  services.IServiceManager
+	cfg             config.Config
+	casbin          *casbin.Enforcer
+	events          *events.Broker
+}
+
+type HandlerGQLConfig struct {
+	InMemoryStorage repo.InMemoryStorageI
+	Log             logger.Logger
+	ServiceManager  services.IServiceManager
+	Cfg             config.Config
+	Casbin          *casbin.Enforcer
+	Events          *events.Broker
+}
+
+func New(h *HandlerGQLConfig) (*handlerGQL, error) {
+	handler := &handlerGQL{
+		inMemoryStorage: h.InMemoryStorage,
+		log:             h.Log,
+		serviceManager:  h.ServiceManager,
+		cfg:             h.Cfg,
+		casbin:          h.Casbin,
+		events:          h.Events,
+	}
+
+	schema, err := handler.newSchema()
+	if err != nil {
+		return nil, err
+	}
+	handler.schema = schema
+
+	return handler, nil
+}
+
+// GraphQL
+// @Router /v1/graphql [post]
+// @Security BearerAuth
+// @Summary graphql endpoint
+// @Tags GraphQL
+// @Description Query and mutate users with GraphQL. Root fields are authorized by the same casbin enforcer as the REST routes.
+// @Accept json
+// @Produce json
+// @Param Request body models.GraphQLReq true "GraphQL request"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+func (h *handlerGQL) Handle(c *gin.Context) {
+	var body models.GraphQLReq
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, &graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(body.Query),
+		Name: "GraphQL request",
+	})})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+
+	if result := graphql.ValidateDocument(&h.schema, doc, nil); !result.IsValid {
+		c.JSON(http.StatusBadRequest, &graphql.Result{Errors: result.Errors})
+		return
+	}
+
+	if err := checkLimits(doc, body.OperationName, body.Variables, h.cfg.GraphQLMaxDepth, h.cfg.GraphQLMaxComplexity); err != nil {
+		c.JSON(http.StatusBadRequest, &graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+
+	ctx := withLoaders(c.Request.Context(), h.newLoaders())
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(h.cfg.CtxTimeout))
+		defer cancel()
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        h.schema,
+		AST:           doc,
+		OperationName: body.OperationName,
+		Args:          body.Variables,
+		Context:       ctx,
+	})
+	if result.HasErrors() {
+		h.log.Warn("graphql request finished with errors", logger.Any("errors", result.Errors))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (h *handlerGQL) authorize(ctx context.Context, operation, field string) error {
+	role := "unauthorized"
+	if id, ok := identity.FromContext(ctx); ok && id.Role != "" {
+		role = id.Role
+	}
+
+	allowed, err := h.casbin.Enforce(role, "/v1/graphql/"+field, operation)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return errPermissionDenied
+	}
+
+	return nil
+}
+
+// publishEvent announces a user change made through a mutation and adds it
+// to the user's audit log.
+func (h *handlerGQL) publishEvent(ctx context.Context, eventType, userID string) {
+	id, _ := identity.FromContext(ctx)
+
+	event := events.Event{
+		ID:         uuid.New().String(),
+		Type:       eventType,
+		UserID:     userID,
+		RequestID:  id.RequestID,
+		OccurredAt: time.Now().UTC(),
+	}
+	if err := h.events.Publish(event); err != nil {
+		h.log.Error("cannot publish user event", logger.String("type", eventType), logger.Error(err))
+	}
+	if err := privacy.RecordAudit(h.inMemoryStorage, event); err != nil {
+		h.log.Error("cannot record audit entry", logger.String("type", eventType), logger.Error(err))
+	}
+}
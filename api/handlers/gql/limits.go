@@ -0,0 +1,133 @@
+package gql
+
+import (
+	"fmt"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/spf13/cast"
+	"strings"
+)
+
+// defaultListSize is assumed for list fields whose size is not known from
+// their arguments.
+const defaultListSize = 10
+
+type limitsChecker struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+}
+
+// checkLimits rejects operations that are nested deeper than maxDepth or whose
+// estimated cost is above maxComplexity. Every field costs 1, and the cost of
+// the fields below a list is multiplied by the requested list size.
+func checkLimits(doc *ast.Document, operationName string, variables map[string]interface{}, maxDepth, maxComplexity int) error {
+	checker := limitsChecker{
+		fragments: make(map[string]*ast.FragmentDefinition),
+		variables: variables,
+	}
+
+	var operation *ast.OperationDefinition
+	for _, definition := range doc.Definitions {
+		switch d := definition.(type) {
+		case *ast.FragmentDefinition:
+			checker.fragments[d.Name.Value] = d
+		case *ast.OperationDefinition:
+			if operation == nil && (operationName == "" || d.Name != nil && d.Name.Value == operationName) {
+				operation = d
+			}
+		}
+	}
+	if operation == nil {
+		return fmt.Errorf("unknown operation %q", operationName)
+	}
+
+	depth, complexity := checker.measure(operation.SelectionSet, 0, map[string]bool{})
+	if maxDepth > 0 && depth > maxDepth {
+		return fmt.Errorf("query depth %d exceeds the maximum of %d", depth, maxDepth)
+	}
+	if maxComplexity > 0 && complexity > maxComplexity {
+		return fmt.Errorf("query complexity %d exceeds the maximum of %d", complexity, maxComplexity)
+	}
+
+	return nil
+}
+
+func (l *limitsChecker) measure(set *ast.SelectionSet, depth int, visiting map[string]bool) (int, int) {
+	if set == nil {
+		return depth, 0
+	}
+
+	maxDepth, complexity := depth, 0
+	for _, selection := range set.Selections {
+		switch s := selection.(type) {
+		case *ast.Field:
+			// Introspection is answered from the schema without backend calls.
+			if strings.HasPrefix(s.Name.Value, "__") {
+				continue
+			}
+
+			childDepth, childComplexity := l.measure(s.SelectionSet, depth+1, visiting)
+			if childDepth > maxDepth {
+				maxDepth = childDepth
+			}
+			complexity += 1 + childComplexity*l.listSize(s)
+		case *ast.InlineFragment:
+			childDepth, childComplexity := l.measure(s.SelectionSet, depth, visiting)
+			if childDepth > maxDepth {
+				maxDepth = childDepth
+			}
+			complexity += childComplexity
+		case *ast.FragmentSpread:
+			fragment, ok := l.fragments[s.Name.Value]
+			if !ok || visiting[s.Name.Value] {
+				continue
+			}
+
+			visiting[s.Name.Value] = true
+			childDepth, childComplexity := l.measure(fragment.SelectionSet, depth, visiting)
+			delete(visiting, s.Name.Value)
+
+			if childDepth > maxDepth {
+				maxDepth = childDepth
+			}
+			complexity += childComplexity
+		}
+	}
+
+	return maxDepth, complexity
+}
+
+// listSize estimates how many items a field returns from its "limit" or
+// "ids" argument. Fields without them count as one item.
+func (l *limitsChecker) listSize(field *ast.Field) int {
+	for _, argument := range field.Arguments {
+		switch argument.Name.Value {
+		case "limit":
+			if size := cast.ToInt(l.value(argument.Value)); size > 0 {
+				return size
+			}
+			return defaultListSize
+		case "ids":
+			if ids, ok := l.value(argument.Value).([]interface{}); ok {
+				return len(ids)
+			}
+			return defaultListSize
+		}
+	}
+
+	return 1
+}
+
+func (l *limitsChecker) value(value ast.Value) interface{} {
+	switch v := value.(type) {
+	case *ast.Variable:
+		return l.variables[v.Name.Value]
+	case *ast.ListValue:
+		values := make([]interface{}, len(v.Values))
+		for i, item := range v.Values {
+			values[i] = l.value(item)
+		}
+		return values
+	default:
+		return value.GetValue()
+	}
+}
@@ -0,0 +1,68 @@
+package gql
+
+import (
+	"context"
+	"github.com/graph-gophers/dataloader/v7"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/services"
+	"time"
+)
+
+type loaders struct {
+	users *dataloader.Loader[string, *pbu.User]
+}
+
+type loadersKey struct{}
+
+func withLoaders(ctx context.Context, l *loaders) context.Context {
+	return context.WithValue(ctx, loadersKey{}, l)
+}
+
+func loadersFromContext(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey{}).(*loaders)
+}
+
+// newLoaders creates the per-request loaders. Users requested while resolving
+// the same level of a query are fetched in one batch and deduplicated.
+func (h *handlerGQL) newLoaders() *loaders {
+	return &loaders{
+		users: dataloader.NewBatchedLoader(h.batchGetUsers,
+			dataloader.WithWait[string, *pbu.User](2*time.Millisecond),
+			dataloader.WithBatchCapacity[string, *pbu.User](h.cfg.BatchGetMaxIDs),
+		),
+	}
+}
+
+func (h *handlerGQL) batchGetUsers(ctx context.Context, ids []string) []*dataloader.Result[*pbu.User] {
+	users, errs := services.GetUsersByIds(ctx, h.serviceManager.UserService(), ids, h.cfg.BatchGetConcurrency)
+
+	results := make([]*dataloader.Result[*pbu.User], len(ids))
+	for i := range ids {
+		results[i] = &dataloader.Result[*pbu.User]{Data: users[i], Error: errs[i]}
+	}
+
+	return results
+}
+
+// loadUser returns a thunk, so the executor can collect sibling fields into
+// one batch before waiting. A missing or deleted user resolves to null.
+func loadUser(ctx context.Context, id string) func() (interface{}, error) {
+	thunk := loadersFromContext(ctx).users.Load(ctx, id)
+
+	return func() (interface{}, error) {
+		user, err := thunk()
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fromGrpcError(err)
+		}
+		if user.DeletedAt != "" {
+			return nil, nil
+		}
+
+		return user, nil
+	}
+}
@@ -0,0 +1,364 @@
+package gql
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"github.com/graphql-go/graphql"
+	"github.com/spf13/cast"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"myproject/api-gateway/api/handlers/tokens"
+	v1 "myproject/api-gateway/api/handlers/v1"
+	"myproject/api-gateway/api/models"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/etc"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/tombstone"
+	"myproject/api-gateway/services"
+	"strings"
+	"time"
+)
+
+// Casbin actions of GraphQL fields. The object is "/v1/graphql/<field>".
+const (
+	operationQuery    = "QUERY"
+	operationMutation = "MUTATION"
+)
+
+func userField(fieldType graphql.Output, get func(*pbu.User) string) *graphql.Field {
+	return &graphql.Field{
+		Type: fieldType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*pbu.User)), nil
+		},
+	}
+}
+
+var userType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "User",
+	Fields: graphql.Fields{
+		"id":        userField(graphql.NewNonNull(graphql.ID), (*pbu.User).GetId),
+		"firstName": userField(graphql.String, (*pbu.User).GetFirstName),
+		"lastName":  userField(graphql.String, (*pbu.User).GetLastName),
+		"birthDate": userField(graphql.String, (*pbu.User).GetBirthDate),
+		"email":     userField(graphql.String, (*pbu.User).GetEmail),
+		"createdAt": userField(graphql.String, (*pbu.User).GetCreatedAt),
+		"updatedAt": userField(graphql.String, (*pbu.User).GetUpdatedAt),
+	},
+})
+
+var userListType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "UserList",
+	Fields: graphql.Fields{
+		"users": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*pbu.ListUsersResp).GetUsers(), nil
+			},
+		},
+		"count": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.Int),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*pbu.ListUsersResp).GetCount(), nil
+			},
+		},
+	},
+})
+
+var createUserInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "CreateUserInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"firstName": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"birthDate": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"email":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"password":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var updateUserInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "UpdateUserInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"firstName": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"birthDate": &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+func (h *handlerGQL) newSchema() (graphql.Schema, error) {
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: h.guard(operationQuery, "user", h.resolveUser),
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(userType)),
+				Args: graphql.FieldConfigArgument{
+					"ids": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.ID)))},
+				},
+				Resolve: h.guard(operationQuery, "users", h.resolveUsers),
+			},
+			"listUsers": &graphql.Field{
+				Type: graphql.NewNonNull(userListType),
+				Args: graphql.FieldConfigArgument{
+					"page":   &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+					"filter": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+				},
+				Resolve: h.guard(operationQuery, "listUsers", h.resolveListUsers),
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createUserInput)},
+				},
+				Resolve: h.guard(operationMutation, "createUser", h.resolveCreateUser),
+			},
+			"updateUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateUserInput)},
+				},
+				Resolve: h.guard(operationMutation, "updateUser", h.resolveUpdateUser),
+			},
+			"deleteUser": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: h.guard(operationMutation, "deleteUser", h.resolveDeleteUser),
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	})
+}
+
+// guard authorizes a root field with casbin before resolving it.
+func (h *handlerGQL) guard(operation, field string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if err := h.authorize(p.Context, operation, field); err != nil {
+			return nil, err
+		}
+
+		return resolve(p)
+	}
+}
+
+func (h *handlerGQL) resolveUser(p graphql.ResolveParams) (interface{}, error) {
+	return loadUser(p.Context, cast.ToString(p.Args["id"])), nil
+}
+
+func (h *handlerGQL) resolveUsers(p graphql.ResolveParams) (interface{}, error) {
+	ids, _ := p.Args["ids"].([]interface{})
+	if len(ids) > h.cfg.BatchGetMaxIDs {
+		return nil, newResolverError(v1.ErrorValidationError, "too many ids requested at once")
+	}
+
+	users := make([]interface{}, len(ids))
+	for i, id := range ids {
+		users[i] = loadUser(p.Context, cast.ToString(id))
+	}
+
+	return users, nil
+}
+
+func (h *handlerGQL) resolveListUsers(p graphql.ResolveParams) (interface{}, error) {
+	page, limit := cast.ToInt64(p.Args["page"]), cast.ToInt64(p.Args["limit"])
+	if page <= 0 || limit <= 0 {
+		return nil, newResolverError(v1.ErrorCodeInvalidParams, "page and limit should be positive numbers")
+	}
+
+	filter := cast.ToString(p.Args["filter"])
+	response, err := h.serviceManager.UserService().GetAllUsers(p.Context, &pbu.ListUsersReq{
+		Page:   page,
+		Limit:  limit,
+		Filter: filter,
+	})
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+
+	// Deleted users are left out, like GET /v1/users does by default. Only
+	// without a filter are they known well enough to leave the count too.
+	listed := &pbu.ListUsersResp{Count: response.Count}
+	loader := loadersFromContext(p.Context).users
+	for _, user := range response.Users {
+		loader.Prime(p.Context, user.Id, user)
+		if user.DeletedAt == "" {
+			listed.Users = append(listed.Users, user)
+		}
+	}
+	if filter == "" {
+		deleted, err := tombstone.Count(h.inMemoryStorage)
+		if err != nil {
+			h.log.Error("error while counting deleted users", logger.Error(err))
+			return nil, newResolverError(v1.ErrorCodeInternalServerError, "Sorry, try again")
+		}
+		if listed.Count -= deleted; listed.Count < 0 {
+			listed.Count = 0
+		}
+	}
+
+	return listed, nil
+}
+
+func (h *handlerGQL) resolveCreateUser(p graphql.ResolveParams) (interface{}, error) {
+	input, _ := p.Args["input"].(map[string]interface{})
+
+	body := models.User{
+		FirstName: cast.ToString(input["firstName"]),
+		LastName:  cast.ToString(input["lastName"]),
+		BirthDate: cast.ToString(input["birthDate"]),
+		Email:     strings.ToLower(strings.TrimSpace(cast.ToString(input["email"]))),
+		Password:  cast.ToString(input["password"]),
+	}
+	if err := body.Validate(); err != nil {
+		return nil, newResolverError(v1.ErrorValidationError, err.Error())
+	}
+
+	hashedPassword, err := etc.GenerateHashPassword(body.Password)
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+
+	id := uuid.New().String()
+	jwtHandler := tokens.JWTHandler{
+		Sub:       id,
+		Role:      "user",
+		SignInKey: h.cfg.SignInKey,
+		Log:       h.log,
+		TimeOut:   h.cfg.AccessTokenTimeOut,
+	}
+	access, refresh, err := jwtHandler.GenerateAuthJWT()
+	if err != nil {
+		h.log.Error("error while generating access and refresh token", logger.Error(err))
+		return nil, newResolverError(v1.ErrorCodeInternalServerError, "Sorry, try again")
+	}
+
+	respUser, err := h.serviceManager.UserService().CreateUser(p.Context, &pbu.User{
+		Id:           id,
+		FirstName:    body.FirstName,
+		LastName:     body.LastName,
+		BirthDate:    body.BirthDate,
+		Email:        body.Email,
+		Password:     hashedPassword,
+		AccessToken:  access,
+		RefreshToken: refresh,
+	})
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+	h.publishEvent(p.Context, events.UserRegistered, respUser.Id)
+
+	return respUser, nil
+}
+
+func (h *handlerGQL) resolveUpdateUser(p graphql.ResolveParams) (interface{}, error) {
+	id := cast.ToString(p.Args["id"])
+	input, _ := p.Args["input"].(map[string]interface{})
+	if err := authorizeUser(p.Context, id); err != nil {
+		return nil, err
+	}
+
+	current, err := h.serviceManager.UserService().GetUserById(p.Context, &pbu.GetUserReqById{
+		UserId: id,
+	})
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+
+	var fields []string
+	updated := proto.Clone(current).(*pbu.User)
+	if value, ok := input["firstName"]; ok {
+		updated.FirstName = cast.ToString(value)
+		fields = append(fields, "first_name")
+	}
+	if value, ok := input["lastName"]; ok {
+		updated.LastName = cast.ToString(value)
+		fields = append(fields, "last_name")
+	}
+	if value, ok := input["birthDate"]; ok {
+		updated.BirthDate = cast.ToString(value)
+		fields = append(fields, "birth_date")
+	}
+
+	profile := models.User{
+		FirstName: updated.FirstName,
+		LastName:  updated.LastName,
+		BirthDate: updated.BirthDate,
+	}
+	if err := profile.ValidateProfile(); err != nil {
+		return nil, newResolverError(v1.ErrorValidationError, err.Error())
+	}
+
+	ctx, err := services.WithUpdateMask(p.Context, &fieldmaskpb.FieldMask{Paths: fields})
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+	respUser, err := h.serviceManager.UserService().UpdateUser(ctx, updated)
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+	loadersFromContext(p.Context).users.Clear(p.Context, id)
+	h.publishEvent(p.Context, events.UserUpdated, id)
+
+	return respUser, nil
+}
+
+func (h *handlerGQL) resolveDeleteUser(p graphql.ResolveParams) (interface{}, error) {
+	id := cast.ToString(p.Args["id"])
+	if err := authorizeUser(p.Context, id); err != nil {
+		return nil, err
+	}
+
+	current, err := h.serviceManager.UserService().GetUserById(p.Context, &pbu.GetUserReqById{
+		UserId: id,
+	})
+	if err != nil {
+		return nil, fromGrpcError(err)
+	}
+
+	if current.DeletedAt == "" {
+		_, err = services.SoftDeleteUser(p.Context, h.serviceManager.UserService(), current, time.Now())
+		if err != nil {
+			return nil, fromGrpcError(err)
+		}
+		loadersFromContext(p.Context).users.Clear(p.Context, id)
+		h.publishEvent(p.Context, events.UserDeleted, id)
+	}
+
+	if err := tombstone.Set(h.inMemoryStorage, id, 0); err != nil {
+		h.log.Error("error while revoking user tokens", logger.Error(err))
+		return nil, newResolverError(v1.ErrorCodeInternalServerError, "Sorry, try again")
+	}
+
+	return true, nil
+}
+
+// authorizeUser lets callers change their own account only, unless they are
+// an admin. Casbin grants the mutation, not the user it is applied to.
+func authorizeUser(ctx context.Context, userID string) error {
+	if id, _ := identity.FromContext(ctx); !id.CanActOn(userID) {
+		return newResolverError(v1.ErrorCodeForbidden, "You can only change your own account")
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"github.com/gin-gonic/gin"
+	v1 "myproject/api-gateway/api/handlers/v1"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/services"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+var proxyMetrics = expvar.NewMap("proxy")
+
+// identityHeaders are set by the gateway only, whatever the client sent.
+var identityHeaders = []string{
+	services.MetadataRequestID,
+	services.MetadataUserID,
+	services.MetadataUserRoles,
+	services.MetadataTenantID,
+	services.MetadataClientIP,
+	services.MetadataIdentityAssertion,
+}
+
+type upstreamKey struct{}
+
+type handlerProxy struct {
+	route Route
+	pool  *pool
+	proxy *httputil.ReverseProxy
+	log   logger.Logger
+	cfg   config.Config
+}
+
+type HandlerProxyConfig struct {
+	Log logger.Logger
+	Cfg config.Config
+}
+
+func New(route Route, h *HandlerProxyConfig) (*handlerProxy, error) {
+	upstreams, err := newPool(route.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &handlerProxy{
+		route: route,
+		pool:  upstreams,
+		log:   h.Log,
+		cfg:   h.Cfg,
+	}
+	handler.proxy = &httputil.ReverseProxy{
+		Rewrite:      handler.rewrite,
+		ErrorHandler: handler.handleError,
+	}
+
+	return handler, nil
+}
+
+func (h *handlerProxy) Handle(c *gin.Context) {
+	timeout := time.Second * time.Duration(h.route.Timeout)
+	if timeout == 0 {
+		timeout = time.Second * time.Duration(h.cfg.CtxTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	if err := h.setHeaders(c.Request); err != nil {
+		h.log.Error("cannot sign identity assertion", logger.Error(err))
+		writeError(c.Writer, http.StatusInternalServerError, v1.ErrorCodeInternalServerError, "Internal server error")
+		return
+	}
+
+	proxyMetrics.Add(h.route.Prefix+".requests", 1)
+	ctx = context.WithValue(ctx, upstreamKey{}, h.pool.pick())
+	h.proxy.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+}
+
+// setHeaders replaces the identity headers sent by the client with the ones
+// of the authenticated caller and adds the headers configured for the route.
+func (h *handlerProxy) setHeaders(req *http.Request) error {
+	for _, header := range identityHeaders {
+		req.Header.Del(header)
+	}
+
+	for name, value := range h.route.Headers {
+		req.Header.Set(name, value)
+	}
+
+	id, ok := identity.FromContext(req.Context())
+	if !ok {
+		return nil
+	}
+
+	req.Header.Set(services.MetadataRequestID, id.RequestID)
+	req.Header.Set(services.MetadataClientIP, id.ClientIP)
+	if id.UserID != "" {
+		req.Header.Set(services.MetadataUserID, id.UserID)
+	}
+	if id.Role != "" {
+		req.Header.Set(services.MetadataUserRoles, id.Role)
+	}
+	if id.Tenant != "" {
+		req.Header.Set(services.MetadataTenantID, id.Tenant)
+	}
+
+	assertion, err := identity.SignAssertion(id, h.cfg.InternalSignInKey, time.Second*time.Duration(h.cfg.IdentityAssertionTimeOut))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(services.MetadataIdentityAssertion, assertion)
+
+	return nil
+}
+
+func (h *handlerProxy) rewrite(pr *httputil.ProxyRequest) {
+	target := pr.In.Context().Value(upstreamKey{}).(*upstream).target
+
+	pr.Out.URL.Path = h.route.rewritePath(pr.In.URL.Path)
+	pr.Out.URL.RawPath = ""
+	pr.SetURL(target)
+	pr.SetXForwarded()
+}
+
+func (h *handlerProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	proxyMetrics.Add(h.route.Prefix+".errors", 1)
+
+	switch {
+	case errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, v1.ErrorCodeGatewayTimeout, "Upstream did not respond in time")
+	case errors.Is(r.Context().Err(), context.Canceled):
+		writeError(w, v1.StatusClientClosedRequest, v1.ErrorCodeCanceled, "Request was canceled")
+	default:
+		failed := r.Context().Value(upstreamKey{}).(*upstream)
+		failed.markDown()
+
+		h.log.Error("proxy request failed",
+			logger.String("prefix", h.route.Prefix),
+			logger.String("upstream", failed.target.String()),
+			logger.Error(err))
+		writeError(w, http.StatusBadGateway, v1.ErrorCodeBadGateway, "Upstream is unavailable")
+	}
+}
+
+func writeError(w http.ResponseWriter, httpStatus int, status, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(httpStatus)
+	_ = json.NewEncoder(w).Encode(models.ResponseError{
+		Error: models.StandardErrorModel{
+			Status:  status,
+			Message: message,
+		},
+	})
+}
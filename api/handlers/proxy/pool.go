@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamCooldown is how long an upstream is skipped after a failed request.
+const upstreamCooldown = 10 * time.Second
+
+type upstream struct {
+	target    *url.URL
+	downUntil atomic.Int64
+}
+
+func (u *upstream) markDown() {
+	u.downUntil.Store(time.Now().Add(upstreamCooldown).UnixNano())
+}
+
+func (u *upstream) available(now time.Time) bool {
+	return now.UnixNano() >= u.downUntil.Load()
+}
+
+// pool balances requests over the upstreams of a route with round robin,
+// skipping upstreams that failed recently.
+type pool struct {
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+func newPool(targets []string) (*pool, error) {
+	p := &pool{}
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, &upstream{target: u})
+	}
+
+	return p, nil
+}
+
+// pick falls back to plain round robin when every upstream is down, so a
+// recovered upstream is found without waiting for the cooldown.
+func (p *pool) pick() *upstream {
+	now := time.Now()
+	start := p.next.Add(1) - 1
+	count := uint64(len(p.upstreams))
+
+	for i := uint64(0); i < count; i++ {
+		if u := p.upstreams[(start+i)%count]; u.available(now) {
+			return u
+		}
+	}
+
+	return p.upstreams[start%count]
+}
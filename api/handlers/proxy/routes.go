@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Route sends every request under Prefix to one of Upstreams. The matched
+// prefix is replaced by Rewrite when it is set, or removed when StripPrefix is
+// set. Headers are added to every upstream request, and Timeout in seconds
+// bounds the whole exchange, CtxTimeout being used when it is zero.
+type Route struct {
+	Prefix      string            `json:"prefix"`
+	Upstreams   []string          `json:"upstreams"`
+	StripPrefix bool              `json:"strip_prefix"`
+	Rewrite     string            `json:"rewrite"`
+	Headers     map[string]string `json:"headers"`
+	Timeout     int               `json:"timeout"`
+	RateLimit   float64           `json:"rate_limit"`
+	RateBurst   int               `json:"rate_burst"`
+}
+
+// LoadRoutes reads the proxy routes from a JSON file. A missing file means no
+// routes are configured.
+func LoadRoutes(path string) ([]Route, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []Route
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("cannot parse proxy routes %s: %w", path, err)
+	}
+
+	prefixes := make(map[string]bool)
+	for i := range routes {
+		if err := routes[i].validate(); err != nil {
+			return nil, fmt.Errorf("proxy route %d: %w", i, err)
+		}
+		if prefixes[routes[i].Prefix] {
+			return nil, fmt.Errorf("proxy route %d: duplicate prefix %s", i, routes[i].Prefix)
+		}
+		prefixes[routes[i].Prefix] = true
+	}
+
+	return routes, nil
+}
+
+func (r *Route) validate() error {
+	r.Prefix = "/" + strings.Trim(r.Prefix, "/")
+	if r.Prefix == "/" {
+		return fmt.Errorf("prefix is required")
+	}
+	if strings.ContainsAny(r.Prefix, ":*") {
+		return fmt.Errorf("prefix %s should not contain route parameters", r.Prefix)
+	}
+	if r.Rewrite != "" {
+		r.Rewrite = "/" + strings.Trim(r.Rewrite, "/")
+	}
+
+	if len(r.Upstreams) == 0 {
+		return fmt.Errorf("%s has no upstreams", r.Prefix)
+	}
+	for _, upstream := range r.Upstreams {
+		target, err := url.Parse(upstream)
+		if err != nil {
+			return fmt.Errorf("%s: invalid upstream %s: %w", r.Prefix, upstream, err)
+		}
+		if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+			return fmt.Errorf("%s: upstream %s should be an absolute http(s) url", r.Prefix, upstream)
+		}
+	}
+
+	if r.Timeout < 0 {
+		return fmt.Errorf("%s: timeout should not be negative", r.Prefix)
+	}
+
+	return nil
+}
+
+// rewritePath maps the path of an incoming request to the upstream path.
+func (r *Route) rewritePath(path string) string {
+	rest := strings.TrimPrefix(path, r.Prefix)
+
+	switch {
+	case r.Rewrite != "":
+		path = r.Rewrite + rest
+	case r.StripPrefix:
+		path = rest
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return path
+}
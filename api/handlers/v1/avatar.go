@@ -0,0 +1,264 @@
+package v1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/pkg/avatar"
+	"myproject/api-gateway/pkg/blob"
+	"myproject/api-gateway/pkg/cursor"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/tombstone"
+	"net/http"
+	"path"
+	"time"
+)
+
+// avatarFormOverhead is allowed on top of AvatarMaxBytes for the rest of the
+// multipart form.
+const avatarFormOverhead = 64 << 10
+
+var avatarContentTypes = map[string]string{
+	".png": "image/png",
+	".jpg": "image/jpeg",
+}
+
+// avatarLink is signed into avatar URLs. Key names one version of one size,
+// so the content behind a link never changes.
+type avatarLink struct {
+	UserID string `json:"u"`
+	Key    string `json:"k"`
+}
+
+// Upload avatar
+// @Router /v1/me/avatar [put]
+// @Security BearerAuth
+// @Summary upload my avatar
+// @Tags User
+// @Description Replace the caller's avatar with a PNG, JPEG or WebP picture. The type is checked from the content. Metadata such as EXIF is removed, and large, medium and small sizes are stored.
+// @Accept multipart/form-data
+// @Produce json
+// @Param avatar formData file true "picture"
+// @Success 200 {object} models.AvatarResp
+// @Failure 400 string Error models.ResponseError
+// @Failure 413 string Error models.ResponseError
+// @Failure 415 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) PutAvatar(c *gin.Context) {
+	userID, ok := callerID(c)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(h.cfg.AvatarMaxBytes)+avatarFormOverhead)
+	file, _, err := c.Request.FormFile("avatar")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		avatarTooLarge(c)
+		return
+	}
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams) {
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(h.cfg.AvatarMaxBytes)+1))
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorBadRequest) {
+		return
+	}
+	if len(data) > h.cfg.AvatarMaxBytes {
+		avatarTooLarge(c)
+		return
+	}
+
+	result, err := avatar.Process(data, h.cfg.AvatarMaxPixels)
+	switch err {
+	case nil:
+	case avatar.ErrUnsupported:
+		c.JSON(http.StatusUnsupportedMediaType, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeUnsupportedMedia,
+				Message: err.Error(),
+			},
+		})
+		return
+	case avatar.ErrTooLarge:
+		avatarTooLarge(c)
+		return
+	default:
+		handleInternalServerErrorWithMessage(c, h.log, err, "error while processing avatar")
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	current, err := avatar.Save(ctx, h.blobs, userID, result)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while saving avatar") {
+		return
+	}
+
+	response, err := h.avatarResponse(userID, current)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while signing avatar urls") {
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Get avatar
+// @Router /v1/me/avatar [get]
+// @Security BearerAuth
+// @Summary get my avatar
+// @Tags User
+// @Description URLs of the caller's avatar
+// @Produce json
+// @Success 200 {object} models.AvatarResp
+// @Failure 404 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) GetAvatar(c *gin.Context) {
+	userID, ok := callerID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	current, err := avatar.Load(ctx, h.blobs, userID)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading avatar") {
+		return
+	}
+	if current == nil {
+		avatarNotFound(c)
+		return
+	}
+
+	response, err := h.avatarResponse(userID, *current)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while signing avatar urls") {
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Serve avatar
+// @Router /v1/avatars/{token} [get]
+// @Summary avatar image
+// @Tags User
+// @Description Image behind a signed avatar URL. Browsers may cache it for a day, shared caches may not.
+// @Produce image/png,image/jpeg
+// @Param token path string true "token from the avatar URL"
+// @Success 200 {file} file
+// @Failure 404 string Error models.ResponseError
+func (h *handlerV1) ServeAvatar(c *gin.Context) {
+	token := c.Param("token")
+
+	var link avatarLink
+	if err := cursor.Decode(token, h.cfg.AvatarSignInKey, &link); err != nil {
+		avatarNotFound(c)
+		return
+	}
+	contentType, ok := avatarContentTypes[path.Ext(link.Key)]
+	if !ok {
+		avatarNotFound(c)
+		return
+	}
+
+	// Soft deleted users keep their avatar until they are purged, but it is
+	// not shown meanwhile.
+	deleted, err := tombstone.Exists(h.inMemoryStorage, link.UserID)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading user state") {
+		return
+	}
+	if deleted {
+		avatarNotFound(c)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(link.Key))
+	if notModified(c, `"`+hex.EncodeToString(sum[:16])+`"`) {
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	r, err := h.blobs.Get(ctx, link.Key)
+	if errors.Is(err, blob.ErrNotFound) {
+		avatarNotFound(c)
+		return
+	}
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading avatar") {
+		return
+	}
+	defer r.Close()
+
+	// Links never expire, so shared caches would keep serving the avatar of
+	// an erased or deleted user. Only the viewer's browser keeps it, and not
+	// for long.
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, r); err != nil {
+		h.log.Error("cannot send avatar", logger.Error(err))
+	}
+}
+
+func (h *handlerV1) avatarResponse(userID string, current avatar.Avatar) (models.AvatarResp, error) {
+	response := models.AvatarResp{
+		URLs:      make(map[string]string, len(avatar.Sizes)),
+		UpdatedAt: current.UpdatedAt.Format(time.RFC3339),
+	}
+	for _, size := range avatar.Sizes {
+		token, err := cursor.Encode(avatarLink{
+			UserID: userID,
+			Key:    current.Key(userID, size.Name),
+		}, h.cfg.AvatarSignInKey)
+		if err != nil {
+			return models.AvatarResp{}, err
+		}
+		response.URLs[size.Name] = "/v1/avatars/" + token
+	}
+
+	return response, nil
+}
+
+func avatarTooLarge(c *gin.Context) {
+	c.JSON(http.StatusRequestEntityTooLarge, models.ResponseError{
+		Error: models.StandardErrorModel{
+			Status:  ErrorCodePayloadTooLarge,
+			Message: "Avatar is too large",
+		},
+	})
+}
+
+func avatarNotFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, models.ResponseError{
+		Error: models.StandardErrorModel{
+			Status:  ErrorCodeNotFound,
+			Message: "Avatar not found",
+		},
+	})
+}
+
+// callerID is the id of the user the token belongs to.
+func callerID(c *gin.Context) (string, bool) {
+	id, _ := identity.FromContext(c.Request.Context())
+	if id.UserID == "" {
+		c.JSON(http.StatusUnauthorized, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeUnauthorized,
+				Message: "Sign in first",
+			},
+		})
+		return "", false
+	}
+
+	return id.UserID, true
+}
@@ -0,0 +1,445 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"html/template"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/api/projection"
+	"myproject/api-gateway/email"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/cursor"
+	"myproject/api-gateway/pkg/etc"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/logger"
+	grpcClient "myproject/api-gateway/services"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	emailChangeKeyPrefix = "user:email-change:"
+	// emailChangeAttemptsKeyPrefix counts wrong codes of the pending change.
+	emailChangeAttemptsKeyPrefix = "user:email-change-attempts:"
+	emailRevertKeyPrefix         = "user:email-revert:"
+)
+
+// emailChange is a change waiting for the code sent to the new address.
+type emailChange struct {
+	NewEmail string `json:"new_email"`
+	CodeHash string `json:"code_hash"`
+}
+
+// emailRevert lets the old address undo the last change. Only the latest
+// change of a user can be reverted, and only once.
+type emailRevert struct {
+	ID       string `json:"id"`
+	OldEmail string `json:"old_email"`
+	NewEmail string `json:"new_email"`
+}
+
+// emailRevertLink is signed into the revert link sent to the old address.
+type emailRevertLink struct {
+	UserID    string `json:"u"`
+	RevertID  string `json:"r"`
+	ExpiresAt int64  `json:"x"`
+}
+
+// emailRevertPage is what opening the revert link shows. Mail scanners open
+// links too, so the revert itself waits for the form to be posted.
+var emailRevertPage = template.Must(template.New("email-revert").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Revert email change</title></head>
+<body>
+<p>The email of your account was changed from {{.OldEmail}} to {{.NewEmail}}.</p>
+<form method="post"><button type="submit">Put {{.OldEmail}} back</button></form>
+</body>
+</html>
+`))
+
+// Request email change
+// @Router /v1/me/email [post]
+// @Security BearerAuth
+// @Summary change my email
+// @Tags User
+// @Description Start changing the caller's email. A code is sent to the new address, and the email only changes once the code is confirmed through POST /v1/me/email/confirm.
+// @Accept json
+// @Produce json
+// @Param email body models.EmailChangeReq true "New email"
+// @Success 202 {object} models.Status
+// @Failure 400 string Error models.ResponseError
+// @Failure 409 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) RequestEmailChange(c *gin.Context) {
+	var body models.EmailChangeReq
+
+	err := c.ShouldBindJSON(&body)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidJSON) {
+		return
+	}
+
+	body.Email = strings.ToLower(strings.TrimSpace(body.Email))
+
+	err = body.Validate()
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorValidationError) {
+		return
+	}
+
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+	if strings.EqualFold(user.Email, body.Email) {
+		handleBadRequestErrWithMessage(c, h.log, errors.New("this is your email already"), ErrorValidationError)
+		return
+	}
+	if !h.emailAvailable(c, body.Email) {
+		return
+	}
+
+	code := etc.GenerateCode(5)
+	change := emailChange{
+		NewEmail: body.Email,
+		CodeHash: etc.HashCode(code, h.cfg.VerifyCodeHashKey),
+	}
+	data, err := json.Marshal(change)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while marshaling json") {
+		return
+	}
+
+	// A new request replaces the previous one, so only the latest code works.
+	err = h.inMemoryStorage.SetWithTTL(emailChangeKeyPrefix+user.Id, string(data), h.cfg.EmailChangeTTL)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while setting with ttl to redis") {
+		return
+	}
+	if err := h.inMemoryStorage.Del(emailChangeAttemptsKeyPrefix + user.Id); err != nil {
+		h.log.Error("cannot delete email change attempts", logger.Error(err))
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	message, err := email.SendVerificationCode(ctx, h.mailer, email.EmailPayload{
+		To:        change.NewEmail,
+		Code:      code,
+		Message:   fmt.Sprintf("Hi, %s, confirm this is your new email address", user.FirstName),
+		ExpiresAt: time.Now().Add(time.Second * time.Duration(h.cfg.EmailChangeTTL)),
+	})
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while sending code to the new email") {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, models.Status{Message: message})
+}
+
+// Confirm email change
+// @Router /v1/me/email/confirm [post]
+// @Security BearerAuth
+// @Summary confirm my new email
+// @Tags User
+// @Description Apply a pending email change with the code sent to the new address. The old address is told about the change and gets a link to revert it. After VERIFY_MAX_ATTEMPTS wrong codes the change is dropped and has to be requested again.
+// @Accept json
+// @Produce json
+// @Param code body models.EmailChangeConfirmReq true "Code"
+// @Success 200 {object} models.UserPublic
+// @Header 200 {string} ETag "version of the updated user"
+// @Failure 400 string Error models.ResponseError
+// @Failure 404 string Error models.ResponseError
+// @Failure 409 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) ConfirmEmailChange(c *gin.Context) {
+	var body models.EmailChangeConfirmReq
+
+	err := c.ShouldBindJSON(&body)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidJSON) {
+		return
+	}
+
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	data, err := redis.Bytes(h.inMemoryStorage.Get(emailChangeKeyPrefix + user.Id))
+	if err == redis.ErrNil {
+		c.JSON(http.StatusNotFound, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeNotFound,
+				Message: "There is no pending email change, or its code is expired",
+			},
+		})
+		return
+	}
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading email change") {
+		return
+	}
+
+	var change emailChange
+	err = json.Unmarshal(data, &change)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "cannot unmarshal email change from redis") {
+		return
+	}
+	attempts, err := h.inMemoryStorage.IncrWithTTL(emailChangeAttemptsKeyPrefix+user.Id, h.cfg.EmailChangeTTL)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while counting email change attempts") {
+		return
+	}
+	if !etc.CompareHashCode(change.CodeHash, body.Code, h.cfg.VerifyCodeHashKey) || int(attempts) > h.cfg.VerifyMaxAttempts {
+		left := h.cfg.VerifyMaxAttempts - int(attempts)
+		message := fmt.Sprintf("Code is incorrect, %d attempts left", left)
+		if left <= 0 {
+			// Guessing is over, the change has to be requested again.
+			if err := h.inMemoryStorage.Del(emailChangeKeyPrefix+user.Id, emailChangeAttemptsKeyPrefix+user.Id); err != nil {
+				h.log.Error("cannot delete email change after failed attempts", logger.Error(err))
+			}
+			message = "Code is incorrect and no attempts are left, request the change again"
+		}
+		c.JSON(http.StatusBadRequest, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeInvalidCode,
+				Message: message,
+			},
+		})
+		return
+	}
+
+	// The address may have been taken since the code was sent.
+	if !h.emailAvailable(c, change.NewEmail) {
+		return
+	}
+
+	consumed, err := h.inMemoryStorage.DelIfEqual(emailChangeKeyPrefix+user.Id, string(data))
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while consuming email change") {
+		return
+	}
+	if !consumed {
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeConflict,
+				Message: "Email change was confirmed already or its code was replaced",
+			},
+		})
+		return
+	}
+	if err := h.inMemoryStorage.Del(emailChangeAttemptsKeyPrefix + user.Id); err != nil {
+		h.log.Error("cannot delete email change attempts", logger.Error(err))
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	respUser, err := grpcClient.ChangeEmail(ctx, h.serviceManager.UserService(), user, change.NewEmail)
+	if handleGrpcErrWithMessage(c, h.log, err, "error while changing email") {
+		return
+	}
+
+	h.sendEmailRevertLink(ctx, user, change.NewEmail)
+
+	h.publishEvent(c, events.UserEmailChanged, respUser.Id)
+	c.Header("ETag", userETag(respUser))
+
+	c.JSON(http.StatusOK, projection.User(c.Request.Context(), respUser))
+}
+
+// Show email revert
+// @Router /v1/email-reverts/{token} [get]
+// @Summary confirm reverting an email change
+// @Tags User
+// @Description Page behind the link sent to the old address. It changes nothing, since mail scanners open links too; its button posts the same token to revert the change.
+// @Produce html
+// @Param token path string true "token from the revert link"
+// @Success 200 string string
+// @Failure 404 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) ShowEmailRevert(c *gin.Context) {
+	_, revert, ok := h.pendingEmailRevert(c)
+	if !ok {
+		return
+	}
+
+	var page strings.Builder
+	err := emailRevertPage.Execute(&page, revert)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "cannot render email revert page") {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page.String()))
+}
+
+// Revert email change
+// @Router /v1/email-reverts/{token} [post]
+// @Summary revert an email change
+// @Tags User
+// @Description Put back the email a user had before their last change. The token comes from the link sent to the old address and is signed, so it needs no access token.
+// @Produce json
+// @Param token path string true "token from the revert link"
+// @Success 200 {object} models.Status
+// @Failure 404 string Error models.ResponseError
+// @Failure 409 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) RevertEmailChange(c *gin.Context) {
+	link, revert, ok := h.pendingEmailRevert(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	user, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
+		UserId: link.UserID,
+	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
+		return
+	}
+	if !strings.EqualFold(user.Email, revert.NewEmail) {
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeConflict,
+				Message: "Email was changed again since, this link no longer applies",
+			},
+		})
+		return
+	}
+	if !h.emailAvailable(c, revert.OldEmail) {
+		return
+	}
+
+	respUser, err := grpcClient.ChangeEmail(ctx, h.serviceManager.UserService(), user, revert.OldEmail)
+	if handleGrpcErrWithMessage(c, h.log, err, "error while reverting email") {
+		return
+	}
+
+	// Whoever changed the email must not finish another change with a code
+	// they already hold.
+	if err := h.inMemoryStorage.Del(emailRevertKeyPrefix+link.UserID, emailChangeKeyPrefix+link.UserID); err != nil {
+		h.log.Error("cannot delete email change state", logger.String("user_id", link.UserID), logger.Error(err))
+	}
+
+	h.publishEvent(c, events.UserEmailChanged, respUser.Id)
+
+	h.notifyEmail(ctx, revert.OldEmail, "Your email change was reverted", fmt.Sprintf(
+		"Hi %s, your email is %s again. If you did not ask for the change, change your password too.",
+		respUser.FirstName, revert.OldEmail,
+	))
+
+	c.JSON(http.StatusOK, models.Status{Message: "email change was reverted"})
+}
+
+// pendingEmailRevert checks the token of the request against the revert that
+// is still waiting, and answers 404 when there is none.
+func (h *handlerV1) pendingEmailRevert(c *gin.Context) (emailRevertLink, emailRevert, bool) {
+	var (
+		link   emailRevertLink
+		revert emailRevert
+	)
+	if err := cursor.Decode(c.Param("token"), h.cfg.EmailRevertSignInKey, &link); err != nil || time.Now().Unix() > link.ExpiresAt {
+		emailRevertNotFound(c)
+		return link, revert, false
+	}
+
+	data, err := redis.Bytes(h.inMemoryStorage.Get(emailRevertKeyPrefix + link.UserID))
+	if err == redis.ErrNil {
+		emailRevertNotFound(c)
+		return link, revert, false
+	}
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading email revert") {
+		return link, revert, false
+	}
+
+	err = json.Unmarshal(data, &revert)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "cannot unmarshal email revert from redis") {
+		return link, revert, false
+	}
+	if revert.ID != link.RevertID {
+		emailRevertNotFound(c)
+		return link, revert, false
+	}
+
+	return link, revert, true
+}
+
+// emailAvailable answers 409 when address belongs to a user already.
+func (h *handlerV1) emailAvailable(c *gin.Context, address string) bool {
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	exists, err := h.serviceManager.UserService().CheckField(ctx, &pbu.CheckFieldReq{
+		Value: address,
+		Field: "email",
+	})
+	if handleGrpcErrWithMessage(c, h.log, err, "failed to check email uniqueness") {
+		return false
+	}
+	if exists.Status {
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeAlreadyExists,
+				Message: "Email is used by another account",
+			},
+		})
+		return false
+	}
+
+	return true
+}
+
+// sendEmailRevertLink records the change and tells the old address about it.
+// The change is applied already, so failures are only logged.
+func (h *handlerV1) sendEmailRevertLink(ctx context.Context, user *pbu.User, newEmail string) {
+	revert := emailRevert{
+		ID:       uuid.New().String(),
+		OldEmail: user.Email,
+		NewEmail: newEmail,
+	}
+	data, err := json.Marshal(revert)
+	if err != nil {
+		h.log.Error("cannot marshal email revert", logger.Error(err))
+		return
+	}
+	if err := h.inMemoryStorage.SetWithTTL(emailRevertKeyPrefix+user.Id, string(data), h.cfg.EmailRevertTTL); err != nil {
+		h.log.Error("cannot save email revert", logger.String("user_id", user.Id), logger.Error(err))
+		return
+	}
+
+	expiresAt := time.Now().Add(time.Second * time.Duration(h.cfg.EmailRevertTTL))
+	token, err := cursor.Encode(emailRevertLink{
+		UserID:    user.Id,
+		RevertID:  revert.ID,
+		ExpiresAt: expiresAt.Unix(),
+	}, h.cfg.EmailRevertSignInKey)
+	if err != nil {
+		h.log.Error("cannot sign email revert link", logger.Error(err))
+		return
+	}
+
+	h.notifyEmail(ctx, revert.OldEmail, "Your email was changed", fmt.Sprintf(
+		"Hi %s, the email of your account was changed to %s. If you did not do this, open %s/v1/email-reverts/%s before %s to put this address back.",
+		user.FirstName, newEmail, strings.TrimSuffix(h.cfg.PublicURL, "/"), token, expiresAt.UTC().Format("2 January 2006 15:04 MST"),
+	))
+}
+
+func (h *handlerV1) notifyEmail(ctx context.Context, to, subject, message string) {
+	err := email.SendNotice(ctx, h.mailer, email.EmailPayload{
+		To:      to,
+		Message: message,
+	}, subject)
+	if err != nil {
+		h.log.Error("cannot send email notice", logger.String("subject", subject), logger.Error(err))
+	}
+}
+
+func emailRevertNotFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, models.ResponseError{
+		Error: models.StandardErrorModel{
+			Status:  ErrorCodeNotFound,
+			Message: "Revert link is invalid, expired or used already",
+		},
+	})
+}
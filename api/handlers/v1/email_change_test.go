@@ -0,0 +1,225 @@
+package v1
+
+import (
+	"myproject/api-gateway/api/models"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var revertLinkPattern = regexp.MustCompile(`/v1/email-reverts/([A-Za-z0-9_\-.]+)`)
+
+// changeEmail takes u1 from ann@example.com to to and returns the path of
+// the revert link sent to the old address.
+func (f handlerFixture) changeEmail(t *testing.T, to string) string {
+	t.Helper()
+
+	w := f.serve(http.MethodPost, "/v1/me/email", "u1", models.EmailChangeReq{Email: to})
+	wantStatus(t, w, http.StatusAccepted)
+
+	w = f.serve(http.MethodPost, "/v1/me/email/confirm", "u1", models.EmailChangeConfirmReq{Code: f.lastCode(t, to)})
+	wantStatus(t, w, http.StatusOK)
+
+	messages := f.mailer.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To != "ann@example.com" {
+			continue
+		}
+		if match := revertLinkPattern.FindStringSubmatch(messages[i].HTML); match != nil {
+			return "/v1/email-reverts/" + match[1]
+		}
+	}
+	t.Fatal("no revert link was sent to the old address")
+	return ""
+}
+
+func newEmailChangeFixture(t *testing.T) handlerFixture {
+	t.Helper()
+
+	f := newHandlerFixture(t)
+	f.users.users["u1"] = &pbu.User{Id: "u1", FirstName: "Ann", Email: "ann@example.com"}
+	f.users.users["u2"] = &pbu.User{Id: "u2", FirstName: "Bob", Email: "bob@example.com"}
+	return f
+}
+
+func TestRequestEmailChange(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "new address", email: "ann.new@example.com", wantStatus: http.StatusAccepted},
+		{name: "current address", email: "ANN@example.com", wantStatus: http.StatusBadRequest, wantError: ErrorValidationError},
+		{name: "taken address", email: "bob@example.com", wantStatus: http.StatusConflict, wantError: ErrorCodeAlreadyExists},
+		{name: "not an address", email: "ann", wantStatus: http.StatusBadRequest, wantError: ErrorValidationError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newEmailChangeFixture(t)
+
+			w := f.serve(http.MethodPost, "/v1/me/email", "u1", models.EmailChangeReq{Email: tt.email})
+			wantStatus(t, w, tt.wantStatus)
+			if tt.wantError != "" {
+				if got := errorStatus(t, w); got != tt.wantError {
+					t.Errorf("error status %s, want %s", got, tt.wantError)
+				}
+				return
+			}
+
+			f.lastCode(t, tt.email)
+			if got := f.users.user("u1").Email; got != "ann@example.com" {
+				t.Errorf("email changed to %s before it was confirmed", got)
+			}
+		})
+	}
+}
+
+func TestConfirmEmailChange(t *testing.T) {
+	tests := []struct {
+		name string
+		// codes are tried in order, "right" standing for the code sent.
+		codes      []string
+		wantStatus int
+		wantEmail  string
+	}{
+		{
+			name:       "right code",
+			codes:      []string{"right"},
+			wantStatus: http.StatusOK,
+			wantEmail:  "ann.new@example.com",
+		},
+		{
+			name:       "wrong code",
+			codes:      []string{"00000"},
+			wantStatus: http.StatusBadRequest,
+			wantEmail:  "ann@example.com",
+		},
+		{
+			name:       "right code once attempts are used up",
+			codes:      []string{"00000", "00000", "00000", "right"},
+			wantStatus: http.StatusNotFound,
+			wantEmail:  "ann@example.com",
+		},
+		{
+			name:       "code is consumed",
+			codes:      []string{"right", "right"},
+			wantStatus: http.StatusNotFound,
+			wantEmail:  "ann.new@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newEmailChangeFixture(t)
+
+			w := f.serve(http.MethodPost, "/v1/me/email", "u1", models.EmailChangeReq{Email: "ann.new@example.com"})
+			wantStatus(t, w, http.StatusAccepted)
+			sent := f.lastCode(t, "ann.new@example.com")
+
+			for _, code := range tt.codes {
+				if code == "right" {
+					code = sent
+				}
+				w = f.serve(http.MethodPost, "/v1/me/email/confirm", "u1", models.EmailChangeConfirmReq{Code: code})
+			}
+			wantStatus(t, w, tt.wantStatus)
+
+			if got := f.users.user("u1").Email; got != tt.wantEmail {
+				t.Errorf("email %s, want %s", got, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestEmailRevert(t *testing.T) {
+	tests := []struct {
+		name string
+		// after runs between the change and opening the link.
+		after      func(t *testing.T, f handlerFixture, link string) string
+		wantShow   int
+		wantRevert int
+		wantEmail  string
+	}{
+		{
+			name:       "revert",
+			after:      func(t *testing.T, f handlerFixture, link string) string { return link },
+			wantShow:   http.StatusOK,
+			wantRevert: http.StatusOK,
+			wantEmail:  "ann@example.com",
+		},
+		{
+			name: "used already",
+			after: func(t *testing.T, f handlerFixture, link string) string {
+				wantStatus(t, f.serve(http.MethodPost, link, "", nil), http.StatusOK)
+				return link
+			},
+			wantShow:   http.StatusNotFound,
+			wantRevert: http.StatusNotFound,
+			wantEmail:  "ann@example.com",
+		},
+		{
+			name: "tampered link",
+			after: func(t *testing.T, f handlerFixture, link string) string {
+				return link[:len(link)-2] + "xx"
+			},
+			wantShow:   http.StatusNotFound,
+			wantRevert: http.StatusNotFound,
+			wantEmail:  "ann.new@example.com",
+		},
+		{
+			name: "changed again since",
+			after: func(t *testing.T, f handlerFixture, link string) string {
+				f.users.user("u1").Email = "ann.third@example.com"
+				return link
+			},
+			wantShow:   http.StatusOK,
+			wantRevert: http.StatusConflict,
+			wantEmail:  "ann.third@example.com",
+		},
+		{
+			name: "old address taken meanwhile",
+			after: func(t *testing.T, f handlerFixture, link string) string {
+				f.users.users["u3"] = &pbu.User{Id: "u3", Email: "ann@example.com"}
+				return link
+			},
+			wantShow:   http.StatusOK,
+			wantRevert: http.StatusConflict,
+			wantEmail:  "ann.new@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newEmailChangeFixture(t)
+			link := tt.after(t, f, f.changeEmail(t, "ann.new@example.com"))
+
+			// Opening the link only shows what the revert would do.
+			before := f.users.user("u1").Email
+			w := f.serve(http.MethodGet, link, "", nil)
+			wantStatus(t, w, tt.wantShow)
+			if tt.wantShow == http.StatusOK {
+				page := w.Body.String()
+				if !strings.Contains(page, `<form method="post">`) || !strings.Contains(page, "ann.new@example.com") {
+					t.Errorf("revert page has no form for the change: %s", page)
+				}
+				if got := w.Header().Get("Cache-Control"); got != "no-store" {
+					t.Errorf("Cache-Control %q, want no-store", got)
+				}
+			}
+			if got := f.users.user("u1").Email; got != before {
+				t.Fatalf("opening the link changed the email from %s to %s", before, got)
+			}
+
+			w = f.serve(http.MethodPost, link, "", nil)
+			wantStatus(t, w, tt.wantRevert)
+
+			if got := f.users.user("u1").Email; got != tt.wantEmail {
+				t.Errorf("email %s, want %s", got, tt.wantEmail)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/pkg/logger"
+	"net/http"
+)
+
+// StatusClientClosedRequest is used when the client went away before the
+// backend answered. Nobody reads the response, but it keeps the access log honest.
+const StatusClientClosedRequest = 499
+
+type grpcErrorMapping struct {
+	httpStatus int
+	errorCode  string
+}
+
+var grpcErrorMappings = map[codes.Code]grpcErrorMapping{
+	codes.InvalidArgument:    {http.StatusBadRequest, ErrorBadRequest},
+	codes.FailedPrecondition: {http.StatusBadRequest, ErrorBadRequest},
+	codes.OutOfRange:         {http.StatusBadRequest, ErrorBadRequest},
+	codes.Unauthenticated:    {http.StatusUnauthorized, ErrorCodeUnauthorized},
+	codes.PermissionDenied:   {http.StatusForbidden, ErrorCodeForbidden},
+	codes.NotFound:           {http.StatusNotFound, ErrorCodeNotFound},
+	codes.AlreadyExists:      {http.StatusConflict, ErrorCodeAlreadyExists},
+	codes.Aborted:            {http.StatusConflict, ErrorCodeConflict},
+	codes.ResourceExhausted:  {http.StatusTooManyRequests, ErrorCodeTooManyRequests},
+	codes.Canceled:           {StatusClientClosedRequest, ErrorCodeCanceled},
+	codes.Unimplemented:      {http.StatusNotImplemented, ErrorCodeNotImplemented},
+	codes.Unavailable:        {http.StatusServiceUnavailable, ErrorCodeServiceUnavailable},
+	codes.DeadlineExceeded:   {http.StatusGatewayTimeout, ErrorCodeGatewayTimeout},
+}
+
+// TranslateGrpcError maps an error returned by a backend call to the HTTP
+// status and error model sent to the client. Backend messages are only passed
+// through for client errors; server errors get a generic message.
+func TranslateGrpcError(err error) (int, models.StandardErrorModel, *errdetails.RetryInfo) {
+	st, ok := status.FromError(err)
+	if !ok {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			st = status.New(codes.DeadlineExceeded, err.Error())
+		case errors.Is(err, context.Canceled):
+			st = status.New(codes.Canceled, err.Error())
+		default:
+			st = status.New(codes.Internal, err.Error())
+		}
+	}
+
+	mapping, ok := grpcErrorMappings[st.Code()]
+	if !ok {
+		mapping = grpcErrorMapping{http.StatusInternalServerError, ErrorCodeInternalServerError}
+	}
+
+	model := models.StandardErrorModel{
+		Status:  mapping.errorCode,
+		Message: st.Message(),
+	}
+
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.BadRequest:
+			model.Status = ErrorValidationError
+			for _, violation := range d.GetFieldViolations() {
+				model.Violations = append(model.Violations, models.FieldViolation{
+					Field:       violation.GetField(),
+					Description: violation.GetDescription(),
+				})
+			}
+		case *errdetails.LocalizedMessage:
+			model.Message = d.GetMessage()
+		case *errdetails.RetryInfo:
+			retryInfo = d
+		}
+	}
+
+	switch mapping.httpStatus {
+	case http.StatusGatewayTimeout:
+		model.Message = "The request took too long, try again later"
+	case http.StatusServiceUnavailable:
+		model.Message = "Service is temporarily unavailable, try again later"
+	case http.StatusInternalServerError, http.StatusNotImplemented:
+		model.Message = "Sorry, try again"
+	}
+
+	return mapping.httpStatus, model, retryInfo
+}
+
+// handleGrpcErrWithMessage writes the translated backend error, if any.
+func handleGrpcErrWithMessage(c *gin.Context, log logger.Logger, err error, message string) bool {
+	if err == nil {
+		return false
+	}
+
+	httpStatus, model, retryInfo := TranslateGrpcError(err)
+	if delay := retryInfo.GetRetryDelay(); delay != nil {
+		c.Header("Retry-After", fmt.Sprint(int64(math.Ceil(delay.AsDuration().Seconds()))))
+	}
+
+	c.JSON(httpStatus, models.ResponseError{
+		Error: model,
+	})
+
+	if httpStatus >= http.StatusInternalServerError {
+		log.Error(message, logger.Error(err))
+	} else {
+		log.Warn(message, logger.Error(err))
+	}
+	return true
+}
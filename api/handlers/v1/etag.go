@@ -0,0 +1,73 @@
+package v1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"myproject/api-gateway/api/models"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"net/http"
+	"strings"
+)
+
+// userETag changes whenever the user is updated. It is derived from
+// updated_at, and from the profile itself when the backend leaves it empty.
+func userETag(user *pbu.User) string {
+	version := user.UpdatedAt
+	if version == "" {
+		version = strings.Join([]string{user.FirstName, user.LastName, user.BirthDate, user.Email}, "\x00")
+	}
+
+	sum := sha256.Sum256([]byte(user.Id + "\x00" + version))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether etag is in a comma separated If-Match or
+// If-None-Match header. Weak validators compare equal to strong ones when
+// weak is set, as If-None-Match requires.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified answers 304 when the client already has the current version.
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+
+	header := c.GetHeader("If-None-Match")
+	if header == "" || !etagMatches(header, etag, true) {
+		return false
+	}
+
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// preconditionFailed answers 412 when If-Match is set and the user was
+// changed since the client read it.
+func preconditionFailed(c *gin.Context, current *pbu.User) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" || etagMatches(header, userETag(current), false) {
+		return false
+	}
+
+	c.JSON(http.StatusPreconditionFailed, models.ResponseError{
+		Error: models.StandardErrorModel{
+			Status:  ErrorCodePreconditionFailed,
+			Message: "User was modified by someone else, reload it and try again",
+		},
+	})
+	return true
+}
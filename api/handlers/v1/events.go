@@ -0,0 +1,171 @@
+package v1
+
+import (
+	"fmt"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"io"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	eventsHeartbeat    = 30 * time.Second
+	eventsWriteTimeout = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// subscriptionTypes reads the requested event types from the "types" query
+// parameter and checks with casbin that the caller may subscribe to each one.
+func (h *handlerV1) subscriptionTypes(c *gin.Context) ([]string, bool) {
+	types := events.UserEventTypes
+	if query := c.Query("types"); query != "" {
+		types = strings.Split(query, ",")
+	}
+
+	role := "unauthorized"
+	if id, ok := identity.FromContext(c.Request.Context()); ok && id.Role != "" {
+		role = id.Role
+	}
+
+	for _, eventType := range types {
+		known := false
+		for _, t := range events.UserEventTypes {
+			known = known || t == eventType
+		}
+		if !known {
+			handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("unknown event type %q", eventType), ErrorCodeInvalidParams)
+			return nil, false
+		}
+
+		allowed, err := h.casbin.Enforce(role, "/v1/events/users/"+eventType, "SUBSCRIBE")
+		if handleInternalServerErrorWithMessage(c, h.log, err, "error while checking event permissions") {
+			return nil, false
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, models.ResponseError{
+				Error: models.StandardErrorModel{
+					Status:  ErrorCodeForbidden,
+					Message: fmt.Sprintf("You are not allowed to subscribe to %s", eventType),
+				},
+			})
+			return nil, false
+		}
+	}
+
+	return types, true
+}
+
+// Stream user events
+// @Router /v1/events/users [get]
+// @Security BearerAuth
+// @Summary stream user events
+// @Tags Events
+// @Description Server-Sent Events stream of user changes made on any gateway replica
+// @Produce text/event-stream
+// @Param types query string false "comma separated event types, all by default"
+// @Success 200 {object} events.Event
+// @Failure 400 string Error models.ResponseError
+// @Failure 403 string Error models.ResponseError
+func (h *handlerV1) StreamUserEvents(c *gin.Context) {
+	types, ok := h.subscriptionTypes(c)
+	if !ok {
+		return
+	}
+
+	sub := h.events.Subscribe(types)
+	defer sub.Close()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-sub.Events():
+			c.Render(-1, sse.Event{
+				Id:    event.ID,
+				Event: event.Type,
+				Data:  event,
+			})
+			return true
+		case <-heartbeat.C:
+			c.Render(-1, sse.Event{
+				Event: "ping",
+				Data:  time.Now().Unix(),
+			})
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// User events over WebSocket
+// @Router /v1/events/users/ws [get]
+// @Security BearerAuth
+// @Summary user events over websocket
+// @Tags Events
+// @Description WebSocket stream of user changes, every message is one JSON encoded event
+// @Param types query string false "comma separated event types, all by default"
+// @Success 101 {object} events.Event
+// @Failure 400 string Error models.ResponseError
+// @Failure 403 string Error models.ResponseError
+func (h *handlerV1) UserEventsWebSocket(c *gin.Context) {
+	types, ok := h.subscriptionTypes(c)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		h.log.Warn("cannot upgrade to websocket", logger.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	sub := h.events.Subscribe(types)
+	defer sub.Close()
+
+	// Clients only listen; reading is needed to notice when they go away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-sub.Events():
+			_ = conn.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventsWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
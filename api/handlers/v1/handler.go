@@ -1,19 +1,30 @@
 package v1
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/casbin/casbin/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"myproject/api-gateway/api/handlers/tokens"
 	"myproject/api-gateway/api/models"
 	"myproject/api-gateway/config"
+	"myproject/api-gateway/email"
+	"myproject/api-gateway/pkg/blob"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/identity"
 	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/outbox"
+	"myproject/api-gateway/pkg/privacy"
 	grpcClient "myproject/api-gateway/services"
 	"myproject/api-gateway/storage/repo"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type handlerV1 struct {
@@ -23,6 +34,11 @@ type handlerV1 struct {
 	cfg             config.Config
 	jwtHandler      tokens.JWTHandler
 	casbin          *casbin.Enforcer
+	events          *events.Broker
+	erasures        *privacy.Erasures
+	blobs           blob.Store
+	mailer          email.Mailer
+	outbox          *outbox.Outbox
 }
 
 type HandlerV1Config struct {
@@ -32,6 +48,11 @@ type HandlerV1Config struct {
 	Cfg             config.Config
 	JwtHandler      tokens.JWTHandler
 	Casbin          *casbin.Enforcer
+	Events          *events.Broker
+	Erasures        *privacy.Erasures
+	Blobs           blob.Store
+	Mailer          email.Mailer
+	Outbox          *outbox.Outbox
 }
 
 func New(h *HandlerV1Config) *handlerV1 {
@@ -42,6 +63,11 @@ func New(h *HandlerV1Config) *handlerV1 {
 		cfg:             h.Cfg,
 		jwtHandler:      h.JwtHandler,
 		casbin:          h.Casbin,
+		events:          h.Events,
+		erasures:        h.Erasures,
+		blobs:           h.Blobs,
+		mailer:          h.Mailer,
+		outbox:          h.Outbox,
 	}
 }
 
@@ -58,10 +84,42 @@ const (
 	ErrorInvalidCredentials      = "INVALID_CREDENTIALS"
 	StatusMethodNotAllowed       = "METHOD_NOT_ALLOWED"
 	ErrorValidationError         = "VALIDATION_ERROR"
+	ErrorCodeGatewayTimeout      = "GATEWAY_TIMEOUT"
+	ErrorCodeForbidden           = "FORBIDDEN"
+	ErrorCodeConflict            = "CONFLICT"
+	ErrorCodeTooManyRequests     = "TOO_MANY_REQUESTS"
+	ErrorCodeCanceled            = "REQUEST_CANCELED"
+	ErrorCodeNotImplemented      = "NOT_IMPLEMENTED"
+	ErrorCodeServiceUnavailable  = "SERVICE_UNAVAILABLE"
+	ErrorCodeBadGateway          = "BAD_GATEWAY"
+	ErrorCodeIdempotencyReused   = "IDEMPOTENCY_KEY_REUSED"
+	ErrorCodePreconditionFailed  = "PRECONDITION_FAILED"
+	ErrorCodePayloadTooLarge     = "PAYLOAD_TOO_LARGE"
+	ErrorCodeUnsupportedMedia    = "UNSUPPORTED_MEDIA_TYPE"
 )
 
+// requestContext derives the RPC context from the incoming request, so a client
+// disconnect cancels the backend call. CtxTimeout is only applied when no
+// deadline was set by middleware.Timeout.
+func (h *handlerV1) requestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	ctx := c.Request.Context()
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Second*time.Duration(h.cfg.CtxTimeout))
+}
+
 func ParsePageQueryParam(c *gin.Context) (int, error) {
-	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	return parsePage(c.DefaultQuery("page", "1"))
+}
+
+func ParseLimitQueryParam(c *gin.Context) (int, error) {
+	return parseLimit(c.DefaultQuery("limit", "10"))
+}
+
+func parsePage(value string) (int, error) {
+	page, err := strconv.Atoi(value)
 	if err != nil {
 		return 0, err
 	}
@@ -75,8 +133,8 @@ func ParsePageQueryParam(c *gin.Context) (int, error) {
 	return page, nil
 }
 
-func ParseLimitQueryParam(c *gin.Context) (int, error) {
-	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+func parseLimit(value string) (int, error) {
+	limit, err := strconv.Atoi(value)
 	if err != nil {
 		return 0, err
 	}
@@ -91,6 +149,26 @@ func ParseLimitQueryParam(c *gin.Context) (int, error) {
 	return limit, nil
 }
 
+// publishEvent announces a user change and adds it to the user's audit log.
+// Failing either does not fail the request that caused it.
+func (h *handlerV1) publishEvent(c *gin.Context, eventType, userID string) {
+	id, _ := identity.FromContext(c.Request.Context())
+
+	event := events.Event{
+		ID:         uuid.New().String(),
+		Type:       eventType,
+		UserID:     userID,
+		RequestID:  id.RequestID,
+		OccurredAt: time.Now().UTC(),
+	}
+	if err := h.events.Publish(event); err != nil {
+		h.log.Error("cannot publish user event", logger.String("type", eventType), logger.Error(err))
+	}
+	if err := privacy.RecordAudit(h.inMemoryStorage, event); err != nil {
+		h.log.Error("cannot record audit entry", logger.String("type", eventType), logger.Error(err))
+	}
+}
+
 func handleBadRequestErrWithMessage(c *gin.Context, log logger.Logger, err error, status string) bool {
 	if err != nil {
 		c.JSON(http.StatusBadRequest, models.ResponseError{
@@ -105,7 +183,21 @@ func handleBadRequestErrWithMessage(c *gin.Context, log logger.Logger, err error
 	return false
 }
 
+// handleInternalServerErrorWithMessage answers 504 when err is a deadline
+// that ran out, such as redis or the outbox outliving the route timeout, and
+// 500 otherwise.
 func handleInternalServerErrorWithMessage(c *gin.Context, log logger.Logger, err error, message string) bool {
+	if isDeadlineExceeded(err) {
+		c.JSON(http.StatusGatewayTimeout, models.ResponseError{
+			Error: models.ServerError{
+				Status:  ErrorCodeGatewayTimeout,
+				Message: "The request took too long, try again later",
+			},
+		})
+		log.Error(message, logger.Error(err))
+		return true
+	}
+
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ResponseError{
 			Error: models.ServerError{
@@ -119,3 +211,11 @@ func handleInternalServerErrorWithMessage(c *gin.Context, log logger.Logger, err
 
 	return false
 }
+
+func isDeadlineExceeded(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded
+}
@@ -0,0 +1,212 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/email"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/storage/memory"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeUserService keeps users in a map, by id.
+type fakeUserService struct {
+	pbu.UserServiceClient
+
+	mu        sync.Mutex
+	users     map[string]*pbu.User
+	createErr error
+}
+
+func (s *fakeUserService) CreateUser(ctx context.Context, in *pbu.User, opts ...grpc.CallOption) (*pbu.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.createErr != nil {
+		return nil, s.createErr
+	}
+	s.users[in.Id] = proto.Clone(in).(*pbu.User)
+	return in, nil
+}
+
+func (s *fakeUserService) GetUserById(ctx context.Context, in *pbu.GetUserReqById, opts ...grpc.CallOption) (*pbu.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[in.UserId]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return proto.Clone(user).(*pbu.User), nil
+}
+
+func (s *fakeUserService) UpdateUser(ctx context.Context, in *pbu.User, opts ...grpc.CallOption) (*pbu.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[in.Id] = proto.Clone(in).(*pbu.User)
+	return in, nil
+}
+
+func (s *fakeUserService) CheckField(ctx context.Context, in *pbu.CheckFieldReq, opts ...grpc.CallOption) (*pbu.CheckFieldResp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if in.Field == "email" && strings.EqualFold(user.Email, in.Value) {
+			return &pbu.CheckFieldResp{Status: true}, nil
+		}
+	}
+	return &pbu.CheckFieldResp{}, nil
+}
+
+func (s *fakeUserService) user(id string) *pbu.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.users[id]
+}
+
+type fakeServiceManager struct {
+	users *fakeUserService
+}
+
+func (m fakeServiceManager) UserService() pbu.UserServiceClient {
+	return m.users
+}
+
+type handlerFixture struct {
+	router  *gin.Engine
+	storage *memory.Storage
+	users   *fakeUserService
+	mailer  *email.Recorder
+	cfg     config.Config
+}
+
+// newHandlerFixture serves the v1 routes under test. Requests carrying
+// X-Test-User are signed in as that user.
+func newHandlerFixture(t *testing.T) handlerFixture {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	storage := memory.New()
+	users := &fakeUserService{users: make(map[string]*pbu.User)}
+	mailer := email.NewRecorder()
+	log := logger.New("error", "test")
+	cfg := config.Config{
+		CtxTimeout:           5,
+		AccessTokenTimeOut:   60,
+		SignInKey:            "test-sign-in-key",
+		VerifyCodeTTL:        300,
+		VerifyMaxAttempts:    3,
+		VerifyDailySendCap:   5,
+		VerifyCodeHashKey:    "test-code-key",
+		EmailChangeTTL:       900,
+		EmailRevertTTL:       3600,
+		EmailRevertSignInKey: "test-revert-key",
+		PublicURL:            "http://gateway.test",
+	}
+
+	h := New(&HandlerV1Config{
+		InMemoryStorage: storage,
+		Log:             log,
+		ServiceManager:  fakeServiceManager{users},
+		Cfg:             cfg,
+		Events:          events.NewBroker(storage, log),
+		Mailer:          mailer,
+	})
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		id := identity.Identity{UserID: c.GetHeader("X-Test-User"), Role: "user"}
+		c.Request = c.Request.WithContext(identity.WithIdentity(c.Request.Context(), id))
+	})
+	api := router.Group("/v1")
+	api.POST("/register", h.Register)
+	api.POST("/verify", h.Verify)
+	api.POST("/me/email", h.RequestEmailChange)
+	api.POST("/me/email/confirm", h.ConfirmEmailChange)
+	api.GET("/email-reverts/:token", h.ShowEmailRevert)
+	api.POST("/email-reverts/:token", h.RevertEmailChange)
+
+	return handlerFixture{router: router, storage: storage, users: users, mailer: mailer, cfg: cfg}
+}
+
+// serve sends body as JSON, signed in as userID unless it is empty.
+func (f handlerFixture) serve(method, path, userID string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if userID != "" {
+		req.Header.Set("X-Test-User", userID)
+	}
+
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	return w
+}
+
+// errorStatus is the status code inside an error response.
+func errorStatus(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var resp struct {
+		Error struct {
+			Status string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("cannot read error response %s: %v", w.Body, err)
+	}
+	return resp.Error.Status
+}
+
+var codePattern = regexp.MustCompile(`<div class="otp-display">(\d+)</div>`)
+
+// lastCode returns the code in the last email sent to to.
+func (f handlerFixture) lastCode(t *testing.T, to string) string {
+	t.Helper()
+
+	messages := f.mailer.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To != to {
+			continue
+		}
+		if match := codePattern.FindStringSubmatch(messages[i].HTML); match != nil {
+			return match[1]
+		}
+	}
+	t.Fatalf("no code was sent to %s", to)
+	return ""
+}
+
+func wantStatus(t *testing.T, w *httptest.ResponseRecorder, code int) {
+	t.Helper()
+
+	if w.Code != code {
+		t.Fatalf("status %d, want %d: %s", w.Code, code, w.Body)
+	}
+	if code >= http.StatusBadRequest && w.Body.Len() == 0 {
+		t.Fatal("error response has no body")
+	}
+}
@@ -0,0 +1,104 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/pkg/outbox"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// streamIDPattern matches redis stream ids, which dead mail is known by.
+var streamIDPattern = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
+
+// List dead mail
+// @Router /v1/admin/mail/dead [get]
+// @Security BearerAuth
+// @Summary list dead mail
+// @Tags Mail
+// @Description List emails that failed every delivery attempt, oldest first. The body is not returned.
+// @Produce json
+// @Param limit query int false "page size" default(10)
+// @Param cursor query string false "next_cursor of the previous page"
+// @Success 200 {object} models.DeadMailPage
+// @Failure 400 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) ListDeadMail(c *gin.Context) {
+	limit, err := ParseLimitQueryParam(c)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams) {
+		return
+	}
+	if h.cfg.ListUsersMaxLimit > 0 && limit > h.cfg.ListUsersMaxLimit {
+		limit = h.cfg.ListUsersMaxLimit
+	}
+
+	after := c.Query("cursor")
+	if after != "" && !streamIDPattern.MatchString(after) {
+		handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("invalid cursor"), ErrorCodeInvalidParams)
+		return
+	}
+
+	// One more than asked tells whether there is a next page.
+	letters, err := h.outbox.Dead(after, limit+1)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while listing dead mail") {
+		return
+	}
+
+	page := models.DeadMailPage{Messages: []models.DeadMail{}}
+	if len(letters) > limit {
+		letters = letters[:limit]
+		page.NextCursor = letters[limit-1].ID
+	}
+	for _, letter := range letters {
+		page.Messages = append(page.Messages, models.DeadMail{
+			ID:         letter.ID,
+			To:         letter.To,
+			Subject:    letter.Subject,
+			Attempts:   letter.Attempts,
+			LastError:  letter.LastError,
+			EnqueuedAt: letter.EnqueuedAt.Format(time.RFC3339),
+			FailedAt:   letter.FailedAt.Format(time.RFC3339),
+		})
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// Retry dead mail
+// @Router /v1/admin/mail/dead/{id}/retry [post]
+// @Security BearerAuth
+// @Summary retry dead mail
+// @Tags Mail
+// @Description Queue a dead email again with a fresh set of delivery attempts
+// @Produce json
+// @Param id path string true "id"
+// @Success 202 {object} models.Status
+// @Failure 400 string Error models.ResponseError
+// @Failure 404 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) RetryDeadMail(c *gin.Context) {
+	id := c.Param("id")
+	if !streamIDPattern.MatchString(id) {
+		handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("invalid id"), ErrorCodeInvalidParams)
+		return
+	}
+
+	err := h.outbox.Retry(id)
+	if errors.Is(err, outbox.ErrNotFound) {
+		c.JSON(http.StatusNotFound, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeNotFound,
+				Message: "There is no such dead mail",
+			},
+		})
+		return
+	}
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while retrying dead mail") {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, models.Status{Message: "mail was queued again"})
+}
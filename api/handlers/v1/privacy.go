@@ -0,0 +1,356 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/api/projection"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/avatar"
+	"myproject/api-gateway/pkg/cursor"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/privacy"
+	"net/http"
+	"time"
+)
+
+// dataExportLink is signed into the download URL, so the download needs no
+// token and works until ExpiresAt.
+type dataExportLink struct {
+	UserID    string `json:"u"`
+	ExportID  string `json:"e"`
+	ExpiresAt int64  `json:"x"`
+}
+
+// Export my data
+// @Router /v1/me/data-export [post]
+// @Security BearerAuth
+// @Summary export my data
+// @Tags Privacy
+// @Description Build a JSON archive of the caller's profile, avatar, recent sign-ins and audit log. It is downloaded from download_url, without a token, until expires_at. A new export replaces the previous one.
+// @Produce json
+// @Success 201 {object} models.DataExportResp
+// @Failure 401 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) RequestDataExport(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	erasure, err := h.erasures.Get(user.Id)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading erasure request") {
+		return
+	}
+
+	now := time.Now().UTC()
+	archive := models.DataExportArchive{
+		ExportID:  uuid.New().String(),
+		CreatedAt: now.Format(time.RFC3339),
+		Profile:   projection.User(c.Request.Context(), user),
+		Erasure:   erasureStatus(erasure),
+	}
+
+	sessions, err := privacy.Sessions(h.inMemoryStorage, user.Id)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading sessions") {
+		return
+	}
+	archive.Sessions = make([]models.DataExportSession, 0, len(sessions))
+	for _, session := range sessions {
+		archive.Sessions = append(archive.Sessions, models.DataExportSession{
+			Method:    session.Method,
+			IP:        session.IP,
+			UserAgent: session.UserAgent,
+			RequestID: session.RequestID,
+			StartedAt: session.StartedAt.Format(time.RFC3339),
+			ExpiresAt: session.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+
+	audit, err := privacy.AuditEntries(h.inMemoryStorage, user.Id)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading audit log") {
+		return
+	}
+	archive.Audit = make([]models.DataExportAuditEntry, 0, len(audit))
+	for _, entry := range audit {
+		archive.Audit = append(archive.Audit, models.DataExportAuditEntry{
+			EventID:    entry.EventID,
+			Type:       entry.Type,
+			RequestID:  entry.RequestID,
+			OccurredAt: entry.OccurredAt.Format(time.RFC3339),
+		})
+	}
+
+	current, err := avatar.Load(c.Request.Context(), h.blobs, user.Id)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading avatar") {
+		return
+	}
+	if current != nil {
+		response, err := h.avatarResponse(user.Id, *current)
+		if handleInternalServerErrorWithMessage(c, h.log, err, "error while signing avatar urls") {
+			return
+		}
+		archive.Avatar = &response
+	}
+
+	data, err := json.Marshal(archive)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while building data export") {
+		return
+	}
+
+	err = privacy.SaveExport(h.inMemoryStorage, user.Id, data, h.cfg.DataExportTTL)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while saving data export") {
+		return
+	}
+
+	expiresAt := now.Add(time.Second * time.Duration(h.cfg.DataExportTTL))
+	token, err := cursor.Encode(dataExportLink{
+		UserID:    user.Id,
+		ExportID:  archive.ExportID,
+		ExpiresAt: expiresAt.Unix(),
+	}, h.cfg.DataExportSignInKey)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while signing download link") {
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.DataExportResp{
+		ExportID:    archive.ExportID,
+		DownloadURL: "/v1/data-exports/" + token,
+		ExpiresAt:   expiresAt.Format(time.RFC3339),
+	})
+}
+
+// Download data export
+// @Router /v1/data-exports/{token} [get]
+// @Summary download data export
+// @Tags Privacy
+// @Description Download an archive built by POST /v1/me/data-export. The link is signed, so it needs no token.
+// @Produce json
+// @Param token path string true "token from download_url"
+// @Success 200 {object} models.DataExportArchive
+// @Failure 404 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) DownloadDataExport(c *gin.Context) {
+	var link dataExportLink
+	if err := cursor.Decode(c.Param("token"), h.cfg.DataExportSignInKey, &link); err != nil || time.Now().Unix() > link.ExpiresAt {
+		dataExportNotFound(c)
+		return
+	}
+
+	data, err := privacy.LoadExport(h.inMemoryStorage, link.UserID)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading data export") {
+		return
+	}
+	if data == nil {
+		dataExportNotFound(c)
+		return
+	}
+
+	var archive models.DataExportArchive
+	err = json.Unmarshal(data, &archive)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading data export") {
+		return
+	}
+	// An older link must not download a newer export.
+	if archive.ExportID != link.ExportID {
+		dataExportNotFound(c)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="data-export-%s.json"`, archive.ExportID))
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// recordSession adds a sign-in to the user's history, which is part of their
+// data export. Failing to record it does not fail the sign-in.
+func (h *handlerV1) recordSession(c *gin.Context, userID, method string) {
+	id, _ := identity.FromContext(c.Request.Context())
+	now := time.Now().UTC()
+
+	err := privacy.RecordSession(h.inMemoryStorage, userID, privacy.Session{
+		Method:    method,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		RequestID: id.RequestID,
+		StartedAt: now,
+		ExpiresAt: now.Add(time.Second * time.Duration(h.cfg.AccessTokenTimeOut)),
+	})
+	if err != nil {
+		h.log.Error("cannot record session", logger.Error(err))
+	}
+}
+
+func dataExportNotFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, models.ResponseError{
+		Error: models.StandardErrorModel{
+			Status:  ErrorCodeNotFound,
+			Message: "Download link is invalid or expired, request a new export",
+		},
+	})
+}
+
+// Request erasure
+// @Router /v1/me/erasure [post]
+// @Security BearerAuth
+// @Summary request erasure of my data
+// @Tags Privacy
+// @Description Schedule the erasure of the caller's account and data after a cooling-off period. A confirmation email is sent, and the request can be cancelled until it is carried out.
+// @Produce json
+// @Success 202 {object} models.ErasureStatus
+// @Failure 401 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) RequestErasure(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	request, err := h.erasures.Request(ctx, user)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while requesting erasure") {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, erasureStatus(&request))
+}
+
+// Cancel erasure
+// @Router /v1/me/erasure [delete]
+// @Security BearerAuth
+// @Summary cancel erasure of my data
+// @Tags Privacy
+// @Description Cancel a pending erasure request of the caller
+// @Produce json
+// @Success 200 {object} models.Status
+// @Failure 404 string Error models.ResponseError
+// @Failure 409 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) CancelErasure(c *gin.Context) {
+	id, _ := identity.FromContext(c.Request.Context())
+	h.cancelErasure(c, id.UserID)
+}
+
+// Erase user
+// @Router /v1/users/{id}/erasure [post]
+// @Security BearerAuth
+// @Summary erase user
+// @Tags Privacy
+// @Description Erase a user and their data now, skipping the cooling-off period of a pending request
+// @Produce json
+// @Param id path string true "id"
+// @Success 200 {object} models.Status
+// @Failure 404 string Error models.ResponseError
+// @Failure 409 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) EraseUser(c *gin.Context) {
+	id := c.Param("id")
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	_, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
+		UserId: id,
+	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
+		return
+	}
+
+	err = h.erasures.Execute(ctx, id)
+	if err == privacy.ErrErasureRunning {
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeConflict,
+				Message: "User is being erased already",
+			},
+		})
+		return
+	}
+	if handleGrpcErrWithMessage(c, h.log, err, "error while erasing user") {
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Status{Message: "user was successfully erased"})
+}
+
+// Cancel user erasure
+// @Router /v1/users/{id}/erasure [delete]
+// @Security BearerAuth
+// @Summary cancel erasure of a user
+// @Tags Privacy
+// @Description Cancel a pending erasure request of any user
+// @Produce json
+// @Param id path string true "id"
+// @Success 200 {object} models.Status
+// @Failure 404 string Error models.ResponseError
+// @Failure 409 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) CancelUserErasure(c *gin.Context) {
+	h.cancelErasure(c, c.Param("id"))
+}
+
+func (h *handlerV1) cancelErasure(c *gin.Context, userID string) {
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	cancelled, err := h.erasures.Cancel(ctx, userID)
+	if err == privacy.ErrErasureRunning {
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeConflict,
+				Message: "Erasure has started and can not be cancelled",
+			},
+		})
+		return
+	}
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while cancelling erasure") {
+		return
+	}
+	if !cancelled {
+		c.JSON(http.StatusNotFound, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeNotFound,
+				Message: "There is no pending erasure request",
+			},
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.Status{Message: "erasure request was cancelled"})
+}
+
+// currentUser loads the user the caller's token belongs to.
+func (h *handlerV1) currentUser(c *gin.Context) (*pbu.User, bool) {
+	userID, ok := callerID(c)
+	if !ok {
+		return nil, false
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	user, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
+		UserId: userID,
+	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
+		return nil, false
+	}
+
+	return user, true
+}
+
+func erasureStatus(request *privacy.ErasureRequest) *models.ErasureStatus {
+	if request == nil {
+		return nil
+	}
+
+	return &models.ErasureStatus{
+		RequestedAt:  request.RequestedAt.Format(time.RFC3339),
+		ExecuteAfter: request.ExecuteAfter.Format(time.RFC3339),
+	}
+}
@@ -1,19 +1,32 @@
 package v1
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
 	"github.com/gomodule/redigo/redis"
 	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"myproject/api-gateway/api/handlers/tokens"
 	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/api/projection"
 	"myproject/api-gateway/email"
 	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/avatar"
+	"myproject/api-gateway/pkg/cursor"
 	"myproject/api-gateway/pkg/etc"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/tombstone"
+	grpcClient "myproject/api-gateway/services"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 )
@@ -22,12 +35,16 @@ import (
 // @Router /v1/register [post]
 // @Summary register user
 // @Tags User
-// @Description Registration
+// @Description Registration. The verification code is queued for delivery, so this answers without waiting for the mail server
 // @Accept json
 // @Produce json
 // @Param UserData body models.User true "Register user"
-// @Success 201 {object} models.RegisterRespModel
+// @Param Idempotency-Key header string false "repeats with the same key return the first response"
+// @Success 200 {object} models.RegisterRespModel
 // @Failure 400 string error models.ResponseError
+// @Failure 409 string error models.ResponseError
+// @Failure 422 string error models.StandardErrorModel
+// @Failure 429 string error models.ResponseError
 // @Failure 500 string error models.ResponseError
 func (h *handlerV1) Register(c *gin.Context) {
 	var (
@@ -52,7 +69,7 @@ func (h *handlerV1) Register(c *gin.Context) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 
 	exists, err := h.serviceManager.UserService().CheckField(ctx, &pbu.CheckFieldReq{
@@ -60,101 +77,162 @@ func (h *handlerV1) Register(c *gin.Context) {
 		Field: "email",
 	})
 
-	if handleInternalServerErrorWithMessage(c, h.log, err, "failed to check email uniqueness") {
+	if handleGrpcErrWithMessage(c, h.log, err, "failed to check email uniqueness") {
 		return
 	}
 
 	if exists.Status {
-		if handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("you've already registered before, try to log in"), ErrorBadRequest) {
-			return
-		}
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeAlreadyExists,
+				Message: "You've already registered before, try to log in",
+			},
+		})
+		return
 	}
 
-	code = etc.GenerateCode(5)
-	registerUser := models.RegisterUserModel{
-		ID:        body.ID,
-		FirstName: body.FirstName,
-		LastName:  body.LastName,
-		BirthDate: body.BirthDate,
-		Email:     body.Email,
-		Password:  body.Password,
-		Code:      code,
+	status, ok := h.reserveVerificationEmail(c, body.Email)
+	if !ok {
+		return
 	}
 
-	userJson, err := json.Marshal(registerUser)
-	if handleInternalServerErrorWithMessage(c, h.log, err, "error while marshaling json") {
+	passwordHash, err := etc.GenerateHashPassword(body.Password)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while hashing the password") {
 		return
 	}
 
-	timeOut := time.Second * 300
+	code = etc.GenerateCode(5)
+	registerUser := models.RegisterUserModel{
+		ID:           body.ID,
+		FirstName:    body.FirstName,
+		LastName:     body.LastName,
+		BirthDate:    body.BirthDate,
+		Email:        body.Email,
+		PasswordHash: passwordHash,
+		CodeHash:     etc.HashCode(code, h.cfg.VerifyCodeHashKey),
+		ExpiresAt:    time.Now().Add(time.Second * time.Duration(h.cfg.VerifyCodeTTL)).Unix(),
+	}
 
-	err = h.inMemoryStorage.SetWithTTL(registerUser.Email, string(userJson), int(timeOut.Seconds()))
+	err = h.saveRegistration(registerUser)
 	if handleInternalServerErrorWithMessage(c, h.log, err, "error while setting with ttl to redis") {
 		return
 	}
 
-	message, err := email.SendVerificationCode(email.EmailPayload{
-		From:     h.cfg.SendEmailFrom,
-		To:       registerUser.Email,
-		Password: h.cfg.EmailCode,
-		Code:     registerUser.Code,
-		Message:  fmt.Sprintf("Hi, %s", registerUser.FirstName),
+	message, err := email.SendVerificationCode(ctx, h.mailer, email.EmailPayload{
+		To:        registerUser.Email,
+		Code:      code,
+		Message:   fmt.Sprintf("Hi, %s", registerUser.FirstName),
+		ExpiresAt: time.Unix(registerUser.ExpiresAt, 0),
 	})
 	if handleInternalServerErrorWithMessage(c, h.log, err, "error while sending code to user's email") {
 		return
 	}
 
+	h.publishEvent(c, events.UserRegistered, registerUser.ID)
+
+	status.ExpiresIn = h.cfg.VerifyCodeTTL
+	status.AttemptsLeft = h.cfg.VerifyMaxAttempts
 	c.JSON(http.StatusOK, models.RegisterRespModel{
-		Message: message,
+		Message:            message,
+		VerificationStatus: status,
 	})
 }
 
 // Verify User
-// @Router /v1/verify/{email}/{code} [get]
+// @Router /v1/verify [post]
 // @Summary verify user
 // @Tags User
-// @Description Verify a user with code sent to their email
+// @Description Verify a user with code sent to their email. After too many wrong codes the registration is dropped and has to start again. A code creates the user only once.
 // @Accept json
-// @Product json
-// @Param email path string true "email"
-// @Param code path string true "code"
+// @Produce json
+// @Param verification body models.VerifyReq true "Email and code"
 // @Success 201 {object} models.VerifyRespModel
 // @Failure 400 string error models.ResponseError
-// @Failure 400 string error models.ResponseError
+// @Failure 404 string error models.ResponseError
+// @Failure 409 string error models.ResponseError
+// @Failure 500 string error models.ResponseError
 func (h *handlerV1) Verify(c *gin.Context) {
-	var jspMarshal protojson.MarshalOptions
-	jspMarshal.UseProtoNames = true
+	var body models.VerifyReq
+
+	err := c.ShouldBindJSON(&body)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidJSON) {
+		return
+	}
 
-	userEmail := c.Param("email")
-	userCode := c.Param("code")
+	userEmail := strings.ToLower(strings.TrimSpace(body.Email))
 
 	registeredUser, err := redis.Bytes(h.inMemoryStorage.Get(userEmail))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, models.StandardErrorModel{
-			Status:  ErrorCodeNotFound,
-			Message: "Code is expired, try again",
-		})
-		h.log.Error("Code is expired, TTL is over.")
+	if err != nil && err != redis.ErrNil {
+		handleInternalServerErrorWithMessage(c, h.log, err, "error while reading registration")
 		return
 	}
 
 	var user models.RegisterUserModel
-	if err := json.Unmarshal(registeredUser, &user); err != nil {
-		if handleInternalServerErrorWithMessage(c, h.log, err, "cannot unmarshal user from redis") {
-			return
+	if err == nil {
+		if err := json.Unmarshal(registeredUser, &user); err != nil {
+			if handleInternalServerErrorWithMessage(c, h.log, err, "cannot unmarshal user from redis") {
+				return
+			}
 		}
 	}
+	// Registrations saved before passwords were hashed on register carry no
+	// hash, they have to start again like expired ones.
+	if user.PasswordHash == "" {
+		c.JSON(http.StatusNotFound, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeNotFound,
+				Message: "Code is expired, try again",
+			},
+		})
+		return
+	}
 
-	if user.Code != userCode {
-		if handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("code is incorrect, verification is failed"), ErrorCodeInvalidCode) {
-			return
+	attempts, err := h.inMemoryStorage.IncrWithTTL(verifyAttemptsKeyPrefix+userEmail, h.cfg.VerifyCodeTTL)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while counting verification attempts") {
+		return
+	}
+	if !etc.CompareHashCode(user.CodeHash, body.Code, h.cfg.VerifyCodeHashKey) || int(attempts) > h.cfg.VerifyMaxAttempts {
+		status := models.VerificationStatus{
+			ExpiresIn:    expiresIn(&user),
+			AttemptsLeft: h.cfg.VerifyMaxAttempts - int(attempts),
+		}
+		message := fmt.Sprintf("Code is incorrect, %d attempts left", status.AttemptsLeft)
+		if status.AttemptsLeft <= 0 {
+			// Guessing is over, the registration has to start again.
+			if err := h.inMemoryStorage.Del(userEmail, verifyAttemptsKeyPrefix+userEmail); err != nil {
+				h.log.Error("cannot delete registration after failed attempts", logger.Error(err))
+			}
+			status = models.VerificationStatus{}
+			message = "Code is incorrect and no attempts are left, register again"
 		}
+		c.JSON(http.StatusBadRequest, models.ResponseError{
+			Error: models.VerificationError{
+				Status:             ErrorCodeInvalidCode,
+				Message:            message,
+				VerificationStatus: status,
+			},
+		})
+		return
 	}
 
-	user.Password, err = etc.GenerateHashPassword(user.Password)
-	if handleInternalServerErrorWithMessage(c, h.log, err, "error while hashing the password") {
+	// Of concurrent requests with the right code only one creates the user,
+	// and a code replaced by a resend meanwhile is not used either.
+	consumed, err := h.inMemoryStorage.DelIfEqual(userEmail, string(registeredUser))
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while consuming registration") {
+		return
+	}
+	if !consumed {
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeConflict,
+				Message: "Registration was verified already or its code was replaced",
+			},
+		})
 		return
 	}
+	if err := h.inMemoryStorage.Del(verifyAttemptsKeyPrefix + userEmail); err != nil {
+		h.log.Error("cannot delete verification attempts", logger.Error(err))
+	}
 
 	h.jwtHandler = tokens.JWTHandler{
 		Sub:       user.ID,
@@ -169,7 +247,7 @@ func (h *handlerV1) Verify(c *gin.Context) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 
 	respUser, err := h.serviceManager.UserService().CreateUser(ctx, &pbu.User{
@@ -178,23 +256,27 @@ func (h *handlerV1) Verify(c *gin.Context) {
 		LastName:     user.LastName,
 		BirthDate:    user.BirthDate,
 		Email:        user.Email,
-		Password:     user.Password,
+		Password:     user.PasswordHash,
 		AccessToken:  access,
 		RefreshToken: refresh,
 	})
-	if handleInternalServerErrorWithMessage(c, h.log, err, "error while creating user") {
+	if err != nil {
+		// The code was right, so the registration is kept for another try.
+		if err := h.saveRegistration(user); err != nil {
+			h.log.Error("cannot restore registration", logger.Error(err))
+		}
+	}
+	if handleGrpcErrWithMessage(c, h.log, err, "error while creating user") {
 		return
 	}
 	userModel := models.VerifyRespModel{
-		ID:          respUser.Id,
-		FirstName:   respUser.FirstName,
-		LastName:    respUser.LastName,
-		BirthDate:   respUser.BirthDate,
-		Email:       respUser.Email,
-		Password:    respUser.Password,
+		UserPublic:  projection.User(c.Request.Context(), respUser),
 		AccessToken: respUser.AccessToken,
 	}
 
+	h.publishEvent(c, events.UserVerified, respUser.Id)
+	h.recordSession(c, respUser.Id, "registration")
+
 	c.JSON(http.StatusCreated, userModel)
 }
 
@@ -205,8 +287,7 @@ func (h *handlerV1) Verify(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param User body models.LoginReqModel true "Login"
-// @Success 201 {object} models.LoginRespModel
-// @Failure 400 string Error models.ResponseError
+// @Success 200 {object} models.LoginRespModel
 // @Failure 400 string Error models.ResponseError
 // @Router /v1/login [post]
 func (h *handlerV1) Login(c *gin.Context) {
@@ -217,23 +298,27 @@ func (h *handlerV1) Login(c *gin.Context) {
 
 	jspMarshal.UseProtoNames = true
 	err := c.ShouldBind(&body)
-	if handleBadRequestErrWithMessage(c, h.log, err, "error while marshaling request body") {
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidJSON) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 
 	user, err := h.serviceManager.UserService().IfExists(ctx, &pbu.IfExistsReq{
 		Email: body.Email,
 	})
 
-	if handleInternalServerErrorWithMessage(c, h.log, err, "error while checking if user exists") {
+	if status.Code(err) == codes.NotFound {
+		err = nil
+		user = &pbu.IfExistsResp{}
+	}
+	if handleGrpcErrWithMessage(c, h.log, err, "error while checking if user exists") {
 		return
 	}
 
-	if !etc.CompareHashPassword(user.User.Password, body.Password) {
-		if handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("wrong password"), ErrorInvalidCredentials) {
+	if user.User == nil || user.User.DeletedAt != "" || !etc.CompareHashPassword(user.User.Password, body.Password) {
+		if handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("wrong email or password"), ErrorInvalidCredentials) {
 			return
 		}
 	}
@@ -251,13 +336,10 @@ func (h *handlerV1) Login(c *gin.Context) {
 		return
 	}
 
+	h.recordSession(c, user.User.Id, "password")
+
 	loginResp := models.UserModel{
-		ID:          user.User.Id,
-		FirstName:   user.User.FirstName,
-		LastName:    user.User.LastName,
-		BirthDate:   user.User.BirthDate,
-		Email:       user.User.Email,
-		Password:    user.User.Password,
+		UserPublic:  projection.User(c.Request.Context(), user.User),
 		AccessToken: access,
 	}
 
@@ -276,8 +358,11 @@ func (h *handlerV1) Login(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param UserInfo body models.User true "Create user"
+// @Param Idempotency-Key header string false "repeats with the same key return the first response"
 // @Success 201 {object} models.UserModel
 // @Failure 400 string Error models.ResponseError
+// @Failure 409 string Error models.StandardErrorModel
+// @Failure 422 string Error models.StandardErrorModel
 // @Failure 500 string Error models.ResponseError
 func (h *handlerV1) CreateUser(c *gin.Context) {
 	var (
@@ -296,7 +381,7 @@ func (h *handlerV1) CreateUser(c *gin.Context) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 
 	body.ID = uuid.New().String()
@@ -317,17 +402,12 @@ func (h *handlerV1) CreateUser(c *gin.Context) {
 	}
 
 	respUser, err := h.serviceManager.UserService().CreateUser(ctx, createReq)
-	if handleInternalServerErrorWithMessage(c, h.log, err, "error while creating a user") {
+	if handleGrpcErrWithMessage(c, h.log, err, "error while creating a user") {
 		return
 	}
 
 	response := models.UserModel{
-		ID:          respUser.Id,
-		FirstName:   respUser.FirstName,
-		LastName:    respUser.LastName,
-		BirthDate:   respUser.BirthDate,
-		Email:       respUser.Email,
-		Password:    respUser.Password,
+		UserPublic:  projection.User(c.Request.Context(), respUser),
 		AccessToken: respUser.AccessToken,
 	}
 
@@ -343,7 +423,10 @@ func (h *handlerV1) CreateUser(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param id path string true "id"
-// @Success 201 {object} models.User
+// @Param If-None-Match header string false "ETag of a cached copy, answered with 304 if it is still current"
+// @Success 201 {object} models.UserPublic
+// @Header 201 {string} ETag "version of the user"
+// @Success 304 "Not Modified"
 // @Failure 400 string Error models.ResponseError
 // @Failure 500 string Error models.ResponseError
 func (h *handlerV1) GetUserById(c *gin.Context) {
@@ -352,26 +435,20 @@ func (h *handlerV1) GetUserById(c *gin.Context) {
 
 	id := c.Param("id")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration((h.cfg.CtxTimeout)))
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 
 	respUser, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
 		UserId: id,
 	})
-	if handleInternalServerErrorWithMessage(c, h.log, err, "error while getting user by id") {
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
 		return
 	}
-
-	response := models.User{
-		ID:        respUser.Id,
-		FirstName: respUser.FirstName,
-		LastName:  respUser.LastName,
-		BirthDate: respUser.BirthDate,
-		Email:     respUser.Email,
-		Password:  respUser.Password,
+	if notModified(c, userETag(respUser)) {
+		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	c.JSON(http.StatusOK, projection.User(c.Request.Context(), respUser))
 }
 
 // Update User
@@ -379,13 +456,17 @@ func (h *handlerV1) GetUserById(c *gin.Context) {
 // @Security BearerAuth
 // @Summary update user
 // @Tags User
-// @Description Update user
+// @Description Update user. The email can not change here, send the current one or leave it empty.
 // @Accept json
 // @Produce json
 // @Param id path string true "id"
+// @Param If-Match header string false "ETag from GET /v1/user/{id}, the update fails with 412 if the user changed since"
 // @Param UserInfo body models.User true "Update User"
-// @Success 201 {object} models.User
+// @Success 201 {object} models.UserPublic
+// @Header 201 {string} ETag "version of the updated user"
 // @Failure 400 string Error models.ResponseError
+// @Failure 403 string Error models.ResponseError
+// @Failure 412 string Error models.ResponseError
 // @Failure 500 string Error models.ResponseError
 func (h *handlerV1) UpdateUser(c *gin.Context) {
 	var (
@@ -400,30 +481,178 @@ func (h *handlerV1) UpdateUser(c *gin.Context) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 
+	current, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
+		UserId: id,
+	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
+		return
+	}
+	// The backend has no compare-and-set, so a write landing between this
+	// check and the update below is still not detected.
+	if preconditionFailed(c, current) {
+		return
+	}
+	if body.Email != "" && !strings.EqualFold(strings.TrimSpace(body.Email), current.Email) {
+		handleBadRequestErrWithMessage(c, h.log, errors.New("email can not be changed here, use POST /v1/me/email"), ErrorValidationError)
+		return
+	}
+
+	// Passwords are only changed through /v1/user/password/change, which
+	// hashes them, and emails through /v1/me/email, which verifies the new
+	// address, so the mask leaves both alone.
+	ctx, err = grpcClient.WithUpdateMask(ctx, &fieldmaskpb.FieldMask{Paths: []string{"birth_date", "first_name", "last_name"}})
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while encoding update mask") {
+		return
+	}
+
+	updated := proto.Clone(current).(*pbu.User)
+	updated.FirstName = body.FirstName
+	updated.LastName = body.LastName
+	updated.BirthDate = body.BirthDate
+
+	respUser, err := h.serviceManager.UserService().UpdateUser(ctx, updated)
+	if handleGrpcErrWithMessage(c, h.log, err, "error while updating user") {
+		return
+	}
+	h.publishEvent(c, events.UserUpdated, respUser.Id)
+	c.Header("ETag", userETag(respUser))
+
+	c.JSON(http.StatusOK, projection.User(c.Request.Context(), respUser))
+}
+
+// Patch User
+// @Router /v1/users/{id} [patch]
+// @Security BearerAuth
+// @Summary partially update user
+// @Tags User
+// @Description JSON merge patch of the user profile. Only the fields sent are validated and changed, null clears a field. Email and password have their own endpoints.
+// @Accept json
+// @Produce json
+// @Param id path string true "id"
+// @Param If-Match header string false "ETag from GET /v1/user/{id}, the update fails with 412 if the user changed since"
+// @Param UserInfo body models.UserPatch true "Fields to change"
+// @Success 200 {object} models.UserPublic
+// @Header 200 {string} ETag "version of the updated user"
+// @Failure 400 string Error models.ResponseError
+// @Failure 403 string Error models.ResponseError
+// @Failure 412 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) PatchUser(c *gin.Context) {
+	var patch map[string]*string
+
+	err := c.ShouldBindJSON(&patch)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidJSON) {
+		return
+	}
+
+	var (
+		body   models.User
+		fields []string
+	)
+	for field, value := range patch {
+		switch field {
+		case "first_name":
+			body.FirstName = stringValue(value)
+		case "last_name":
+			body.LastName = stringValue(value)
+		case "birth_date":
+			body.BirthDate = stringValue(value)
+		case "email", "password":
+			handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("%s can not be changed here, use its dedicated endpoint", field), ErrorValidationError)
+			return
+		default:
+			handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("unknown field %s", field), ErrorValidationError)
+			return
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		handleBadRequestErrWithMessage(c, h.log, errors.New("nothing to update"), ErrorValidationError)
+		return
+	}
+	sort.Strings(fields)
+
+	err = body.ValidateFields(fields)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorValidationError) {
+		return
+	}
+
 	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
 
-	respUser, err := h.serviceManager.UserService().UpdateUser(ctx, &pbu.User{
-		Id:        id,
-		FirstName: body.FirstName,
-		LastName:  body.LastName,
-		BirthDate: body.BirthDate,
-		Email:     body.Email,
-		Password:  body.Password,
+	current, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
+		UserId: id,
 	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
+		return
+	}
+	if preconditionFailed(c, current) {
+		return
+	}
 
-	response := models.User{
-		ID:        respUser.Id,
-		FirstName: respUser.FirstName,
-		LastName:  respUser.LastName,
-		BirthDate: respUser.BirthDate,
-		Email:     respUser.Email,
-		Password:  respUser.Password,
+	updated := proto.Clone(current).(*pbu.User)
+	for _, field := range fields {
+		switch field {
+		case "first_name":
+			updated.FirstName = body.FirstName
+		case "last_name":
+			updated.LastName = body.LastName
+		case "birth_date":
+			updated.BirthDate = body.BirthDate
+		}
 	}
 
-	c.JSON(http.StatusOK, response)
+	ctx, err = grpcClient.WithUpdateMask(ctx, &fieldmaskpb.FieldMask{Paths: fields})
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while encoding update mask") {
+		return
+	}
+
+	respUser, err := h.serviceManager.UserService().UpdateUser(ctx, updated)
+	if handleGrpcErrWithMessage(c, h.log, err, "error while updating user") {
+		return
+	}
+	h.publishEvent(c, events.UserUpdated, respUser.Id)
+	c.Header("ETag", userETag(respUser))
+
+	c.JSON(http.StatusOK, projection.User(c.Request.Context(), respUser))
+}
+
+// stringValue maps a JSON null of a merge patch to the empty string.
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+
+	return *value
+}
+
+// authorizeUser lets callers change their own account only, unless they are
+// an admin. Casbin grants the route, not the user it is applied to.
+func authorizeUser(c *gin.Context, userID string) bool {
+	if id, _ := identity.FromContext(c.Request.Context()); !id.CanActOn(userID) {
+		c.JSON(http.StatusForbidden, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeForbidden,
+				Message: "You can only change your own account",
+			},
+		})
+		return false
+	}
+
+	return true
 }
 
 // Delete User
@@ -431,39 +660,158 @@ func (h *handlerV1) UpdateUser(c *gin.Context) {
 // @Security BearerAuth
 // @Summary delete user
 // @Tags User
-// @Description Delete user
+// @Description Soft delete the user. Their tokens stop working and an admin can restore them until the user is purged.
 // @Accept json
 // @Produce json
 // @Param id path string true "id"
-// @Success 201 {object} models.Status
+// @Success 200 {object} models.Status
 // @Failure 400 string Error models.ResponseError
+// @Failure 403 string Error models.ResponseError
 // @Failure 500 string Error models.ResponseError
 func (h *handlerV1) DeleteUser(c *gin.Context) {
-	var jspbMarshal protojson.MarshalOptions
-	jspbMarshal.UseProtoNames = true
-
 	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 
-	_, err := h.serviceManager.UserService().DeleteUser(ctx, &pbu.DeleteUserReq{
+	current, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
 		UserId: id,
 	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
+		return
+	}
+
+	if current.DeletedAt == "" {
+		_, err = grpcClient.SoftDeleteUser(ctx, h.serviceManager.UserService(), current, time.Now())
+		if handleGrpcErrWithMessage(c, h.log, err, "error while deleting user") {
+			return
+		}
+		h.publishEvent(c, events.UserDeleted, id)
+	}
 
-	if handleInternalServerErrorWithMessage(c, h.log, err, "error while deleting user") {
+	// Set again for users that are already deleted, so a retry fixes a
+	// tombstone that failed to be written the first time.
+	err = tombstone.Set(h.inMemoryStorage, id, 0)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while revoking user tokens") {
 		return
 	}
 
 	c.JSON(http.StatusOK, models.Status{Message: "user was successfully deleted"})
 }
 
+// Restore User
+// @Router /v1/users/{id}/restore [post]
+// @Security BearerAuth
+// @Summary restore user
+// @Tags User
+// @Description Undo the soft delete of a user
+// @Accept json
+// @Produce json
+// @Param id path string true "id"
+// @Success 200 {object} models.UserPublic
+// @Failure 404 string Error models.ResponseError
+// @Failure 409 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) RestoreUser(c *gin.Context) {
+	id := c.Param("id")
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	current, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
+		UserId: id,
+	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
+		return
+	}
+	if current.DeletedAt == "" {
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeConflict,
+				Message: "User is not deleted",
+			},
+		})
+		return
+	}
+
+	respUser, err := grpcClient.RestoreUser(ctx, h.serviceManager.UserService(), current)
+	if handleGrpcErrWithMessage(c, h.log, err, "error while restoring user") {
+		return
+	}
+
+	err = tombstone.Clear(h.inMemoryStorage, id)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while restoring user tokens") {
+		return
+	}
+	h.publishEvent(c, events.UserRestored, id)
+	c.Header("ETag", userETag(respUser))
+
+	c.JSON(http.StatusOK, projection.User(c.Request.Context(), respUser))
+}
+
+// Purge User
+// @Router /v1/users/{id}/purge [delete]
+// @Security BearerAuth
+// @Summary purge user
+// @Tags User
+// @Description Irreversibly delete a user that was soft deleted before
+// @Accept json
+// @Produce json
+// @Param id path string true "id"
+// @Success 200 {object} models.Status
+// @Failure 404 string Error models.ResponseError
+// @Failure 409 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) PurgeUser(c *gin.Context) {
+	id := c.Param("id")
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	current, err := h.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
+		UserId: id,
+	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while getting user by id") {
+		return
+	}
+	if current.DeletedAt == "" {
+		c.JSON(http.StatusConflict, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeConflict,
+				Message: "Only deleted users can be purged, delete the user first",
+			},
+		})
+		return
+	}
+
+	_, err = h.serviceManager.UserService().DeleteUser(ctx, &pbu.DeleteUserReq{
+		UserId: id,
+	})
+	if handleGrpcErrWithMessage(c, h.log, err, "error while purging user") {
+		return
+	}
+
+	if err := tombstone.SetPurged(h.inMemoryStorage, h.cfg, id); err != nil {
+		h.log.Error("cannot keep tombstone of purged user", logger.String("id", id), logger.Error(err))
+	}
+	if err := avatar.Delete(ctx, h.blobs, id); err != nil {
+		h.log.Error("cannot delete avatar of purged user", logger.String("id", id), logger.Error(err))
+	}
+	h.publishEvent(c, events.UserPurged, id)
+
+	c.JSON(http.StatusOK, models.Status{Message: "user was successfully purged"})
+}
+
 // List users
 // @Router /v1/users/{page}/{limit}/{filter} [get]
 // @Security BearerAuth
 // @Summary get users' list
 // @Tags User
-// @Description get all users
+// @Description get all users, deprecated in favour of GET /v1/users. Deleted users are only listed for admins.
+// @Deprecated
 // @Accept json
 // @Produce json
 // @Param page path string false "page"
@@ -476,27 +824,108 @@ func (h *handlerV1) ListUsers(c *gin.Context) {
 	var jspbMarshal protojson.MarshalOptions
 	jspbMarshal.UseProtoNames = true
 
-	page, err := ParsePageQueryParam(c)
+	page, err := parsePage(c.Param("page"))
 	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams) {
 		return
 	}
-	limit, err := ParseLimitQueryParam(c)
+	limit, err := parseLimit(c.Param("limit"))
 	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams) {
 		return
 	}
+	if h.cfg.ListUsersMaxLimit > 0 && limit > h.cfg.ListUsersMaxLimit {
+		limit = h.cfg.ListUsersMaxLimit
+	}
 	filter := c.Param("filter")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 	response, err := h.serviceManager.UserService().GetAllUsers(ctx, &pbu.ListUsersReq{
 		Limit:  int64(limit),
 		Page:   int64(page),
 		Filter: filter,
 	})
-	if handleInternalServerErrorWithMessage(c, h.log, err, ErrorCodeInternalServerError) {
+	if handleGrpcErrWithMessage(c, h.log, err, "error while listing users") {
 		return
 	}
 
+	users, count := response.Users, response.Count
+	if id, _ := identity.FromContext(c.Request.Context()); !id.IsAdmin() {
+		users = users[:0:0]
+		for _, user := range response.Users {
+			if user.DeletedAt == "" {
+				users = append(users, user)
+			}
+		}
+		// Without a filter the deleted users are known, so they can leave
+		// the count too.
+		if filter == "" {
+			live, err := h.deletedCount(userQuery{Deleted: deletedExclude}, response.Count)
+			if handleInternalServerErrorWithMessage(c, h.log, err, "error while counting deleted users") {
+				return
+			}
+			count = *live
+		}
+	}
+
+	c.JSON(http.StatusOK, models.ListUsersResp{
+		Users: projection.Users(c.Request.Context(), users),
+		Count: count,
+	})
+}
+
+// Query users
+// @Router /v1/users [get]
+// @Security BearerAuth
+// @Summary query users
+// @Tags User
+// @Description List users page by page. Follow next_cursor, or the Link header, for the next page; a cursor only works with the parameters it was issued for. With filters, deleted=exclude included, a page may be short or empty and still have a next one. count is left out when filtering on more than deleted, because it would need a scan of every user. Sorting reads every user, so it fails with 400 when there are more than LIST_USERS_MAX_SCAN.
+// @Produce json
+// @Param limit query int false "page size, capped by the server" default(20)
+// @Param cursor query string false "next_cursor of the previous page"
+// @Param sort query string false "created_at, updated_at, first_name, last_name or email"
+// @Param order query string false "asc or desc" default(asc)
+// @Param email query string false "exact email"
+// @Param name_prefix query string false "prefix of the first or last name"
+// @Param created_after query string false "RFC 3339 timestamp or yyyy-mm-dd"
+// @Param created_before query string false "RFC 3339 timestamp or yyyy-mm-dd"
+// @Param deleted query string false "exclude, include or only deleted users" default(exclude)
+// @Success 200 {object} models.UsersPage
+// @Header 200 {string} Link "URL of the next page"
+// @Failure 400 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) QueryUsers(c *gin.Context) {
+	query, offset, err := h.parseUserQuery(c)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams) {
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	page, err := h.queryUsers(ctx, query, offset)
+	if err == errTooManyToSort {
+		handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams)
+		return
+	}
+	if handleGrpcErrWithMessage(c, h.log, err, "error while querying users") {
+		return
+	}
+
+	response := models.UsersPage{
+		Users: projection.Users(c.Request.Context(), page.Users),
+		Count: page.Count,
+	}
+	if page.HasMore {
+		response.NextCursor, err = cursor.Encode(userCursor{
+			Query:  query.fingerprint(),
+			Offset: page.Next,
+		}, h.cfg.CursorSignInKey)
+		if handleInternalServerErrorWithMessage(c, h.log, err, "error while encoding cursor") {
+			return
+		}
+		c.Header("Link", fmt.Sprintf(`<%s>; rel="next"`, nextPageURL(c, response.NextCursor)))
+	}
+
 	c.JSON(http.StatusOK, response)
 }
 
@@ -534,7 +963,7 @@ func (h *handlerV1) ChangePassword(c *gin.Context) {
 	if handleInternalServerErrorWithMessage(c, h.log, err, "error while hashing the password") {
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	ctx, cancel := h.requestContext(c)
 	defer cancel()
 
 	result, err := h.serviceManager.UserService().ChangePassword(ctx, &pbu.ChangeUserPasswordReq{
@@ -542,13 +971,67 @@ func (h *handlerV1) ChangePassword(c *gin.Context) {
 		Password: body.NewPassword,
 	})
 
-	if handleInternalServerErrorWithMessage(c, h.log, err, "error while changing password") {
+	if handleGrpcErrWithMessage(c, h.log, err, "error while changing password") {
 		return
 	}
 
 	if result.Status {
+		if user, err := h.serviceManager.UserService().IfExists(ctx, &pbu.IfExistsReq{Email: body.Email}); err == nil && user.User != nil {
+			h.publishEvent(c, events.UserPasswordChanged, user.User.Id)
+		}
 		c.JSON(http.StatusOK, models.Status{Message: "password was successfully changed."})
 	} else {
 		c.JSON(http.StatusOK, models.Status{Message: "failed to change the password"})
 	}
 }
+
+// Batch get users
+// @Router /v1/users/batch-get [post]
+// @Security BearerAuth
+// @Summary get users by ids
+// @Tags User
+// @Description Get several users at once. Results keep the order of the requested ids, and a failed lookup only fails its own item.
+// @Accept json
+// @Produce json
+// @Param ids body models.BatchGetUsersReq true "User ids"
+// @Success 200 {object} models.BatchGetUsersResp
+// @Failure 400 string Error models.ResponseError
+func (h *handlerV1) BatchGetUsers(c *gin.Context) {
+	var body models.BatchGetUsersReq
+
+	err := c.ShouldBindJSON(&body)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidJSON) {
+		return
+	}
+
+	if len(body.IDs) == 0 {
+		handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("ids should not be empty"), ErrorValidationError)
+		return
+	}
+	if len(body.IDs) > h.cfg.BatchGetMaxIDs {
+		handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("at most %d ids can be requested at once", h.cfg.BatchGetMaxIDs), ErrorValidationError)
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	users, errs := grpcClient.GetUsersByIds(ctx, h.serviceManager.UserService(), body.IDs, h.cfg.BatchGetConcurrency)
+
+	results := make([]models.BatchGetUserResult, len(body.IDs))
+	for i, id := range body.IDs {
+		results[i].ID = id
+		if errs[i] != nil {
+			_, model, _ := TranslateGrpcError(errs[i])
+			results[i].Error = &model
+			continue
+		}
+
+		user := projection.User(c.Request.Context(), users[i])
+		results[i].User = &user
+	}
+
+	c.JSON(http.StatusOK, models.BatchGetUsersResp{
+		Results: results,
+	})
+}
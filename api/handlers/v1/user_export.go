@@ -0,0 +1,264 @@
+package v1
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/api/projection"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/logger"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportErrorTrailer is sent after the body when the export stopped early,
+// because the status line has been written by then.
+const exportErrorTrailer = "X-Export-Error"
+
+type exportColumn struct {
+	name  string
+	value func(models.UserPublic) string
+}
+
+// exportColumns are read from the projected user, so nothing that is hidden
+// from API responses can be exported.
+var exportColumns = []exportColumn{
+	{"id", func(u models.UserPublic) string { return u.ID }},
+	{"first_name", func(u models.UserPublic) string { return u.FirstName }},
+	{"last_name", func(u models.UserPublic) string { return u.LastName }},
+	{"birth_date", func(u models.UserPublic) string { return u.BirthDate }},
+	{"email", func(u models.UserPublic) string { return u.Email }},
+	{"created_at", func(u models.UserPublic) string { return u.CreatedAt }},
+	{"updated_at", func(u models.UserPublic) string { return u.UpdatedAt }},
+	{"deleted_at", func(u models.UserPublic) string { return u.DeletedAt }},
+}
+
+type userExportWriter interface {
+	write(user models.UserPublic) error
+	// flush sends the rows written so far to the client.
+	flush() error
+}
+
+// Export users
+// @Router /v1/admin/users/export [get]
+// @Security BearerAuth
+// @Summary export users
+// @Tags User
+// @Description Stream every user as CSV or NDJSON, page by page. If the export fails after it started, the X-Export-Error trailer is set and the file is incomplete.
+// @Produce text/csv,application/x-ndjson
+// @Param format query string false "csv or ndjson" default(csv)
+// @Param columns query string false "comma separated columns, all by default: id,first_name,last_name,birth_date,email,created_at,updated_at,deleted_at"
+// @Param email query string false "exact email"
+// @Param name_prefix query string false "prefix of the first or last name"
+// @Param created_after query string false "RFC 3339 timestamp or yyyy-mm-dd"
+// @Param created_before query string false "RFC 3339 timestamp or yyyy-mm-dd"
+// @Param deleted query string false "exclude, include or only deleted users" default(exclude)
+// @Success 200 {string} string "users"
+// @Failure 400 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) ExportUsers(c *gin.Context) {
+	format := c.DefaultQuery("format", formatCSV)
+	if format != formatCSV && format != formatNDJSON {
+		handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("format should be %s or %s", formatCSV, formatNDJSON), ErrorCodeInvalidParams)
+		return
+	}
+
+	columns, err := parseExportColumns(c.Query("columns"))
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams) {
+		return
+	}
+
+	var query userQuery
+	err = parseUserFilters(c, &query)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams) {
+		return
+	}
+
+	// The first page is read before anything is written, so a backend that
+	// is down still gets a proper error response.
+	response, err := h.exportPage(c.Request.Context(), 1)
+	if handleGrpcErrWithMessage(c, h.log, err, "error while exporting users") {
+		return
+	}
+
+	filename := "users-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Header("Trailer", exportErrorTrailer)
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	var writer userExportWriter
+	if format == formatCSV {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		writer = newCSVExportWriter(c.Writer, columns)
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+		writer = newNDJSONExportWriter(c.Writer, columns)
+	}
+	c.Status(http.StatusOK)
+
+	err = h.exportUsers(c, query, writer, response)
+	if err != nil {
+		h.log.Error("user export stopped", logger.Error(err))
+		c.Writer.Header().Set(exportErrorTrailer, "export stopped before the last user")
+	}
+}
+
+func (h *handlerV1) exportUsers(c *gin.Context, query userQuery, writer userExportWriter, response *pbu.ListUsersResp) error {
+	pageSize := h.exportPageSize()
+
+	var (
+		err     error
+		scanned int64
+	)
+	for page := int64(1); ; page++ {
+		if page > 1 {
+			response, err = h.exportPage(c.Request.Context(), page)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, user := range response.Users {
+			if !query.matches(user) {
+				continue
+			}
+			if err := writer.write(projection.User(c.Request.Context(), user)); err != nil {
+				return err
+			}
+		}
+		if err := writer.flush(); err != nil {
+			return err
+		}
+
+		scanned += int64(len(response.Users))
+		if len(response.Users) < pageSize || scanned >= response.Count {
+			return nil
+		}
+	}
+}
+
+// exportPage reads one page with its own timeout, since the whole export may
+// take much longer than a single request.
+func (h *handlerV1) exportPage(ctx context.Context, page int64) (*pbu.ListUsersResp, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(h.cfg.CtxTimeout))
+	defer cancel()
+
+	return h.serviceManager.UserService().GetAllUsers(ctx, &pbu.ListUsersReq{
+		Limit: int64(h.exportPageSize()),
+		Page:  page,
+	})
+}
+
+func (h *handlerV1) exportPageSize() int {
+	if h.cfg.ExportPageSize > 0 {
+		return h.cfg.ExportPageSize
+	}
+
+	return listUsersScanPageSize
+}
+
+func parseExportColumns(value string) ([]exportColumn, error) {
+	if value == "" {
+		return exportColumns, nil
+	}
+
+	var columns []exportColumn
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+
+		found := false
+		for _, column := range exportColumns {
+			if column.name == name {
+				columns = append(columns, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+	}
+
+	return columns, nil
+}
+
+type csvExportWriter struct {
+	writer  *csv.Writer
+	flusher http.Flusher
+	columns []exportColumn
+	header  bool
+}
+
+func newCSVExportWriter(w gin.ResponseWriter, columns []exportColumn) *csvExportWriter {
+	return &csvExportWriter{writer: csv.NewWriter(w), flusher: w, columns: columns}
+}
+
+func (w *csvExportWriter) write(user models.UserPublic) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	record := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		record[i] = column.value(user)
+	}
+
+	return w.writer.Write(record)
+}
+
+func (w *csvExportWriter) flush() error {
+	// Even an empty export has a header.
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		return err
+	}
+	w.flusher.Flush()
+
+	return nil
+}
+
+func (w *csvExportWriter) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+
+	names := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		names[i] = column.name
+	}
+
+	return w.writer.Write(names)
+}
+
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+	flusher http.Flusher
+	columns []exportColumn
+}
+
+func newNDJSONExportWriter(w gin.ResponseWriter, columns []exportColumn) *ndjsonExportWriter {
+	return &ndjsonExportWriter{encoder: json.NewEncoder(w), flusher: w, columns: columns}
+}
+
+func (w *ndjsonExportWriter) write(user models.UserPublic) error {
+	row := make(map[string]string, len(w.columns))
+	for _, column := range w.columns {
+		row[column.name] = column.value(user)
+	}
+
+	return w.encoder.Encode(row)
+}
+
+func (w *ndjsonExportWriter) flush() error {
+	w.flusher.Flush()
+	return nil
+}
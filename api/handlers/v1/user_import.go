@@ -0,0 +1,499 @@
+package v1
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"io"
+	"mime"
+	"myproject/api-gateway/api/handlers/tokens"
+	"myproject/api-gateway/api/models"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/etc"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/logger"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	importModeDryRun = "dry_run"
+	importModeCommit = "commit"
+
+	// Formats of imported and exported files.
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	importProgressKeyPrefix = "user:import:"
+	importMaxLineSize       = 1 << 20
+)
+
+var importIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// importColumns are the CSV columns, in any order.
+var importColumns = []string{"first_name", "last_name", "birth_date", "email", "password"}
+
+type importRow struct {
+	number int
+	user   models.User
+	// err is set when the row itself could not be parsed.
+	err error
+}
+
+type rowReader interface {
+	// next returns io.EOF after the last row. Other errors abort the import.
+	next() (importRow, error)
+}
+
+// importProgress is kept for every created row, so a resumed import skips it.
+type importProgress struct {
+	UserID      string `json:"user_id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Import users
+// @Router /v1/users/import [post]
+// @Security BearerAuth
+// @Summary import users
+// @Tags User
+// @Description Create users from a CSV file with a first_name,last_name,birth_date,email,password header, or from NDJSON with one user per line. The file is sent as the body or as the "file" field of a multipart form. dry_run only validates; run commit with the returned import_id again to resume an import that partially failed. When the file can not be read to the end, the report of the rows before that comes with an error.
+// @Accept text/csv,application/x-ndjson,multipart/form-data
+// @Produce json
+// @Param mode query string false "dry_run or commit" default(dry_run)
+// @Param format query string false "csv or ndjson, taken from the content type by default"
+// @Param import_id query string false "id of a previous import to resume"
+// @Success 200 {object} models.ImportUsersReport
+// @Failure 400 string Error models.ResponseError
+// @Failure 500 string Error models.ResponseError
+func (h *handlerV1) ImportUsers(c *gin.Context) {
+	mode := c.DefaultQuery("mode", importModeDryRun)
+	if mode != importModeDryRun && mode != importModeCommit {
+		handleBadRequestErrWithMessage(c, h.log, fmt.Errorf("mode should be %s or %s", importModeDryRun, importModeCommit), ErrorCodeInvalidParams)
+		return
+	}
+
+	importID := c.Query("import_id")
+	if importID == "" {
+		importID = uuid.New().String()
+	}
+	if !importIDPattern.MatchString(importID) {
+		handleBadRequestErrWithMessage(c, h.log, errors.New("import_id should be up to 64 letters, digits, - or _"), ErrorCodeInvalidParams)
+		return
+	}
+
+	source, format, err := importSource(c)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidParams) {
+		return
+	}
+
+	var rows rowReader
+	switch format {
+	case formatCSV:
+		rows, err = newCSVRowReader(source)
+	case formatNDJSON:
+		rows = newNDJSONRowReader(source)
+	}
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorBadRequest) {
+		return
+	}
+
+	// A file that breaks half way still has rows created before the break,
+	// so the report is sent with the error rather than instead of it.
+	report, err := h.importUsers(c, rows, mode, importID)
+	if err != nil {
+		h.log.Error("import stopped early", logger.String("import_id", importID), logger.Error(err))
+		report.Error = &models.StandardErrorModel{
+			Status:  ErrorBadRequest,
+			Message: err.Error(),
+		}
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// importSource finds the uploaded file and its format.
+func importSource(c *gin.Context) (io.Reader, string, error) {
+	format := c.Query("format")
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if format == "" {
+			format = formatByMediaType(mediaType)
+		}
+		if format != formatCSV && format != formatNDJSON {
+			return nil, "", fmt.Errorf("unsupported format, send text/csv or application/x-ndjson")
+		}
+
+		return c.Request.Body, format, nil
+	}
+
+	parts, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil, "", errors.New(`multipart form has no "file" field`)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		if format == "" {
+			switch strings.ToLower(filepath.Ext(part.FileName())) {
+			case ".csv":
+				format = formatCSV
+			case ".ndjson", ".jsonl":
+				format = formatNDJSON
+			default:
+				mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+				format = formatByMediaType(mediaType)
+			}
+		}
+		if format != formatCSV && format != formatNDJSON {
+			return nil, "", fmt.Errorf("unsupported format of %s, upload a .csv or .ndjson file", part.FileName())
+		}
+
+		return part, format, nil
+	}
+}
+
+func formatByMediaType(mediaType string) string {
+	switch mediaType {
+	case "text/csv":
+		return formatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return formatNDJSON
+	}
+
+	return ""
+}
+
+type csvRowReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	row     int
+}
+
+func newCSVRowReader(source io.Reader) (*csvRowReader, error) {
+	reader := csv.NewReader(source)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read csv header: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[name] = i
+	}
+	for _, name := range importColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("csv header has no %s column", name)
+		}
+	}
+
+	return &csvRowReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvRowReader) next() (importRow, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return importRow{}, err
+	}
+	r.row++
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return importRow{number: r.row, err: parseErr}, nil
+	}
+	if err != nil {
+		return importRow{}, err
+	}
+
+	column := func(name string) string {
+		if i := r.columns[name]; i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	return importRow{
+		number: r.row,
+		user: models.User{
+			FirstName: column("first_name"),
+			LastName:  column("last_name"),
+			BirthDate: column("birth_date"),
+			Email:     column("email"),
+			Password:  column("password"),
+		},
+	}, nil
+}
+
+type ndjsonRowReader struct {
+	scanner *bufio.Scanner
+	row     int
+}
+
+func newNDJSONRowReader(source io.Reader) *ndjsonRowReader {
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(make([]byte, 0, 64*1024), importMaxLineSize)
+
+	return &ndjsonRowReader{scanner: scanner}
+}
+
+func (r *ndjsonRowReader) next() (importRow, error) {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		r.row++
+
+		var user models.User
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&user); err != nil {
+			return importRow{number: r.row, err: err}, nil
+		}
+
+		return importRow{number: r.row, user: user}, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return importRow{}, err
+	}
+
+	return importRow{}, io.EOF
+}
+
+// importUsers reads rows one by one and hands them to ImportConcurrency
+// workers, so only the report grows with the size of the file.
+func (h *handlerV1) importUsers(c *gin.Context, rows rowReader, mode, importID string) (models.ImportUsersReport, error) {
+	report := models.ImportUsersReport{
+		ImportID: importID,
+		Mode:     mode,
+		Rows:     []models.ImportRowResult{},
+	}
+
+	concurrency := h.cfg.ImportConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		jobs = make(chan importRow)
+	)
+	record := func(result models.ImportRowResult) {
+		mu.Lock()
+		report.Rows = append(report.Rows, result)
+		mu.Unlock()
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range jobs {
+				record(h.importRow(c, row, mode, importID))
+			}
+		}()
+	}
+
+	var (
+		readErr error
+		seen    = make(map[string]int)
+	)
+	for {
+		row, err := rows.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+		if h.cfg.ImportMaxRows > 0 && row.number > h.cfg.ImportMaxRows {
+			report.Truncated = true
+			break
+		}
+
+		row.user.Email = strings.ToLower(strings.TrimSpace(row.user.Email))
+		if row.err == nil && row.user.Email != "" {
+			if first, ok := seen[row.user.Email]; ok {
+				record(models.ImportRowResult{
+					Row:    row.number,
+					Email:  row.user.Email,
+					Status: models.ImportRowFailed,
+					Error: &models.StandardErrorModel{
+						Status:  ErrorCodeAlreadyExists,
+						Message: fmt.Sprintf("email is repeated, first seen on row %d", first),
+					},
+				})
+				continue
+			}
+			seen[row.user.Email] = row.number
+		}
+
+		jobs <- row
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(report.Rows, func(i, j int) bool {
+		return report.Rows[i].Row < report.Rows[j].Row
+	})
+	for _, row := range report.Rows {
+		switch row.Status {
+		case models.ImportRowValid:
+			report.Valid++
+		case models.ImportRowCreated:
+			report.Created++
+		case models.ImportRowSkipped:
+			report.Skipped++
+		case models.ImportRowFailed:
+			report.Failed++
+		}
+	}
+	report.Total = len(report.Rows)
+
+	return report, readErr
+}
+
+func (h *handlerV1) importRow(c *gin.Context, row importRow, mode, importID string) models.ImportRowResult {
+	result := models.ImportRowResult{
+		Row:   row.number,
+		Email: row.user.Email,
+	}
+	fail := func(status, message string) models.ImportRowResult {
+		result.Status = models.ImportRowFailed
+		result.Error = &models.StandardErrorModel{Status: status, Message: message}
+		return result
+	}
+	failRPC := func(err error) models.ImportRowResult {
+		_, model, _ := TranslateGrpcError(err)
+		result.Status = models.ImportRowFailed
+		result.Error = &model
+		return result
+	}
+
+	if row.err != nil {
+		return fail(ErrorBadRequest, row.err.Error())
+	}
+	if err := row.user.Validate(); err != nil {
+		return fail(ErrorValidationError, err.Error())
+	}
+
+	progressKey := importProgressKeyPrefix + importID + ":" + strconv.Itoa(row.number)
+	fingerprint := h.importFingerprint(row.user)
+
+	saved, err := redis.Bytes(h.inMemoryStorage.Get(progressKey))
+	if err != nil && err != redis.ErrNil {
+		h.log.Error("cannot read import progress", logger.Error(err))
+		return fail(ErrorCodeInternalServerError, "cannot read import progress")
+	}
+	if err == nil {
+		var progress importProgress
+		if err := json.Unmarshal(saved, &progress); err != nil {
+			return fail(ErrorCodeInternalServerError, "cannot read import progress")
+		}
+		if progress.Fingerprint != fingerprint {
+			return fail(ErrorCodeConflict, "row changed since it was created by this import")
+		}
+
+		result.Status = models.ImportRowSkipped
+		result.UserID = progress.UserID
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*time.Duration(h.cfg.CtxTimeout))
+	defer cancel()
+
+	exists, err := h.serviceManager.UserService().CheckField(ctx, &pbu.CheckFieldReq{
+		Value: row.user.Email,
+		Field: "email",
+	})
+	if err != nil {
+		return failRPC(err)
+	}
+	if exists.Status {
+		return fail(ErrorCodeAlreadyExists, "email is already registered")
+	}
+
+	if mode == importModeDryRun {
+		result.Status = models.ImportRowValid
+		return result
+	}
+
+	hashedPassword, err := etc.GenerateHashPassword(row.user.Password)
+	if err != nil {
+		return fail(ErrorCodeInternalServerError, "error while hashing password")
+	}
+
+	id := uuid.New().String()
+	jwtHandler := tokens.JWTHandler{
+		Sub:       id,
+		Role:      "user",
+		SignInKey: h.cfg.SignInKey,
+		Log:       h.log,
+		TimeOut:   h.cfg.AccessTokenTimeOut,
+	}
+	access, refresh, err := jwtHandler.GenerateAuthJWT()
+	if err != nil {
+		return fail(ErrorCodeInternalServerError, "error while generating access and refresh token")
+	}
+
+	respUser, err := h.serviceManager.UserService().CreateUser(ctx, &pbu.User{
+		Id:           id,
+		FirstName:    row.user.FirstName,
+		LastName:     row.user.LastName,
+		BirthDate:    row.user.BirthDate,
+		Email:        row.user.Email,
+		Password:     hashedPassword,
+		AccessToken:  access,
+		RefreshToken: refresh,
+	})
+	if err != nil {
+		return failRPC(err)
+	}
+
+	progress, _ := json.Marshal(importProgress{UserID: respUser.Id, Fingerprint: fingerprint})
+	if err := h.inMemoryStorage.SetWithTTL(progressKey, string(progress), h.cfg.ImportProgressTTL); err != nil {
+		// A resumed import then reports the row as already registered.
+		h.log.Error("cannot save import progress", logger.String("import_id", importID), logger.Error(err))
+	}
+	h.publishEvent(c, events.UserRegistered, respUser.Id)
+
+	result.Status = models.ImportRowCreated
+	result.UserID = respUser.Id
+	return result
+}
+
+// importFingerprint is keyed, a plain hash of a row would let anyone who
+// reads redis try passwords against it.
+func (h *handlerV1) importFingerprint(user models.User) string {
+	return etc.HashCode(strings.Join([]string{
+		user.FirstName, user.LastName, user.BirthDate, user.Email, user.Password,
+	}, "\x00"), h.cfg.ImportFingerprintKey)
+}
@@ -0,0 +1,389 @@
+package v1
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/cursor"
+	"myproject/api-gateway/pkg/tombstone"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	listUsersDefaultLimit = 20
+	listUsersScanPageSize = 100
+)
+
+// Values of the deleted parameter.
+const (
+	deletedExclude = "exclude"
+	deletedInclude = "include"
+	deletedOnly    = "only"
+)
+
+// userSortFields are the values accepted by the sort parameter.
+var userSortFields = map[string]func(*pbu.User) string{
+	"created_at": (*pbu.User).GetCreatedAt,
+	"updated_at": (*pbu.User).GetUpdatedAt,
+	"first_name": (*pbu.User).GetFirstName,
+	"last_name":  (*pbu.User).GetLastName,
+	"email":      (*pbu.User).GetEmail,
+}
+
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// userQuery is a parsed GET /v1/users request.
+type userQuery struct {
+	Limit         int
+	Sort          string
+	Order         string
+	Email         string
+	NamePrefix    string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Deleted       string
+}
+
+// userCursor is the position kept in next_cursor. Query ties it to the
+// parameters it was issued for. Offset counts sorted matches for sorted
+// queries, and users in the backend's own order for all others.
+type userCursor struct {
+	Query  string `json:"q"`
+	Offset int    `json:"o"`
+}
+
+func (h *handlerV1) parseUserQuery(c *gin.Context) (userQuery, int, error) {
+	query := userQuery{
+		Limit: listUsersDefaultLimit,
+		Sort:  c.Query("sort"),
+		Order: strings.ToLower(c.DefaultQuery("order", "asc")),
+	}
+	if err := parseUserFilters(c, &query); err != nil {
+		return query, 0, err
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return query, 0, fmt.Errorf("limit should be a positive number")
+		}
+		query.Limit = limit
+	}
+	if h.cfg.ListUsersMaxLimit > 0 && query.Limit > h.cfg.ListUsersMaxLimit {
+		query.Limit = h.cfg.ListUsersMaxLimit
+	}
+
+	if _, ok := userSortFields[query.Sort]; query.Sort != "" && !ok {
+		return query, 0, fmt.Errorf("users can not be sorted by %q", query.Sort)
+	}
+	if query.Order != "asc" && query.Order != "desc" {
+		return query, 0, fmt.Errorf("order should be asc or desc")
+	}
+	if query.Sort == "" && query.Order == "desc" {
+		return query, 0, fmt.Errorf("order needs a sort field")
+	}
+
+	offset := 0
+	if value := c.Query("cursor"); value != "" {
+		var position userCursor
+		if err := cursor.Decode(value, h.cfg.CursorSignInKey, &position); err != nil {
+			return query, 0, err
+		}
+		if position.Query != query.fingerprint() || position.Offset < 0 {
+			return query, 0, fmt.Errorf("cursor does not belong to this query")
+		}
+		offset = position.Offset
+	}
+
+	return query, offset, nil
+}
+
+// parseUserFilters reads the email, name_prefix, created_after,
+// created_before and deleted parameters.
+func parseUserFilters(c *gin.Context, query *userQuery) error {
+	query.Email = strings.ToLower(strings.TrimSpace(c.Query("email")))
+	query.NamePrefix = strings.ToLower(strings.TrimSpace(c.Query("name_prefix")))
+
+	query.Deleted = c.DefaultQuery("deleted", deletedExclude)
+	if query.Deleted != deletedExclude && query.Deleted != deletedInclude && query.Deleted != deletedOnly {
+		return fmt.Errorf("deleted should be %s, %s or %s", deletedExclude, deletedInclude, deletedOnly)
+	}
+
+	for param, target := range map[string]*time.Time{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+	} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, ok := parseTimestamp(value)
+		if !ok {
+			return fmt.Errorf("%s should be an RFC 3339 timestamp or a yyyy-mm-dd date", param)
+		}
+		*target = t
+	}
+
+	return nil
+}
+
+func (q userQuery) fingerprint() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		strconv.Itoa(q.Limit), q.Sort, q.Order, q.Email, q.NamePrefix,
+		q.CreatedAfter.UTC().Format(time.RFC3339Nano), q.CreatedBefore.UTC().Format(time.RFC3339Nano), q.Deleted,
+	}, "\x00")))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// filtered reports whether the gateway has to filter the backend's pages,
+// because the backend has no typed filters and includes deleted users.
+func (q userQuery) filtered() bool {
+	return q.typed() || q.Deleted != deletedInclude
+}
+
+// typed reports whether the query filters on more than deleted.
+func (q userQuery) typed() bool {
+	return q.Email != "" || q.NamePrefix != "" || !q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero()
+}
+
+func (q userQuery) matches(user *pbu.User) bool {
+	switch {
+	case q.Deleted == deletedExclude && user.GetDeletedAt() != "":
+		return false
+	case q.Deleted == deletedOnly && user.GetDeletedAt() == "":
+		return false
+	}
+	if q.Email != "" && strings.ToLower(user.GetEmail()) != q.Email {
+		return false
+	}
+	if q.NamePrefix != "" &&
+		!strings.HasPrefix(strings.ToLower(user.GetFirstName()), q.NamePrefix) &&
+		!strings.HasPrefix(strings.ToLower(user.GetLastName()), q.NamePrefix) {
+		return false
+	}
+
+	if !q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero() {
+		createdAt, ok := parseTimestamp(user.GetCreatedAt())
+		if !ok {
+			return false
+		}
+		if !q.CreatedAfter.IsZero() && !createdAt.After(q.CreatedAfter) {
+			return false
+		}
+		if !q.CreatedBefore.IsZero() && !createdAt.Before(q.CreatedBefore) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (q userQuery) less(a, b *pbu.User) bool {
+	get := userSortFields[q.Sort]
+	left, right := get(a), get(b)
+
+	var cmp int
+	if q.Sort == "created_at" || q.Sort == "updated_at" {
+		leftTime, _ := parseTimestamp(left)
+		rightTime, _ := parseTimestamp(right)
+		cmp = leftTime.Compare(rightTime)
+	} else {
+		cmp = strings.Compare(strings.ToLower(left), strings.ToLower(right))
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.GetId(), b.GetId())
+	}
+
+	if q.Order == "desc" {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func parseTimestamp(value string) (time.Time, bool) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// errTooManyToSort is returned for a sorted query when the backend holds more
+// than ListUsersMaxScan users, because sorting needs all of them in memory.
+var errTooManyToSort = errors.New("there are too many users to sort, leave out sort")
+
+// userPage is one page of a user query. Count is nil when only a full scan
+// could tell it. Next is the offset of the next page when HasMore is set.
+type userPage struct {
+	Users   []*pbu.User
+	Count   *int64
+	HasMore bool
+	Next    int
+}
+
+func (h *handlerV1) queryUsers(ctx context.Context, query userQuery, offset int) (userPage, error) {
+	switch {
+	case query.Sort != "":
+		return h.sortUsers(ctx, query, offset)
+	case query.filtered():
+		return h.filterUsers(ctx, query, offset)
+	}
+
+	response, err := h.serviceManager.UserService().GetAllUsers(ctx, &pbu.ListUsersReq{
+		Limit: int64(query.Limit),
+		Page:  int64(offset/query.Limit + 1),
+	})
+	if err != nil {
+		return userPage{}, err
+	}
+
+	next := offset + len(response.Users)
+	return userPage{
+		Users:   response.Users,
+		Count:   &response.Count,
+		HasMore: int64(next) < response.Count,
+		Next:    next,
+	}, nil
+}
+
+// filterUsers reads the backend's pages from position on and keeps the users
+// that match, until the page is full or ListUsersMaxScan users were read. A
+// page may then be short, or even empty, and still have a next one. Only a
+// query that filters on deleted alone has a count, from the tombstones.
+func (h *handlerV1) filterUsers(ctx context.Context, query userQuery, position int) (userPage, error) {
+	var (
+		result  userPage
+		scanned int
+	)
+	for {
+		response, err := h.serviceManager.UserService().GetAllUsers(ctx, &pbu.ListUsersReq{
+			Limit: listUsersScanPageSize,
+			Page:  int64(position/listUsersScanPageSize + 1),
+		})
+		if err != nil {
+			return userPage{}, err
+		}
+		if result.Count == nil && !query.typed() {
+			if result.Count, err = h.deletedCount(query, response.Count); err != nil {
+				return userPage{}, err
+			}
+		}
+
+		skip := position % listUsersScanPageSize
+		if skip > len(response.Users) {
+			skip = len(response.Users)
+		}
+		for _, user := range response.Users[skip:] {
+			if query.matches(user) {
+				if len(result.Users) == query.Limit {
+					result.HasMore, result.Next = true, position
+					return result, nil
+				}
+				result.Users = append(result.Users, user)
+			}
+			position++
+			scanned++
+		}
+
+		if len(response.Users) < listUsersScanPageSize || int64(position) >= response.Count {
+			return result, nil
+		}
+		if h.cfg.ListUsersMaxScan > 0 && scanned >= h.cfg.ListUsersMaxScan {
+			result.HasMore, result.Next = true, position
+			return result, nil
+		}
+	}
+}
+
+// deletedCount counts the users a query on deleted alone matches, out of the
+// total the backend holds.
+func (h *handlerV1) deletedCount(query userQuery, total int64) (*int64, error) {
+	deleted, err := tombstone.Count(h.inMemoryStorage)
+	if err != nil {
+		return nil, err
+	}
+
+	count := deleted
+	if query.Deleted == deletedExclude {
+		count = total - deleted
+	}
+	if count < 0 {
+		count = 0
+	}
+	return &count, nil
+}
+
+// sortUsers reads every user, so it refuses to when there are more than
+// ListUsersMaxScan of them.
+func (h *handlerV1) sortUsers(ctx context.Context, query userQuery, offset int) (userPage, error) {
+	var (
+		matched []*pbu.User
+		scanned int
+	)
+	for page := int64(1); ; page++ {
+		response, err := h.serviceManager.UserService().GetAllUsers(ctx, &pbu.ListUsersReq{
+			Limit: listUsersScanPageSize,
+			Page:  page,
+		})
+		if err != nil {
+			return userPage{}, err
+		}
+		if h.cfg.ListUsersMaxScan > 0 && response.Count > int64(h.cfg.ListUsersMaxScan) {
+			return userPage{}, errTooManyToSort
+		}
+
+		for _, user := range response.Users {
+			if query.matches(user) {
+				matched = append(matched, user)
+			}
+		}
+		scanned += len(response.Users)
+
+		if len(response.Users) < listUsersScanPageSize || int64(scanned) >= response.Count {
+			break
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return query.less(matched[i], matched[j])
+	})
+
+	count := int64(len(matched))
+	result := userPage{Count: &count}
+	if offset < len(matched) {
+		end := offset + query.Limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		result.Users = matched[offset:end]
+		result.HasMore, result.Next = end < len(matched), end
+	}
+
+	return result, nil
+}
+
+// nextPageURL is the request URL with cursor moved to the next page.
+func nextPageURL(c *gin.Context, next string) string {
+	u := url.URL{Path: c.Request.URL.Path}
+	values := c.Request.URL.Query()
+	values.Set("cursor", next)
+	u.RawQuery = values.Encode()
+
+	return u.String()
+}
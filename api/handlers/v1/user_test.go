@@ -0,0 +1,192 @@
+package v1
+
+import (
+	"encoding/json"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/pkg/etc"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const registeredEmail = "ann@example.com"
+
+// register saves a pending registration of registeredEmail with code, the
+// way Register leaves it.
+func (f handlerFixture) register(t *testing.T, code string) {
+	t.Helper()
+
+	passwordHash, err := etc.GenerateHashPassword("secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &handlerV1{inMemoryStorage: f.storage, cfg: f.cfg}
+	err = h.saveRegistration(models.RegisterUserModel{
+		ID:           "u1",
+		FirstName:    "Ann",
+		LastName:     "Lee",
+		Email:        registeredEmail,
+		PasswordHash: passwordHash,
+		CodeHash:     etc.HashCode(code, f.cfg.VerifyCodeHashKey),
+		ExpiresAt:    time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterKeepsNoPlaintextPassword(t *testing.T) {
+	f := newHandlerFixture(t)
+
+	w := f.serve(http.MethodPost, "/v1/register", "", models.User{
+		FirstName: "Ann",
+		LastName:  "Lee",
+		BirthDate: "1990-01-02",
+		Email:     " Ann@Example.com ",
+		Password:  "secret123",
+	})
+	wantStatus(t, w, http.StatusOK)
+
+	stored, err := redis.Bytes(f.storage.Get(registeredEmail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), "secret123") {
+		t.Fatal("registration keeps the plaintext password")
+	}
+
+	w = f.serve(http.MethodPost, "/v1/verify", "", models.VerifyReq{Email: registeredEmail, Code: f.lastCode(t, registeredEmail)})
+	wantStatus(t, w, http.StatusCreated)
+
+	var resp models.VerifyRespModel
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	user := f.users.user(resp.ID)
+	if user == nil || !etc.CompareHashPassword(user.Password, "secret123") {
+		t.Error("created user does not have the registered password")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// codes are tried in order, the last one's answer is checked.
+		codes      []string
+		createErr  error
+		wantStatus int
+		wantError  string
+		wantUser   bool
+		// wantPending is whether the registration is still waiting after.
+		wantPending bool
+	}{
+		{
+			name:       "right code",
+			codes:      []string{"12345"},
+			wantStatus: http.StatusCreated,
+			wantUser:   true,
+		},
+		{
+			name:        "wrong code",
+			codes:       []string{"00000"},
+			wantStatus:  http.StatusBadRequest,
+			wantError:   ErrorCodeInvalidCode,
+			wantPending: true,
+		},
+		{
+			name:       "right code after a wrong one",
+			codes:      []string{"00000", "12345"},
+			wantStatus: http.StatusCreated,
+			wantUser:   true,
+		},
+		{
+			name:       "last attempt wrong drops the registration",
+			codes:      []string{"00000", "00000", "00000"},
+			wantStatus: http.StatusBadRequest,
+			wantError:  ErrorCodeInvalidCode,
+		},
+		{
+			name:       "right code once attempts are used up",
+			codes:      []string{"00000", "00000", "00000", "12345"},
+			wantStatus: http.StatusNotFound,
+			wantError:  ErrorCodeNotFound,
+		},
+		{
+			name:       "code is consumed",
+			codes:      []string{"12345", "12345"},
+			wantStatus: http.StatusNotFound,
+			wantError:  ErrorCodeNotFound,
+			wantUser:   true,
+		},
+		{
+			name:        "user service fails",
+			codes:       []string{"12345"},
+			createErr:   status.Error(codes.Unavailable, "down"),
+			wantStatus:  http.StatusServiceUnavailable,
+			wantPending: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newHandlerFixture(t)
+			f.users.createErr = tt.createErr
+			f.register(t, "12345")
+
+			var last int
+			var body string
+			for _, code := range tt.codes {
+				w := f.serve(http.MethodPost, "/v1/verify", "", models.VerifyReq{Email: registeredEmail, Code: code})
+				last, body = w.Code, w.Body.String()
+				if tt.wantError != "" && w.Code == tt.wantStatus {
+					if got := errorStatus(t, w); got != tt.wantError {
+						t.Errorf("error status %s, want %s", got, tt.wantError)
+					}
+				}
+			}
+			if last != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", last, tt.wantStatus, body)
+			}
+
+			if created := f.users.user("u1") != nil; created != tt.wantUser {
+				t.Errorf("user created = %v, want %v", created, tt.wantUser)
+			}
+			pending, err := f.storage.Get(registeredEmail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (pending != nil) != tt.wantPending {
+				t.Errorf("registration pending = %v, want %v", pending != nil, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestVerifyCountsAttemptsLeft(t *testing.T) {
+	f := newHandlerFixture(t)
+	f.register(t, "12345")
+
+	for left := f.cfg.VerifyMaxAttempts - 1; left >= 0; left-- {
+		w := f.serve(http.MethodPost, "/v1/verify", "", models.VerifyReq{Email: registeredEmail, Code: "00000"})
+		wantStatus(t, w, http.StatusBadRequest)
+
+		var resp struct {
+			Error models.VerificationError `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if left > 0 && resp.Error.VerificationStatus.AttemptsLeft != left {
+			t.Errorf("attempts left %d, want %d", resp.Error.VerificationStatus.AttemptsLeft, left)
+		}
+		if left == 0 && !strings.Contains(resp.Error.Message, "no attempts are left") {
+			t.Errorf("last wrong code answered %q", resp.Error.Message)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/email"
+	"myproject/api-gateway/pkg/etc"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	verifyAttemptsKeyPrefix = "verify:attempts:"
+	// verifyResendKeyPrefix holds the unix time the next code may be sent.
+	verifyResendKeyPrefix = "verify:resend:"
+	verifySentKeyPrefix   = "verify:sent:"
+	// verifySendWindow is the period VerifyDailySendCap applies to, counted
+	// from the first code sent to an address.
+	verifySendWindow = 86400
+)
+
+// Resend verification code
+// @Router /v1/verify/resend [post]
+// @Summary resend verification code
+// @Tags User
+// @Description Send a new code for a pending registration. The previous code stops working and the failed attempts start over. Codes to one address are limited by a cooldown and a daily cap.
+// @Accept json
+// @Produce json
+// @Param email body models.ResendVerificationReq true "Email the registration was made with"
+// @Success 200 {object} models.RegisterRespModel
+// @Failure 400 string error models.ResponseError
+// @Failure 404 string error models.ResponseError
+// @Failure 429 string error models.ResponseError
+// @Failure 500 string error models.ResponseError
+func (h *handlerV1) ResendVerification(c *gin.Context) {
+	var body models.ResendVerificationReq
+
+	err := c.ShouldBindJSON(&body)
+	if handleBadRequestErrWithMessage(c, h.log, err, ErrorCodeInvalidJSON) {
+		return
+	}
+
+	body.Email = strings.ToLower(strings.TrimSpace(body.Email))
+
+	registration, err := h.pendingRegistration(body.Email)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while reading registration") {
+		return
+	}
+	if registration == nil {
+		c.JSON(http.StatusNotFound, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeNotFound,
+				Message: "There is no pending registration for this email, register again",
+			},
+		})
+		return
+	}
+
+	status, ok := h.reserveVerificationEmail(c, registration.Email)
+	if !ok {
+		return
+	}
+
+	code := etc.GenerateCode(5)
+	registration.CodeHash = etc.HashCode(code, h.cfg.VerifyCodeHashKey)
+	registration.ExpiresAt = time.Now().Add(time.Second * time.Duration(h.cfg.VerifyCodeTTL)).Unix()
+	err = h.saveRegistration(*registration)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while setting with ttl to redis") {
+		return
+	}
+
+	ctx, cancel := h.requestContext(c)
+	defer cancel()
+
+	message, err := email.SendVerificationCode(ctx, h.mailer, email.EmailPayload{
+		To:        registration.Email,
+		Code:      code,
+		Message:   fmt.Sprintf("Hi, %s", registration.FirstName),
+		ExpiresAt: time.Unix(registration.ExpiresAt, 0),
+	})
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while sending code to user's email") {
+		return
+	}
+
+	status.ExpiresIn = h.cfg.VerifyCodeTTL
+	status.AttemptsLeft = h.cfg.VerifyMaxAttempts
+	c.JSON(http.StatusOK, models.RegisterRespModel{
+		Message:            message,
+		VerificationStatus: status,
+	})
+}
+
+// reserveVerificationEmail answers 429 when no code may be sent to address
+// yet. Otherwise it counts the code as sent and starts the cooldown.
+func (h *handlerV1) reserveVerificationEmail(c *gin.Context, address string) (models.VerificationStatus, bool) {
+	now := time.Now()
+	cooldown := h.cfg.VerifyResendCooldown
+
+	if cooldown > 0 {
+		next := now.Add(time.Second * time.Duration(cooldown)).Unix()
+		reserved, err := h.inMemoryStorage.SetNXWithTTL(verifyResendKeyPrefix+address, strconv.FormatInt(next, 10), cooldown)
+		if handleInternalServerErrorWithMessage(c, h.log, err, "error while reserving verification email") {
+			return models.VerificationStatus{}, false
+		}
+		if !reserved {
+			next, _ = redis.Int64(h.inMemoryStorage.Get(verifyResendKeyPrefix + address))
+			wait := int(next - now.Unix())
+			if wait < 1 {
+				wait = 1
+			}
+			c.Header("Retry-After", strconv.Itoa(wait))
+			c.JSON(http.StatusTooManyRequests, models.ResponseError{
+				Error: models.StandardErrorModel{
+					Status:  ErrorCodeTooManyRequests,
+					Message: fmt.Sprintf("A code was sent a moment ago, wait %d seconds before asking for another", wait),
+				},
+			})
+			return models.VerificationStatus{}, false
+		}
+	}
+
+	sent, err := h.inMemoryStorage.IncrWithTTL(verifySentKeyPrefix+address, verifySendWindow)
+	if handleInternalServerErrorWithMessage(c, h.log, err, "error while counting verification emails") {
+		return models.VerificationStatus{}, false
+	}
+	if int(sent) > h.cfg.VerifyDailySendCap {
+		c.JSON(http.StatusTooManyRequests, models.ResponseError{
+			Error: models.StandardErrorModel{
+				Status:  ErrorCodeTooManyRequests,
+				Message: "Too many codes were sent to this email today, try again tomorrow",
+			},
+		})
+		return models.VerificationStatus{}, false
+	}
+
+	return models.VerificationStatus{
+		ResendIn:    cooldown,
+		ResendsLeft: h.cfg.VerifyDailySendCap - int(sent),
+	}, true
+}
+
+// pendingRegistration returns nil when address has no registration waiting
+// for its code.
+func (h *handlerV1) pendingRegistration(address string) (*models.RegisterUserModel, error) {
+	data, err := redis.Bytes(h.inMemoryStorage.Get(address))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var registration models.RegisterUserModel
+	if err := json.Unmarshal(data, &registration); err != nil {
+		return nil, err
+	}
+
+	return &registration, nil
+}
+
+// saveRegistration keeps registration until its ExpiresAt, with a fresh
+// count of failed attempts.
+func (h *handlerV1) saveRegistration(registration models.RegisterUserModel) error {
+	data, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+
+	ttl := int(registration.ExpiresAt - time.Now().Unix())
+	if ttl < 1 {
+		ttl = 1
+	}
+	if err := h.inMemoryStorage.SetWithTTL(registration.Email, string(data), ttl); err != nil {
+		return err
+	}
+
+	return h.inMemoryStorage.Del(verifyAttemptsKeyPrefix + registration.Email)
+}
+
+// expiresIn is what is left of the code of registration, in seconds.
+func expiresIn(registration *models.RegisterUserModel) int {
+	left := int(registration.ExpiresAt - time.Now().Unix())
+	if left < 0 {
+		return 0
+	}
+
+	return left
+}
@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"io"
+	v1 "myproject/api-gateway/api/handlers/v1"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/pkg/etc"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/seal"
+	"myproject/api-gateway/storage/repo"
+	"net/http"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	idempotencyKeyPrefix      = "idempotency:"
+	idempotencyMaxKeyLength   = 255
+	idempotencyStateInFlight  = "in_flight"
+	idempotencyStateCompleted = "completed"
+)
+
+// idempotencyRecord is what is kept in redis for one key. Responses may hold
+// tokens, so the body is sealed with IdempotencySealKey, and the fingerprint
+// of a request that may hold a password is keyed with it.
+type idempotencyRecord struct {
+	State       string `json:"state"`
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SealedBody  []byte `json:"sealed_body,omitempty"`
+}
+
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// Idempotency makes a route safe to retry with the Idempotency-Key header. The
+// first response for a key is stored for IdempotencyTTL seconds and replayed
+// for repeats, a repeat arriving while the first request is still running gets
+// 409, and a key reused with a different body gets 422. Keys are scoped by
+// route and by the signed in user, or for anonymous callers by client IP.
+// Bodies over IdempotencyMaxBody get 413. Server errors are not stored, so
+// they can be retried.
+func Idempotency(storage repo.InMemoryStorageI, cfg config.Config) gin.HandlerFunc {
+	lockTTL := cfg.MaxRequestTimeout + cfg.CtxTimeout
+
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > idempotencyMaxKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, models.StandardErrorModel{
+				Status:  v1.ErrorCodeInvalidParams,
+				Message: "Idempotency-Key is too long",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, cfg.IdempotencyMaxBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, models.StandardErrorModel{
+				Status:  v1.ErrorCodePayloadTooLarge,
+				Message: "Request body is too large",
+			})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, models.StandardErrorModel{
+				Status:  v1.ErrorBadRequest,
+				Message: "Cannot read request body",
+			})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := etc.HashCode(string(body), cfg.IdempotencySealKey)
+
+		// Anonymous callers share no user id, so their keys are scoped by
+		// address. A replay also needs the same body, which for register
+		// includes the password.
+		scope := "anonymous:" + c.ClientIP()
+		if id, ok := identity.FromContext(c.Request.Context()); ok && id.UserID != "" {
+			scope = id.UserID
+		}
+		storageKey := idempotencyKeyPrefix + scope + ":" + c.Request.Method + ":" + c.FullPath() + ":" + key
+
+		inFlight, _ := json.Marshal(idempotencyRecord{
+			State:       idempotencyStateInFlight,
+			Fingerprint: fingerprint,
+		})
+		acquired, err := storage.SetNXWithTTL(storageKey, string(inFlight), lockTTL)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, models.StandardErrorModel{
+				Status:  v1.ErrorCodeInternalServerError,
+				Message: "Internal server error",
+			})
+			return
+		}
+
+		if !acquired {
+			replayIdempotent(c, storage, cfg, storageKey, fingerprint)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			_ = storage.Del(storageKey)
+			return
+		}
+
+		sealed, err := seal.Seal(recorder.body.Bytes(), cfg.IdempotencySealKey, storageKey)
+		if err != nil {
+			_ = storage.Del(storageKey)
+			return
+		}
+		completed, _ := json.Marshal(idempotencyRecord{
+			State:       idempotencyStateCompleted,
+			Fingerprint: fingerprint,
+			Status:      status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			SealedBody:  sealed,
+		})
+		if err := storage.SetWithTTL(storageKey, string(completed), cfg.IdempotencyTTL); err != nil {
+			_ = storage.Del(storageKey)
+		}
+	}
+}
+
+func replayIdempotent(c *gin.Context, storage repo.InMemoryStorageI, cfg config.Config, storageKey, fingerprint string) {
+	value, err := storage.Get(storageKey)
+
+	var record idempotencyRecord
+	if err == nil && value != nil {
+		err = json.Unmarshal([]byte(cast.ToString(value)), &record)
+	}
+	// The key expired or was released between SET NX and GET.
+	if err != nil || value == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, models.StandardErrorModel{
+			Status:  v1.ErrorCodeConflict,
+			Message: "A request with this Idempotency-Key is already in progress",
+		})
+		return
+	}
+
+	if record.Fingerprint != fingerprint {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, models.StandardErrorModel{
+			Status:  v1.ErrorCodeIdempotencyReused,
+			Message: "Idempotency-Key was already used with a different request body",
+		})
+		return
+	}
+
+	if record.State == idempotencyStateInFlight {
+		c.AbortWithStatusJSON(http.StatusConflict, models.StandardErrorModel{
+			Status:  v1.ErrorCodeConflict,
+			Message: "A request with this Idempotency-Key is already in progress",
+		})
+		return
+	}
+
+	body, err := seal.Open(record.SealedBody, cfg.IdempotencySealKey, storageKey)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, models.StandardErrorModel{
+			Status:  v1.ErrorCodeInternalServerError,
+			Message: "Internal server error",
+		})
+		return
+	}
+
+	c.Header(IdempotentReplayedHeader, "true")
+	c.Data(record.Status, record.ContentType, body)
+	c.Abort()
+}
@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"encoding/json"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/pkg/etc"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/storage/memory"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type idempotentCall struct {
+	key  string
+	body string
+	ip   string
+	user string
+	// status is what the handler answers if it runs.
+	status int
+
+	wantStatus   int
+	wantReplayed bool
+}
+
+// idempotentRouter runs Idempotency in front of a handler that answers
+// {"token":"secret-<n>"} with the status of the call, n counting the calls
+// that got through.
+func idempotentRouter(storage *memory.Storage, calls *int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	cfg := config.Config{
+		MaxRequestTimeout:  5,
+		CtxTimeout:         5,
+		IdempotencyTTL:     60,
+		IdempotencyMaxBody: 64,
+		IdempotencySealKey: "test-seal-key",
+	}
+
+	router.POST("/v1/users",
+		func(c *gin.Context) {
+			if user := c.GetHeader("X-Test-User"); user != "" {
+				ctx := identity.WithIdentity(c.Request.Context(), identity.Identity{UserID: user})
+				c.Request = c.Request.WithContext(ctx)
+			}
+		},
+		Idempotency(storage, cfg),
+		func(c *gin.Context) {
+			*calls++
+			status := http.StatusCreated
+			if s := c.GetHeader("X-Test-Status"); s != "" {
+				status, _ = strconv.Atoi(s)
+			}
+			c.JSON(status, gin.H{"token": "secret-" + strconv.Itoa(*calls)})
+		},
+	)
+
+	return router
+}
+
+func TestIdempotency(t *testing.T) {
+	tests := []struct {
+		name      string
+		calls     []idempotentCall
+		wantCalls int
+	}{
+		{
+			name: "no key runs every time",
+			calls: []idempotentCall{
+				{body: `{"a":1}`, wantStatus: http.StatusCreated},
+				{body: `{"a":1}`, wantStatus: http.StatusCreated},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "repeat is replayed",
+			calls: []idempotentCall{
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated},
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantReplayed: true},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "key reused with another body",
+			calls: []idempotentCall{
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated},
+				{key: "k1", body: `{"a":2}`, wantStatus: http.StatusUnprocessableEntity},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "server errors are not stored",
+			calls: []idempotentCall{
+				{key: "k1", body: `{"a":1}`, status: http.StatusInternalServerError, wantStatus: http.StatusInternalServerError},
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated},
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantReplayed: true},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "anonymous callers are scoped by address",
+			calls: []idempotentCall{
+				{key: "k1", body: `{"a":1}`, ip: "192.0.2.1", wantStatus: http.StatusCreated},
+				{key: "k1", body: `{"a":1}`, ip: "192.0.2.2", wantStatus: http.StatusCreated},
+				{key: "k1", body: `{"a":1}`, ip: "192.0.2.1", wantStatus: http.StatusCreated, wantReplayed: true},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "signed in callers are scoped by user",
+			calls: []idempotentCall{
+				{key: "k1", body: `{"a":1}`, user: "u1", wantStatus: http.StatusCreated},
+				{key: "k1", body: `{"a":1}`, user: "u2", wantStatus: http.StatusCreated},
+				{key: "k1", body: `{"a":1}`, user: "u1", ip: "192.0.2.9", wantStatus: http.StatusCreated, wantReplayed: true},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "body too large",
+			calls: []idempotentCall{
+				{key: "k1", body: `{"a":"` + strings.Repeat("x", 64) + `"}`, wantStatus: http.StatusRequestEntityTooLarge},
+			},
+		},
+		{
+			name: "key too long",
+			calls: []idempotentCall{
+				{key: strings.Repeat("k", idempotencyMaxKeyLength+1), body: `{"a":1}`, wantStatus: http.StatusBadRequest},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := memory.New()
+			calls := 0
+			router := idempotentRouter(storage, &calls)
+
+			// first is the first stored response of each caller.
+			first := make(map[string]string)
+			for i, call := range tt.calls {
+				w := serveIdempotent(router, call)
+
+				if w.Code != call.wantStatus {
+					t.Fatalf("call %d: status %d, want %d: %s", i, w.Code, call.wantStatus, w.Body)
+				}
+				if replayed := w.Header().Get(IdempotentReplayedHeader) == "true"; replayed != call.wantReplayed {
+					t.Errorf("call %d: replayed = %v, want %v", i, replayed, call.wantReplayed)
+				}
+
+				caller := call.user
+				if caller == "" {
+					caller = call.ip
+				}
+				if call.wantReplayed && w.Body.String() != first[caller] {
+					t.Errorf("call %d: replayed %s, want %s", i, w.Body, first[caller])
+				}
+				if _, ok := first[caller]; !ok && w.Code == http.StatusCreated {
+					first[caller] = w.Body.String()
+				}
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func serveIdempotent(router *gin.Engine, call idempotentCall) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(call.body))
+	req.Header.Set("Content-Type", "application/json")
+	if call.key != "" {
+		req.Header.Set(IdempotencyKeyHeader, call.key)
+	}
+	if call.user != "" {
+		req.Header.Set("X-Test-User", call.user)
+	}
+	if call.status != 0 {
+		req.Header.Set("X-Test-Status", strconv.Itoa(call.status))
+	}
+	req.RemoteAddr = "198.51.100.1:1234"
+	if call.ip != "" {
+		req.RemoteAddr = call.ip + ":1234"
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	storage := memory.New()
+	calls := 0
+	router := idempotentRouter(storage, &calls)
+
+	// The first request with this key is still running on another replica.
+	body := `{"a":1}`
+	record, _ := json.Marshal(idempotencyRecord{
+		State:       idempotencyStateInFlight,
+		Fingerprint: etc.HashCode(body, "test-seal-key"),
+	})
+	storageKey := idempotencyKeyPrefix + "anonymous:198.51.100.1:POST:/v1/users:k1"
+	if err := storage.SetWithTTL(storageKey, string(record), 60); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveIdempotent(router, idempotentCall{key: "k1", body: body})
+	if w.Code != http.StatusConflict {
+		t.Errorf("status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if calls != 0 {
+		t.Errorf("handler ran %d times, want 0", calls)
+	}
+}
+
+func TestIdempotencySealsStoredResponses(t *testing.T) {
+	storage := memory.New()
+	calls := 0
+	router := idempotentRouter(storage, &calls)
+
+	if w := serveIdempotent(router, idempotentCall{key: "k1", body: `{"a":1}`}); w.Code != http.StatusCreated {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	keys := storage.Keys(idempotencyKeyPrefix)
+	if len(keys) != 1 {
+		t.Fatalf("stored keys %v, want one", keys)
+	}
+	value, err := storage.Get(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := string(value.([]byte)); strings.Contains(stored, "secret-") || strings.Contains(stored, `\"a\"`) {
+		t.Errorf("stored record is readable: %s", stored)
+	}
+}
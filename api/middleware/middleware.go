@@ -9,6 +9,10 @@ import (
 	v1 "myproject/api-gateway/api/handlers/v1"
 	"myproject/api-gateway/api/models"
 	"myproject/api-gateway/config"
+	"myproject/api-gateway/pkg/identity"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/tombstone"
+	"myproject/api-gateway/storage/repo"
 	"net/http"
 	"strings"
 )
@@ -16,12 +20,16 @@ import (
 type CasbinHandler struct {
 	cfg      config.Config
 	enforcer *casbin.Enforcer
+	storage  repo.InMemoryStorageI
+	log      logger.Logger
 }
 
-func Auth(casbin *casbin.Enforcer, cfg config.Config) gin.HandlerFunc {
+func Auth(casbin *casbin.Enforcer, cfg config.Config, storage repo.InMemoryStorageI, log logger.Logger) gin.HandlerFunc {
 	casbHandler := &CasbinHandler{
 		cfg:      cfg,
 		enforcer: casbin,
+		storage:  storage,
+		log:      log,
 	}
 
 	return func(ctx *gin.Context) {
@@ -39,13 +47,78 @@ func Auth(casbin *casbin.Enforcer, cfg config.Config) gin.HandlerFunc {
 			casbHandler.RequirePermission(ctx)
 			return
 		}
+
+		if casbHandler.RejectDeleted(ctx) {
+			return
+		}
+
+		casbHandler.SetIdentity(ctx)
 	}
 }
 
-func (c *CasbinHandler) GetRole(ctx *http.Request) (string, int) {
+// RejectDeleted answers 401 when the token belongs to a deleted user. It
+// costs a redis GET on every authenticated request. When redis can not be
+// read, writes get 503 so a deleted user can not change anything, and reads
+// are let through so an outage does not take every signed in page down.
+func (c *CasbinHandler) RejectDeleted(ctx *gin.Context) bool {
+	claims, status := c.GetClaims(ctx.Request)
+	if status != http.StatusOK || claims == nil {
+		return false
+	}
+
+	userID := cast.ToString(claims["sub"])
+	deleted, err := tombstone.Exists(c.storage, userID)
+	if err != nil && !safeMethod(ctx.Request.Method) {
+		c.log.Error("cannot check whether user is deleted", logger.String("user_id", userID), logger.Error(err))
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, models.StandardErrorModel{
+			Status:  v1.ErrorCodeServiceUnavailable,
+			Message: "Service is unavailable, try again later",
+		})
+		return true
+	}
+	if err != nil {
+		c.log.Error("cannot check whether user is deleted, letting the read through", logger.String("user_id", userID), logger.Error(err))
+		return false
+	}
+	if deleted {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, models.StandardErrorModel{
+			Status:  v1.ErrorCodeUnauthorized,
+			Message: "User was deleted",
+		})
+		return true
+	}
+
+	return false
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// SetIdentity copies the caller's token claims into the request context, so
+// they are forwarded to backends together with the request id.
+func (c *CasbinHandler) SetIdentity(ctx *gin.Context) {
+	claims, status := c.GetClaims(ctx.Request)
+	if status != http.StatusOK || claims == nil {
+		return
+	}
+
+	id, _ := identity.FromContext(ctx.Request.Context())
+	id.UserID = cast.ToString(claims["sub"])
+	id.Role = cast.ToString(claims["role"])
+	id.Tenant = cast.ToString(claims["tenant"])
+	if id.ClientIP == "" {
+		id.ClientIP = ctx.ClientIP()
+	}
+
+	ctx.Request = ctx.Request.WithContext(identity.WithIdentity(ctx.Request.Context(), id))
+}
+
+// GetClaims returns nil claims for anonymous requests.
+func (c *CasbinHandler) GetClaims(ctx *http.Request) (jwt.MapClaims, int) {
 	token := ctx.Header.Get("Authorization")
 	if token == "" {
-		return "unauthorized", http.StatusOK
+		return nil, http.StatusOK
 	}
 
 	var cutToken string
@@ -57,7 +130,18 @@ func (c *CasbinHandler) GetRole(ctx *http.Request) (string, int) {
 
 	claims, err := tokens.ExtractClaims(cutToken, []byte(c.cfg.SignInKey))
 	if err != nil {
-		return "unauthorized, token is invalid", http.StatusBadRequest
+		return nil, http.StatusBadRequest
+	}
+	return claims, http.StatusOK
+}
+
+func (c *CasbinHandler) GetRole(ctx *http.Request) (string, int) {
+	claims, status := c.GetClaims(ctx)
+	if status != http.StatusOK {
+		return "unauthorized, token is invalid", status
+	}
+	if claims == nil {
+		return "unauthorized", http.StatusOK
 	}
 	return cast.ToString(claims["role"]), http.StatusOK
 }
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	"math"
+	v1 "myproject/api-gateway/api/handlers/v1"
+	"myproject/api-gateway/api/models"
+	"myproject/api-gateway/pkg/identity"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limiterIdleTimeout is how long a caller's bucket is kept after its last
+// request.
+const limiterIdleTimeout = 10 * time.Minute
+
+type callerLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimit gives every caller a token bucket of rps requests per second with
+// the given burst. Callers are told apart by user id, or by client ip for
+// anonymous requests, so it must run after Auth. A non-positive rps disables
+// the limit.
+func RateLimit(rps float64, burst int) gin.HandlerFunc {
+	if rps <= 0 {
+		return func(c *gin.Context) {}
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	var (
+		mu        sync.Mutex
+		limiters  = make(map[string]*callerLimiter)
+		lastSweep = time.Now()
+	)
+
+	return func(c *gin.Context) {
+		key := c.ClientIP()
+		if id, ok := identity.FromContext(c.Request.Context()); ok && id.UserID != "" {
+			key = "user:" + id.UserID
+		}
+
+		now := time.Now()
+
+		mu.Lock()
+		if now.Sub(lastSweep) > limiterIdleTimeout {
+			for k, l := range limiters {
+				if now.Sub(l.lastSeen) > limiterIdleTimeout {
+					delete(limiters, k)
+				}
+			}
+			lastSweep = now
+		}
+
+		l, ok := limiters[key]
+		if !ok {
+			l = &callerLimiter{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+			limiters[key] = l
+		}
+		l.lastSeen = now
+		reservation := l.limiter.ReserveN(now, 1)
+		mu.Unlock()
+
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			c.Header("Retry-After", fmt.Sprint(int64(math.Ceil(delay.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, models.StandardErrorModel{
+				Status:  v1.ErrorCodeTooManyRequests,
+				Message: "Too many requests, try again later.",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"myproject/api-gateway/pkg/identity"
+	"regexp"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDPattern keeps client ids safe to pass on as gRPC metadata, where
+// other bytes make the call fail.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID reuses the client's X-Request-ID or generates a new one, echoes it
+// back in the response and stores it in the request context for backends.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = uuid.New().String()
+		}
+
+		c.Header(RequestIDHeader, requestID)
+		c.Request = c.Request.WithContext(identity.WithIdentity(c.Request.Context(), identity.Identity{
+			RequestID: requestID,
+			ClientIP:  c.ClientIP(),
+		}))
+
+		c.Next()
+	}
+}
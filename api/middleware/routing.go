@@ -0,0 +1,15 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"myproject/api-gateway/services"
+)
+
+// BackendRouting makes the request headers available to the user service
+// routing rules.
+func BackendRouting() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(services.WithRequestHeader(c.Request.Context(), c.Request.Header))
+		c.Next()
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"myproject/api-gateway/config"
+	"strings"
+	"time"
+)
+
+const RequestTimeoutHeader = "Request-Timeout"
+
+// Timeout attaches a deadline to the request context. The route timeout from
+// config is used by default, and a client may ask for a shorter or longer one
+// with the Request-Timeout header, capped by MaxRequestTimeout.
+func Timeout(cfg config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout := time.Second * time.Duration(cfg.CtxTimeout)
+		if seconds, ok := cfg.RouteTimeouts[c.FullPath()]; ok {
+			timeout = time.Second * time.Duration(seconds)
+		}
+
+		if requested, ok := parseRequestTimeout(c.GetHeader(RequestTimeoutHeader)); ok {
+			timeout = requested
+		}
+
+		if limit := time.Second * time.Duration(cfg.MaxRequestTimeout); limit > 0 && timeout > limit {
+			timeout = limit
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// parseRequestTimeout accepts either a number of seconds ("5") or a
+// duration ("1500ms", "2s").
+func parseRequestTimeout(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d, true
+	}
+
+	if seconds, err := cast.ToFloat64E(value); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+
+	return 0, false
+}
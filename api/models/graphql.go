@@ -0,0 +1,7 @@
+package models
+
+type GraphQLReq struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
@@ -16,6 +16,12 @@ type ValidationError struct {
 }
 
 type StandardErrorModel struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status     string           `json:"status"`
+	Message    string           `json:"message"`
+	Violations []FieldViolation `json:"violations,omitempty"`
+}
+
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
 }
@@ -16,24 +16,27 @@ type User struct {
 	Password  string `json:"password"`
 }
 
-type GetAllUsersRespModel struct {
-	Users []*User
-	Count int64
-}
-
 // Login model
 type LoginReqModel struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
+// UserPublic is a user as the API returns it, built by projection.User.
+// DeletedAt is only filled for admins.
+type UserPublic struct {
+	ID        string `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	BirthDate string `json:"birth_date"`
+	Email     string `json:"email"`
+	CreatedAt string `json:"created_at,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+	DeletedAt string `json:"deleted_at,omitempty"`
+}
+
 type UserModel struct {
-	ID          string `json:"id"`
-	FirstName   string `json:"first_name"`
-	LastName    string `json:"last_name"`
-	BirthDate   string `json:"birth_date"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
+	UserPublic
 	AccessToken string `json:"access_token"`
 }
 
@@ -42,11 +45,23 @@ type LoginRespModel struct {
 	User   UserModel `json:"user"`
 }
 
+var (
+	nameRules = []validation.Rule{
+		validation.Required,
+		validation.Length(3, 50),
+		validation.Match(regexp.MustCompile("^[A-Z][a-z]*$")).Error("should start with a capital letter and should only contain letters"),
+	}
+	birthDateRules = []validation.Rule{
+		validation.Required,
+		validation.Match(regexp.MustCompile("^\\d{4}-\\d{2}-\\d{2}$")).Error("should be in the format 'yyyy-mm-dd'"),
+	}
+)
+
 func (r *User) Validate() error {
 	return validation.ValidateStruct(
 		r,
-		validation.Field(&r.FirstName, validation.Required, validation.Length(3, 50), validation.Match(regexp.MustCompile("^[A-Z][a-z]*$")).Error("should start with a capital letter and should only contain letters")),
-		validation.Field(&r.LastName, validation.Required, validation.Length(3, 50), validation.Match(regexp.MustCompile("^[A-Z][a-z]*$")).Error("should start with a capital letter and should only contain letters")),
+		validation.Field(&r.FirstName, nameRules...),
+		validation.Field(&r.LastName, nameRules...),
 		validation.Field(&r.Email, validation.Required, validation.Length(5, 100), is.Email),
 		validation.Field(&r.Password,
 			validation.Required,
@@ -54,52 +69,205 @@ func (r *User) Validate() error {
 			validation.Match(regexp.MustCompile("\\d")).Error("should contain at least one digit"),
 			validation.Match(regexp.MustCompile("^[a-zA-Z\\d]+$")).Error("should only contain letters (either lowercase or uppercase) and digits"),
 		),
-		validation.Field(&r.BirthDate, validation.Required, validation.Match(regexp.MustCompile("^\\d{4}-\\d{2}-\\d{2}$")).Error("should be in the format 'yyyy-mm-dd'")),
+		validation.Field(&r.BirthDate, birthDateRules...),
+	)
+}
+
+// ValidateProfile validates the fields a user may change about themselves.
+func (r *User) ValidateProfile() error {
+	return validation.ValidateStruct(
+		r,
+		validation.Field(&r.FirstName, nameRules...),
+		validation.Field(&r.LastName, nameRules...),
+		validation.Field(&r.BirthDate, birthDateRules...),
 	)
 }
 
+// ValidateFields validates only the named fields, by their json names.
+func (r *User) ValidateFields(fields []string) error {
+	var rules []*validation.FieldRules
+	for _, field := range fields {
+		switch field {
+		case "first_name":
+			rules = append(rules, validation.Field(&r.FirstName, nameRules...))
+		case "last_name":
+			rules = append(rules, validation.Field(&r.LastName, nameRules...))
+		case "birth_date":
+			rules = append(rules, validation.Field(&r.BirthDate, birthDateRules...))
+		}
+	}
+
+	return validation.ValidateStruct(r, rules...)
+}
+
+// UserPatch documents the JSON merge patch accepted by PATCH /v1/users/{id}.
+// Omitted fields are left as they are.
+type UserPatch struct {
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	BirthDate string `json:"birth_date,omitempty"`
+}
+
+// RegisterUserModel is a registration waiting for its code in redis, so it
+// keeps the password hashed already.
 type RegisterUserModel struct {
-	ID        string `json:"id"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	BirthDate string `json:"birth_date"`
-	Email     string `json:"email"`
-	Password  string `json:"password"`
-	Code      string `json:"code"`
+	ID           string `json:"id"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	BirthDate    string `json:"birth_date"`
+	Email        string `json:"email"`
+	PasswordHash string `json:"password_hash"`
+	CodeHash     string `json:"code_hash"`
+	ExpiresAt    int64  `json:"expires_at"`
 }
 
 type VerifyRespModel struct {
-	ID          string `json:"id"`
-	FirstName   string `json:"first_name"`
-	LastName    string `json:"last_name"`
-	BirthDate   string `json:"birth_date"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
+	UserPublic
 	AccessToken string `json:"access_token"`
 }
 
 type RegisterRespModel struct {
 	Message string `json:"message"`
+	VerificationStatus
 }
 
-type Status struct {
+// VerificationStatus tells the client how long the sent code stays valid,
+// how many guesses are left and when another code may be sent. All times are
+// in seconds.
+type VerificationStatus struct {
+	ExpiresIn    int `json:"expires_in"`
+	AttemptsLeft int `json:"attempts_left"`
+	ResendIn     int `json:"resend_in"`
+	ResendsLeft  int `json:"resends_left"`
+}
+
+// VerificationError is the error of a failed verification, with what is
+// left of the pending registration.
+type VerificationError struct {
+	Status  string `json:"status"`
 	Message string `json:"message"`
+	VerificationStatus
 }
 
-type UserResp struct {
-	ID        string `json:"id"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	BirthDate string `json:"birth_date"`
-	Email     string `json:"email"`
-	Password  string `json:"password"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+type VerifyReq struct {
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+type ResendVerificationReq struct {
+	Email string `json:"email"`
+}
+
+type Status struct {
+	Message string `json:"message"`
 }
 
 type ListUsersResp struct {
-	Count int64
-	Users []*UserResp
+	Users []UserPublic `json:"users"`
+	Count int64        `json:"count"`
+}
+
+// UsersPage is a page of GET /v1/users. NextCursor is empty on the last page.
+// Count is left out for filtered queries, which are not scanned in full.
+type UsersPage struct {
+	Users      []UserPublic `json:"users"`
+	Count      *int64       `json:"count,omitempty"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type BatchGetUsersReq struct {
+	IDs []string `json:"ids"`
+}
+
+type BatchGetUserResult struct {
+	ID    string              `json:"id"`
+	User  *UserPublic         `json:"user,omitempty"`
+	Error *StandardErrorModel `json:"error,omitempty"`
+}
+
+type BatchGetUsersResp struct {
+	Results []BatchGetUserResult `json:"results"`
+}
+
+// Statuses of an imported row.
+const (
+	ImportRowValid   = "valid"
+	ImportRowCreated = "created"
+	ImportRowSkipped = "skipped"
+	ImportRowFailed  = "failed"
+)
+
+type ImportRowResult struct {
+	Row    int                 `json:"row"`
+	Email  string              `json:"email,omitempty"`
+	Status string              `json:"status"`
+	UserID string              `json:"user_id,omitempty"`
+	Error  *StandardErrorModel `json:"error,omitempty"`
+}
+
+// ImportUsersReport has one entry per row. Sending the same file again with
+// ImportID skips the rows that were already created. Truncated means rows
+// after IMPORT_MAX_ROWS were not read, Error that the file broke off and the
+// rows after it were not read.
+type ImportUsersReport struct {
+	ImportID  string              `json:"import_id"`
+	Mode      string              `json:"mode"`
+	Total     int                 `json:"total"`
+	Valid     int                 `json:"valid"`
+	Created   int                 `json:"created"`
+	Skipped   int                 `json:"skipped"`
+	Failed    int                 `json:"failed"`
+	Truncated bool                `json:"truncated,omitempty"`
+	Error     *StandardErrorModel `json:"error,omitempty"`
+	Rows      []ImportRowResult   `json:"rows"`
+}
+
+// DataExportArchive is the copy of their data a user downloads. Sessions and
+// Audit hold the most recent sign-ins and changes, oldest first.
+type DataExportArchive struct {
+	ExportID  string                 `json:"export_id"`
+	CreatedAt string                 `json:"created_at"`
+	Profile   UserPublic             `json:"profile"`
+	Erasure   *ErasureStatus         `json:"erasure,omitempty"`
+	Avatar    *AvatarResp            `json:"avatar,omitempty"`
+	Sessions  []DataExportSession    `json:"sessions"`
+	Audit     []DataExportAuditEntry `json:"audit"`
+}
+
+// DataExportSession is a sign-in that issued tokens. Method is "password" or
+// "registration".
+type DataExportSession struct {
+	Method    string `json:"method"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	StartedAt string `json:"started_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type DataExportAuditEntry struct {
+	EventID    string `json:"event_id"`
+	Type       string `json:"type"`
+	RequestID  string `json:"request_id,omitempty"`
+	OccurredAt string `json:"occurred_at"`
+}
+
+type DataExportResp struct {
+	ExportID    string `json:"export_id"`
+	DownloadURL string `json:"download_url"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+type ErasureStatus struct {
+	RequestedAt  string `json:"requested_at"`
+	ExecuteAfter string `json:"execute_after"`
+}
+
+// AvatarResp has a signed URL for every size of the avatar: large, medium
+// and small. The URLs change with every upload, so they are cached forever.
+type AvatarResp struct {
+	URLs      map[string]string `json:"urls"`
+	UpdatedAt string            `json:"updated_at"`
 }
 
 type ChangePasswordReq struct {
@@ -116,3 +284,37 @@ func (c *ChangePasswordReq) Validate() error {
 		),
 	)
 }
+
+type EmailChangeReq struct {
+	Email string `json:"email"`
+}
+
+func (r *EmailChangeReq) Validate() error {
+	return validation.ValidateStruct(
+		r,
+		validation.Field(&r.Email, validation.Required, validation.Length(5, 100), is.Email),
+	)
+}
+
+type EmailChangeConfirmReq struct {
+	Code string `json:"code"`
+}
+
+// DeadMail is an email that failed its last attempt. The body is left out
+// because it may carry a verification code.
+type DeadMail struct {
+	ID         string `json:"id"`
+	To         string `json:"to"`
+	Subject    string `json:"subject"`
+	Attempts   int    `json:"attempts"`
+	LastError  string `json:"last_error"`
+	EnqueuedAt string `json:"enqueued_at"`
+	FailedAt   string `json:"failed_at"`
+}
+
+// DeadMailPage is a page of dead mail, oldest first. NextCursor is empty on
+// the last page.
+type DeadMailPage struct {
+	Messages   []DeadMail `json:"messages"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
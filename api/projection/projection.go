@@ -0,0 +1,36 @@
+package projection
+
+import (
+	"context"
+	"myproject/api-gateway/api/models"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/identity"
+)
+
+// User maps a backend user to its public form for the caller in ctx.
+func User(ctx context.Context, user *pbu.User) models.UserPublic {
+	public := models.UserPublic{
+		ID:        user.GetId(),
+		FirstName: user.GetFirstName(),
+		LastName:  user.GetLastName(),
+		BirthDate: user.GetBirthDate(),
+		Email:     user.GetEmail(),
+		CreatedAt: user.GetCreatedAt(),
+		UpdatedAt: user.GetUpdatedAt(),
+	}
+
+	if id, _ := identity.FromContext(ctx); id.IsAdmin() {
+		public.DeletedAt = user.GetDeletedAt()
+	}
+
+	return public
+}
+
+func Users(ctx context.Context, users []*pbu.User) []models.UserPublic {
+	public := make([]models.UserPublic, len(users))
+	for i, user := range users {
+		public[i] = User(ctx, user)
+	}
+
+	return public
+}
@@ -0,0 +1,162 @@
+package projection
+
+import (
+	"encoding/json"
+	"myproject/api-gateway/api/models"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sensitiveFields never appear in a response, whatever the role.
+var sensitiveFields = []string{"password", "refresh_token"}
+
+// errorModels are sent in models.ResponseError, whose Error swagger only
+// knows as a string.
+var errorModels = []interface{}{
+	models.ResponseError{},
+	models.StandardErrorModel{},
+	models.VerificationError{},
+}
+
+type swaggerSchema struct {
+	Ref                  string                   `json:"$ref"`
+	Properties           map[string]swaggerSchema `json:"properties"`
+	Items                *swaggerSchema           `json:"items"`
+	AdditionalProperties json.RawMessage          `json:"additionalProperties"`
+	AllOf                []swaggerSchema          `json:"allOf"`
+}
+
+type swaggerDoc struct {
+	Paths map[string]map[string]struct {
+		Responses map[string]struct {
+			Schema *swaggerSchema `json:"schema"`
+		} `json:"responses"`
+	} `json:"paths"`
+	Definitions map[string]swaggerSchema `json:"definitions"`
+}
+
+// TestResponsesHaveNoSensitiveFields walks the schema of every response in
+// the generated swagger, so a new endpoint is checked once it is documented.
+func TestResponsesHaveNoSensitiveFields(t *testing.T) {
+	data, err := os.ReadFile("../docs/swagger.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc swaggerDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	checked := 0
+	for path, methods := range doc.Paths {
+		for method, operation := range methods {
+			for code, response := range operation.Responses {
+				if response.Schema == nil {
+					continue
+				}
+				where := strings.ToUpper(method) + " " + path + " " + code
+				checkSchema(t, &doc, *response.Schema, []string{where}, map[string]bool{})
+				checked++
+			}
+		}
+	}
+	if checked == 0 {
+		t.Fatal("swagger documents no responses")
+	}
+}
+
+func TestErrorModelsHaveNoSensitiveFields(t *testing.T) {
+	for _, model := range errorModels {
+		if path, ok := findSensitiveField(reflect.TypeOf(model), nil, map[reflect.Type]bool{}); ok {
+			t.Errorf("%T exposes %s", model, strings.Join(path, "."))
+		}
+	}
+}
+
+func checkSchema(t *testing.T, doc *swaggerDoc, schema swaggerSchema, path []string, seen map[string]bool) {
+	t.Helper()
+
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/definitions/")
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+
+		definition, ok := doc.Definitions[name]
+		if !ok {
+			t.Errorf("%s: unknown definition %s", strings.Join(path, " > "), name)
+			return
+		}
+		checkSchema(t, doc, definition, append(path[:len(path):len(path)], name), seen)
+		return
+	}
+
+	for name, property := range schema.Properties {
+		if isSensitive(name) {
+			t.Errorf("%s exposes %s", strings.Join(path, " > "), name)
+		}
+		checkSchema(t, doc, property, append(path[:len(path):len(path)], name), seen)
+	}
+	if schema.Items != nil {
+		checkSchema(t, doc, *schema.Items, path, seen)
+	}
+	var additional swaggerSchema
+	if json.Unmarshal(schema.AdditionalProperties, &additional) == nil {
+		checkSchema(t, doc, additional, path, seen)
+	}
+	for _, part := range schema.AllOf {
+		checkSchema(t, doc, part, path, seen)
+	}
+}
+
+func findSensitiveField(t reflect.Type, path []string, seen map[reflect.Type]bool) ([]string, bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil, false
+	}
+	seen[t] = true
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" && !field.Anonymous {
+			name = field.Name
+		}
+		if isSensitive(name) {
+			return append(path, name), true
+		}
+
+		fieldPath := path
+		if name != "" {
+			fieldPath = append(path[:len(path):len(path)], name)
+		}
+		if found, ok := findSensitiveField(field.Type, fieldPath, seen); ok {
+			return found, true
+		}
+	}
+
+	return nil, false
+}
+
+func isSensitive(name string) bool {
+	for _, sensitive := range sensitiveFields {
+		if strings.EqualFold(name, sensitive) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"expvar"
 	"fmt"
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/util"
@@ -9,17 +10,29 @@ import (
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	_ "myproject/api-gateway/api/docs"
+	"myproject/api-gateway/api/handlers/gql"
+	"myproject/api-gateway/api/handlers/proxy"
 	"myproject/api-gateway/api/handlers/tokens"
 	v1 "myproject/api-gateway/api/handlers/v1"
 	"myproject/api-gateway/api/middleware"
 	"myproject/api-gateway/config"
+	"myproject/api-gateway/email"
+	"myproject/api-gateway/pkg/blob"
+	"myproject/api-gateway/pkg/events"
 	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/outbox"
+	"myproject/api-gateway/pkg/privacy"
 	"myproject/api-gateway/services"
 	"myproject/api-gateway/storage/repo"
 )
 
 type Option struct {
 	InMemory       repo.InMemoryStorageI
+	Events         *events.Broker
+	Erasures       *privacy.Erasures
+	Blobs          blob.Store
+	Mailer         email.Mailer
+	Outbox         *outbox.Outbox
 	Cfg            config.Config
 	Logger         logger.Logger
 	ServiceManager services.IServiceManager
@@ -55,9 +68,16 @@ func New(option Option) *gin.Engine {
 	casbinEnforcer.GetRoleManager().AddMatchingFunc("keyMatch3", util.KeyMatch3)
 
 	router := gin.New()
+	// ClientIP keys rate limits and is forwarded to backends, so only the
+	// configured proxies may set it through X-Forwarded-For.
+	if err := router.SetTrustedProxies(option.Cfg.TrustedProxies); err != nil {
+		option.Logger.Fatal("invalid trusted proxies\n", logger.Error(err))
+	}
 
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
+	router.Use(middleware.RequestID())
+	router.Use(middleware.BackendRouting())
 
 	jwtHandler := tokens.JWTHandler{
 		SignInKey: option.Cfg.SignInKey,
@@ -71,22 +91,120 @@ func New(option Option) *gin.Engine {
 		Cfg:             option.Cfg,
 		JwtHandler:      jwtHandler,
 		Casbin:          casbinEnforcer,
+		Events:          option.Events,
+		Erasures:        option.Erasures,
+		Blobs:           option.Blobs,
+		Mailer:          option.Mailer,
+		Outbox:          option.Outbox,
+	})
+
+	gqlHandler, err := gql.New(&gql.HandlerGQLConfig{
+		InMemoryStorage: option.InMemory,
+		Log:             option.Logger,
+		ServiceManager:  option.ServiceManager,
+		Cfg:             option.Cfg,
+		Casbin:          casbinEnforcer,
+		Events:          option.Events,
 	})
+	if err != nil {
+		option.Logger.Fatal("error while building the graphql schema\n", logger.Error(err))
+	}
+
+	auth := middleware.Auth(casbinEnforcer, option.Cfg, option.InMemory, option.Logger)
 
 	api := router.Group("/v1")
 
-	api.Use(middleware.Auth(casbinEnforcer, option.Cfg))
+	api.Use(auth)
+	api.Use(middleware.RateLimit(option.Cfg.RateLimitRPS, option.Cfg.RateLimitBurst))
+	api.Use(middleware.Timeout(option.Cfg))
 
-	api.POST("/register", handlerV1.Register)                   //unauthorized
-	api.GET("/verify/:email/:code", handlerV1.Verify)           //unauthorized
+	idempotent := middleware.Idempotency(option.InMemory, option.Cfg)
+
+	api.POST("/register", idempotent, handlerV1.Register)       //unauthorized
+	api.POST("/verify", handlerV1.Verify)                       //unauthorized
+	api.POST("/verify/resend", handlerV1.ResendVerification)    //unauthorized
 	api.POST("/login", handlerV1.Login)                         //unauthorized
-	api.POST("/user/create", handlerV1.CreateUser)              //admin
+	api.POST("/user/create", idempotent, handlerV1.CreateUser)  //admin
 	api.GET("/user/:id", handlerV1.GetUserById)                 //admin
 	api.PUT("/user/update/:id", handlerV1.UpdateUser)           //user
+	api.PATCH("/users/:id", handlerV1.PatchUser)                //user
 	api.DELETE("/user/delete/:id", handlerV1.DeleteUser)        //user
-	api.GET("/users/:page/:limit/:filter", handlerV1.ListUsers) //admin
+	api.POST("/users/:id/restore", handlerV1.RestoreUser)       //admin
+	api.DELETE("/users/:id/purge", handlerV1.PurgeUser)         //admin
+	api.GET("/users", handlerV1.QueryUsers)                     //admin
+	api.GET("/users/:page/:limit/:filter", handlerV1.ListUsers) //admin, deprecated
+	api.POST("/users/batch-get", handlerV1.BatchGetUsers)       //admin
+	api.POST("/graphql", gqlHandler.Handle)                     //user, fields are authorized separately
 	api.POST("/user/password/change", handlerV1.ChangePassword) //user
 
+	api.POST("/me/email", handlerV1.RequestEmailChange)            //user
+	api.POST("/me/email/confirm", handlerV1.ConfirmEmailChange)    //user
+	api.GET("/email-reverts/:token", handlerV1.ShowEmailRevert)    //unauthorized, the link is signed
+	api.POST("/email-reverts/:token", handlerV1.RevertEmailChange) //unauthorized, the link is signed
+	api.PUT("/me/avatar", handlerV1.PutAvatar)                     //user
+	api.GET("/me/avatar", handlerV1.GetAvatar)                     //user
+	api.GET("/avatars/:token", handlerV1.ServeAvatar)              //unauthorized, the link is signed
+	api.POST("/me/data-export", handlerV1.RequestDataExport)       //user
+	api.GET("/data-exports/:token", handlerV1.DownloadDataExport)  //unauthorized, the link is signed
+	api.POST("/me/erasure", handlerV1.RequestErasure)              //user
+	api.DELETE("/me/erasure", handlerV1.CancelErasure)             //user
+	api.POST("/users/:id/erasure", handlerV1.EraseUser)            //admin
+	api.DELETE("/users/:id/erasure", handlerV1.CancelUserErasure)  //admin
+
+	api.GET("/metrics", gin.WrapH(expvar.Handler())) //admin
+
+	// Event streams are long-lived, so they stay outside of the request timeout.
+	eventsAPI := router.Group("/v1/events")
+	eventsAPI.Use(auth)
+	eventsAPI.Use(middleware.RateLimit(option.Cfg.RateLimitRPS, option.Cfg.RateLimitBurst))
+
+	eventsAPI.GET("/users", handlerV1.StreamUserEvents)       //admin
+	eventsAPI.GET("/users/ws", handlerV1.UserEventsWebSocket) //admin
+
+	// Imports take as long as the upload does, every row has its own timeout.
+	importAPI := router.Group("/v1/users/import")
+	importAPI.Use(auth)
+	importAPI.Use(middleware.RateLimit(option.Cfg.RateLimitRPS, option.Cfg.RateLimitBurst))
+
+	importAPI.POST("", handlerV1.ImportUsers) //admin
+
+	// Exports stream for as long as they need, every page has its own timeout.
+	adminAPI := router.Group("/v1/admin")
+	adminAPI.Use(auth)
+	adminAPI.Use(middleware.RateLimit(option.Cfg.RateLimitRPS, option.Cfg.RateLimitBurst))
+
+	adminAPI.GET("/users/export", handlerV1.ExportUsers)           //admin
+	adminAPI.GET("/mail/dead", handlerV1.ListDeadMail)             //admin
+	adminAPI.POST("/mail/dead/:id/retry", handlerV1.RetryDeadMail) //admin
+
+	// Plain HTTP upstreams. Their paths are authorized by casbin like any other
+	// route, so every prefix needs its own policies.
+	proxyRoutes, err := proxy.LoadRoutes(option.Cfg.ProxyRoutesFile)
+	if err != nil {
+		option.Logger.Fatal("error while loading proxy routes\n", logger.Error(err))
+	}
+	for _, route := range proxyRoutes {
+		proxyHandler, err := proxy.New(route, &proxy.HandlerProxyConfig{
+			Log: option.Logger,
+			Cfg: option.Cfg,
+		})
+		if err != nil {
+			option.Logger.Fatal("error while creating a proxy route\n", logger.String("prefix", route.Prefix), logger.Error(err))
+		}
+
+		rps, burst := option.Cfg.RateLimitRPS, option.Cfg.RateLimitBurst
+		if route.RateLimit > 0 {
+			rps, burst = route.RateLimit, route.RateBurst
+		}
+
+		proxyAPI := router.Group(route.Prefix)
+		proxyAPI.Use(auth)
+		proxyAPI.Use(middleware.RateLimit(rps, burst))
+
+		proxyAPI.Any("", proxyHandler.Handle)
+		proxyAPI.Any("/*path", proxyHandler.Handle)
+	}
+
 	url := ginSwagger.URL("swagger/doc.json")
 	api.GET("swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, url))
 	return router
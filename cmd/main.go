@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	rds "github.com/gomodule/redigo/redis"
 	"myproject/api-gateway/api"
 	"myproject/api-gateway/config"
-	"myproject/api-gateway/pkg/etc"
+	"myproject/api-gateway/email"
+	"myproject/api-gateway/pkg/blob"
+	"myproject/api-gateway/pkg/events"
 	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/outbox"
+	"myproject/api-gateway/pkg/privacy"
 	"myproject/api-gateway/services"
 	"myproject/api-gateway/storage/redis"
 )
@@ -15,10 +20,14 @@ func main() {
 	cfg := config.Load()
 	log := logger.New(cfg.LogLevel, "api-gateway")
 
+	if err := cfg.Validate(); err != nil {
+		log.Fatal("invalid config", logger.Error(err))
+	}
+
 	serviceManager, err := services.NewServiceManager(cfg)
 
 	if err != nil {
-		log.Error("gRPC dial error", logger.Error(err))
+		log.Fatal("gRPC dial error", logger.Error(err))
 	}
 
 	redisPool := rds.Pool{
@@ -33,15 +42,41 @@ func main() {
 		},
 	}
 
+	inMemory := redis.NewRedisRepo(&redisPool)
+	serviceManager = services.WithUserCache(serviceManager, inMemory, cfg)
+
 	//db, _, err := db2.ConnectToDB(cfg)
 	//if err != nil {
 	//	log.Fatal("cannot connect to DB", logger.Error(err))
 	//	panic(err)
 	//}
-	fmt.Println(etc.GenerateHashPassword("string500"))
+
+	eventBroker := events.NewBroker(inMemory, log)
+	go eventBroker.Run(context.Background())
+
+	blobs, err := blob.NewLocal(cfg.BlobDir)
+	if err != nil {
+		log.Fatal("cannot open blob store", logger.Error(err))
+	}
+
+	transport, err := email.New(cfg)
+	if err != nil {
+		log.Fatal("cannot set up mail transport", logger.Error(err))
+	}
+
+	mailOutbox := outbox.New(inMemory, transport, cfg, log)
+	go mailOutbox.Run(context.Background())
+
+	erasures := privacy.NewErasures(inMemory, blobs, mailOutbox, serviceManager, eventBroker, cfg, log)
+	go erasures.Run(context.Background())
 
 	server := api.New(api.Option{
-		InMemory:       redis.NewRedisRepo(&redisPool),
+		InMemory:       inMemory,
+		Events:         eventBroker,
+		Erasures:       erasures,
+		Blobs:          blobs,
+		Mailer:         mailOutbox,
+		Outbox:         mailOutbox,
 		Cfg:            cfg,
 		Logger:         log,
 		ServiceManager: serviceManager,
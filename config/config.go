@@ -1,10 +1,41 @@
 package config
 
 import (
+	"fmt"
 	"github.com/spf13/cast"
 	"os"
+	"sort"
+	"strings"
 )
 
+// TLSConfig describes how the gateway connects to one backend. CertFile and
+// KeyFile enable mTLS, CAFile replaces the system roots.
+type TLSConfig struct {
+	Enabled  bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// ServerName is what the backend certificate must be valid for, the
+	// dialled host by default. An IP address is checked against IP SANs.
+	ServerName string
+}
+
+// secretDefaults are the development values of the keys that sign links and
+// tokens or seal what is kept in redis. They are in the source, so Validate
+// refuses to run production with any of them.
+var secretDefaults = map[string]string{
+	"SIGN_IN_KEY":              "abc",
+	"INTERNAL_SIGN_IN_KEY":     "internal-abc",
+	"CURSOR_SIGN_IN_KEY":       "cursor-abc",
+	"DATA_EXPORT_SIGN_IN_KEY":  "data-export-abc",
+	"AVATAR_SIGN_IN_KEY":       "avatar-abc",
+	"EMAIL_REVERT_SIGN_IN_KEY": "email-revert-abc",
+	"VERIFY_CODE_HASH_KEY":     "verify-code-abc",
+	"IMPORT_FINGERPRINT_KEY":   "import-abc",
+	"IDEMPOTENCY_SEAL_KEY":     "idempotency-abc",
+	"OUTBOX_SEAL_KEY":          "outbox-abc",
+}
+
 type Config struct {
 	Environment string
 
@@ -17,22 +48,108 @@ type Config struct {
 	RedisHost string
 	RedisPort int
 
+	UserCacheTTL         int
+	UserCacheNegativeTTL int
+
+	ListUsersMaxLimit int
+	ListUsersMaxScan  int
+	CursorSignInKey   string
+
+	ImportMaxRows     int
+	ImportConcurrency int
+	ImportProgressTTL int
+	// ImportFingerprintKey keys the row fingerprints kept in redis, which
+	// cover the plaintext password.
+	ImportFingerprintKey string
+
+	ExportPageSize int
+
+	DataExportTTL        int
+	DataExportSignInKey  string
+	ErasureCoolingOff    int
+	ErasureCheckInterval int
+
+	BlobDir         string
+	AvatarMaxBytes  int
+	AvatarMaxPixels int
+	AvatarSignInKey string
+
+	BatchGetMaxIDs      int
+	BatchGetConcurrency int
+
+	GraphQLMaxDepth      int
+	GraphQLMaxComplexity int
+
 	UserServiceHost string
 	UserServicePort int
+	UserServiceTLS  TLSConfig
+
+	UserServiceRoutingFile string
+
+	CtxTimeout        int
+	MaxRequestTimeout int
+	RouteTimeouts     map[string]int
+
+	IdempotencyTTL     int
+	IdempotencyMaxBody int64
+	// IdempotencySealKey encrypts stored responses, which may hold tokens.
+	IdempotencySealKey string
 
-	CtxTimeout int
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// TrustedProxies may set X-Forwarded-For. Without any, the client IP is
+	// the address of the connection.
+	TrustedProxies []string
 
-	LogLevel string
-	HTTPPort string
+	ProxyRoutesFile string
+
+	LogLevel  string
+	HTTPPort  string
+	PublicURL string
 
 	SignInKey           string
 	AccessTokenTimeOut  int
 	RefreshTokenTimeOut int
 
+	InternalSignInKey        string
+	IdentityAssertionTimeOut int
+
 	AuthConfigPath string
 
 	SendEmailFrom string
-	EmailCode     string
+
+	// MailTransport is smtp, maildir or memory. smtp needs SMTPHost,
+	// SMTPUsername and SMTPPassword to be set.
+	MailTransport string
+	MailDir       string
+	SMTPHost      string
+	SMTPPort      int
+	SMTPSecurity  string
+	SMTPUsername  string
+	SMTPPassword  string
+
+	// Emails go through a redis stream outbox. A failed send is tried again
+	// after OutboxBackoff seconds, doubling up to OutboxMaxBackoff, and is a
+	// dead letter after OutboxMaxAttempts.
+	OutboxWorkers     int
+	OutboxMaxAttempts int
+	OutboxBackoff     int
+	OutboxMaxBackoff  int
+	OutboxClaimIdle   int
+	OutboxDeadMaxLen  int
+	// OutboxSealKey encrypts email bodies while they wait in redis, since
+	// they may hold codes and links.
+	OutboxSealKey string
+
+	VerifyCodeTTL        int
+	VerifyMaxAttempts    int
+	VerifyResendCooldown int
+	VerifyDailySendCap   int
+	VerifyCodeHashKey    string
+
+	EmailChangeTTL       int
+	EmailRevertTTL       int
+	EmailRevertSignInKey string
 }
 
 func Load() Config {
@@ -49,25 +166,136 @@ func Load() Config {
 	c.RedisHost = cast.ToString(getOrReturnDefault("REDIS_HOST", "localhost"))
 	c.RedisPort = cast.ToInt(getOrReturnDefault("REDIS_PORT", 6379))
 
+	c.UserCacheTTL = cast.ToInt(getOrReturnDefault("USER_CACHE_TTL", 60))
+	c.UserCacheNegativeTTL = cast.ToInt(getOrReturnDefault("USER_CACHE_NEGATIVE_TTL", 10))
+
+	c.ListUsersMaxLimit = cast.ToInt(getOrReturnDefault("LIST_USERS_MAX_LIMIT", 100))
+	c.ListUsersMaxScan = cast.ToInt(getOrReturnDefault("LIST_USERS_MAX_SCAN", 1000))
+	c.CursorSignInKey = getSecret("CURSOR_SIGN_IN_KEY")
+
+	c.ImportMaxRows = cast.ToInt(getOrReturnDefault("IMPORT_MAX_ROWS", 5000))
+	c.ImportConcurrency = cast.ToInt(getOrReturnDefault("IMPORT_CONCURRENCY", 5))
+	c.ImportProgressTTL = cast.ToInt(getOrReturnDefault("IMPORT_PROGRESS_TTL", 604800))
+	c.ImportFingerprintKey = getSecret("IMPORT_FINGERPRINT_KEY")
+
+	c.ExportPageSize = cast.ToInt(getOrReturnDefault("EXPORT_PAGE_SIZE", 500))
+
+	c.DataExportTTL = cast.ToInt(getOrReturnDefault("DATA_EXPORT_TTL", 86400))
+	c.DataExportSignInKey = getSecret("DATA_EXPORT_SIGN_IN_KEY")
+	c.ErasureCoolingOff = cast.ToInt(getOrReturnDefault("ERASURE_COOLING_OFF", 604800))
+	c.ErasureCheckInterval = cast.ToInt(getOrReturnDefault("ERASURE_CHECK_INTERVAL", 60))
+
+	c.BlobDir = cast.ToString(getOrReturnDefault("BLOB_DIR", "./data/blobs"))
+	c.AvatarMaxBytes = cast.ToInt(getOrReturnDefault("AVATAR_MAX_BYTES", 5<<20))
+	c.AvatarMaxPixels = cast.ToInt(getOrReturnDefault("AVATAR_MAX_PIXELS", 40000000))
+	c.AvatarSignInKey = getSecret("AVATAR_SIGN_IN_KEY")
+
+	c.BatchGetMaxIDs = cast.ToInt(getOrReturnDefault("BATCH_GET_MAX_IDS", 100))
+	c.BatchGetConcurrency = cast.ToInt(getOrReturnDefault("BATCH_GET_CONCURRENCY", 10))
+
+	c.GraphQLMaxDepth = cast.ToInt(getOrReturnDefault("GRAPHQL_MAX_DEPTH", 5))
+	c.GraphQLMaxComplexity = cast.ToInt(getOrReturnDefault("GRAPHQL_MAX_COMPLEXITY", 500))
+
 	c.UserServiceHost = cast.ToString(getOrReturnDefault("USER_SERVICE_HOST", "localhost"))
 	c.UserServicePort = cast.ToInt(getOrReturnDefault("USER_SERVICE_PORT", 8080))
+	c.UserServiceTLS = loadTLSConfig("USER_SERVICE")
+	c.UserServiceRoutingFile = cast.ToString(getOrReturnDefault("USER_SERVICE_ROUTING_FILE", "./config/user_service_routing.json"))
 
 	c.CtxTimeout = cast.ToInt(getOrReturnDefault("CTX_TIMEOUT", 7))
+	c.MaxRequestTimeout = cast.ToInt(getOrReturnDefault("MAX_REQUEST_TIMEOUT", 30))
+	c.RouteTimeouts = parseRouteTimeouts(cast.ToString(getOrReturnDefault("ROUTE_TIMEOUTS", "")))
+
+	c.IdempotencyTTL = cast.ToInt(getOrReturnDefault("IDEMPOTENCY_TTL", 86400))
+	c.IdempotencyMaxBody = cast.ToInt64(getOrReturnDefault("IDEMPOTENCY_MAX_BODY", 1<<20))
+	c.IdempotencySealKey = getSecret("IDEMPOTENCY_SEAL_KEY")
+
+	c.RateLimitRPS = cast.ToFloat64(getOrReturnDefault("RATE_LIMIT_RPS", 0))
+	c.RateLimitBurst = cast.ToInt(getOrReturnDefault("RATE_LIMIT_BURST", 20))
+	c.TrustedProxies = parseList(cast.ToString(getOrReturnDefault("TRUSTED_PROXIES", "")))
+
+	c.ProxyRoutesFile = cast.ToString(getOrReturnDefault("PROXY_ROUTES_FILE", "./config/proxy_routes.json"))
 
 	c.LogLevel = cast.ToString(getOrReturnDefault("LOG_LEVEL", "debug"))
 	c.HTTPPort = cast.ToString(getOrReturnDefault("HTTP_PORT", ":9090"))
+	c.PublicURL = cast.ToString(getOrReturnDefault("PUBLIC_URL", "http://localhost:9090"))
 
-	c.SignInKey = cast.ToString(getOrReturnDefault("SIGN_IN_KEY", "abc"))
+	c.SignInKey = getSecret("SIGN_IN_KEY")
 	c.AccessTokenTimeOut = cast.ToInt(getOrReturnDefault("ACCESS_TOKEN_TIMEOUT", 2000))
 	c.RefreshTokenTimeOut = cast.ToInt(getOrReturnDefault("REFRESH_TOKEN_TIMEOUT", 3000))
 
+	c.InternalSignInKey = getSecret("INTERNAL_SIGN_IN_KEY")
+	c.IdentityAssertionTimeOut = cast.ToInt(getOrReturnDefault("IDENTITY_ASSERTION_TIMEOUT", 60))
+
 	c.AuthConfigPath = cast.ToString(getOrReturnDefault("AUTH_CONFIG_PATH", "./config/auth.conf"))
 
-	c.SendEmailFrom = cast.ToString(getOrReturnDefault("EMAIL_FROM", "mubinayigitaliyeva00@gmail.com"))
-	c.EmailCode = cast.ToString(getOrReturnDefault("EMAIL_CODE", "iocd vnhb lnvx digm"))
+	c.SendEmailFrom = cast.ToString(getOrReturnDefault("EMAIL_FROM", "no-reply@localhost"))
+
+	c.MailTransport = cast.ToString(getOrReturnDefault("MAIL_TRANSPORT", "maildir"))
+	c.MailDir = cast.ToString(getOrReturnDefault("MAIL_DIR", "./data/mail"))
+	c.SMTPHost = cast.ToString(getOrReturnDefault("SMTP_HOST", ""))
+	c.SMTPPort = cast.ToInt(getOrReturnDefault("SMTP_PORT", 587))
+	c.SMTPSecurity = cast.ToString(getOrReturnDefault("SMTP_SECURITY", "starttls"))
+	c.SMTPUsername = cast.ToString(getOrReturnDefault("SMTP_USERNAME", ""))
+	c.SMTPPassword = cast.ToString(getOrReturnDefault("SMTP_PASSWORD", ""))
+
+	c.OutboxWorkers = cast.ToInt(getOrReturnDefault("OUTBOX_WORKERS", 4))
+	c.OutboxMaxAttempts = cast.ToInt(getOrReturnDefault("OUTBOX_MAX_ATTEMPTS", 8))
+	c.OutboxBackoff = cast.ToInt(getOrReturnDefault("OUTBOX_BACKOFF", 10))
+	c.OutboxMaxBackoff = cast.ToInt(getOrReturnDefault("OUTBOX_MAX_BACKOFF", 3600))
+	c.OutboxClaimIdle = cast.ToInt(getOrReturnDefault("OUTBOX_CLAIM_IDLE", 300))
+	c.OutboxDeadMaxLen = cast.ToInt(getOrReturnDefault("OUTBOX_DEAD_MAX_LEN", 10000))
+	c.OutboxSealKey = getSecret("OUTBOX_SEAL_KEY")
+
+	c.VerifyCodeTTL = cast.ToInt(getOrReturnDefault("VERIFY_CODE_TTL", 300))
+	c.VerifyMaxAttempts = cast.ToInt(getOrReturnDefault("VERIFY_MAX_ATTEMPTS", 5))
+	c.VerifyResendCooldown = cast.ToInt(getOrReturnDefault("VERIFY_RESEND_COOLDOWN", 60))
+	c.VerifyDailySendCap = cast.ToInt(getOrReturnDefault("VERIFY_DAILY_SEND_CAP", 5))
+	c.VerifyCodeHashKey = getSecret("VERIFY_CODE_HASH_KEY")
+
+	c.EmailChangeTTL = cast.ToInt(getOrReturnDefault("EMAIL_CHANGE_TTL", 900))
+	c.EmailRevertTTL = cast.ToInt(getOrReturnDefault("EMAIL_REVERT_TTL", 604800))
+	c.EmailRevertSignInKey = getSecret("EMAIL_REVERT_SIGN_IN_KEY")
 	return c
 }
 
+// Validate reports settings the gateway must not run with. In production
+// every secret key has to be set to something other than its default.
+func (c Config) Validate() error {
+	if c.Environment != "production" {
+		return nil
+	}
+
+	secrets := map[string]string{
+		"SIGN_IN_KEY":              c.SignInKey,
+		"INTERNAL_SIGN_IN_KEY":     c.InternalSignInKey,
+		"CURSOR_SIGN_IN_KEY":       c.CursorSignInKey,
+		"DATA_EXPORT_SIGN_IN_KEY":  c.DataExportSignInKey,
+		"AVATAR_SIGN_IN_KEY":       c.AvatarSignInKey,
+		"EMAIL_REVERT_SIGN_IN_KEY": c.EmailRevertSignInKey,
+		"VERIFY_CODE_HASH_KEY":     c.VerifyCodeHashKey,
+		"IMPORT_FINGERPRINT_KEY":   c.ImportFingerprintKey,
+		"IDEMPOTENCY_SEAL_KEY":     c.IdempotencySealKey,
+		"OUTBOX_SEAL_KEY":          c.OutboxSealKey,
+	}
+
+	var weak []string
+	for key, value := range secrets {
+		if value == "" || value == secretDefaults[key] {
+			weak = append(weak, key)
+		}
+	}
+	if len(weak) > 0 {
+		sort.Strings(weak)
+		return fmt.Errorf("secret keys are unset or left at their defaults, which is not allowed in production: %s", strings.Join(weak, ", "))
+	}
+
+	return nil
+}
+
+func getSecret(key string) string {
+	return cast.ToString(getOrReturnDefault(key, secretDefaults[key]))
+}
+
 func getOrReturnDefault(key string, defaultValue interface{}) interface{} {
 	_, exists := os.LookupEnv(key)
 	if exists {
@@ -76,3 +304,42 @@ func getOrReturnDefault(key string, defaultValue interface{}) interface{} {
 
 	return defaultValue
 }
+
+func loadTLSConfig(prefix string) TLSConfig {
+	return TLSConfig{
+		Enabled:    cast.ToBool(getOrReturnDefault(prefix+"_TLS_ENABLED", false)),
+		CAFile:     cast.ToString(getOrReturnDefault(prefix+"_TLS_CA_FILE", "")),
+		CertFile:   cast.ToString(getOrReturnDefault(prefix+"_TLS_CERT_FILE", "")),
+		KeyFile:    cast.ToString(getOrReturnDefault(prefix+"_TLS_KEY_FILE", "")),
+		ServerName: cast.ToString(getOrReturnDefault(prefix+"_TLS_SERVER_NAME", "")),
+	}
+}
+
+// parseRouteTimeouts reads per-route timeouts in seconds, written as
+// "/v1/register=10,/v1/user/:id=3". Keys are gin route patterns.
+func parseRouteTimeouts(value string) map[string]int {
+	timeouts := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		route, seconds, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || route == "" {
+			continue
+		}
+		if t := cast.ToInt(strings.TrimSpace(seconds)); t > 0 {
+			timeouts[strings.TrimSpace(route)] = t
+		}
+	}
+
+	return timeouts
+}
+
+// parseList reads a comma separated list, such as "10.0.0.0/8,127.0.0.1".
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
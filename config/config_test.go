@@ -0,0 +1,93 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	// strong sets every secret key to a value of its own.
+	strong := func(environment string) Config {
+		return Config{
+			Environment:          environment,
+			SignInKey:            "s1",
+			InternalSignInKey:    "s2",
+			CursorSignInKey:      "s3",
+			DataExportSignInKey:  "s4",
+			AvatarSignInKey:      "s5",
+			EmailRevertSignInKey: "s6",
+			VerifyCodeHashKey:    "s7",
+			ImportFingerprintKey: "s8",
+			IdempotencySealKey:   "s9",
+			OutboxSealKey:        "s10",
+		}
+	}
+
+	tests := []struct {
+		name     string
+		cfg      func() Config
+		wantKeys []string
+	}{
+		{
+			name: "develop with defaults",
+			cfg: func() Config {
+				c := strong("develop")
+				c.SignInKey = secretDefaults["SIGN_IN_KEY"]
+				return c
+			},
+		},
+		{
+			name: "production with every key set",
+			cfg:  func() Config { return strong("production") },
+		},
+		{
+			name: "production with a default key",
+			cfg: func() Config {
+				c := strong("production")
+				c.IdempotencySealKey = secretDefaults["IDEMPOTENCY_SEAL_KEY"]
+				return c
+			},
+			wantKeys: []string{"IDEMPOTENCY_SEAL_KEY"},
+		},
+		{
+			name: "production with an empty key",
+			cfg: func() Config {
+				c := strong("production")
+				c.ImportFingerprintKey = ""
+				c.SignInKey = secretDefaults["SIGN_IN_KEY"]
+				return c
+			},
+			wantKeys: []string{"IMPORT_FINGERPRINT_KEY", "SIGN_IN_KEY"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg().Validate()
+			if (err != nil) != (len(tt.wantKeys) > 0) {
+				t.Fatalf("Validate() error = %v, want keys %v", err, tt.wantKeys)
+			}
+			if err == nil {
+				return
+			}
+			if !strings.HasSuffix(err.Error(), strings.Join(tt.wantKeys, ", ")) {
+				t.Errorf("Validate() error = %q, want it to name %v only", err, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestLoadDefaultsFailProduction(t *testing.T) {
+	for key := range secretDefaults {
+		// Setenv restores the variable after the test, Unsetenv leaves the
+		// default to Load.
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	t.Setenv("ENVIRONMENT", "production")
+
+	if err := Load().Validate(); err == nil {
+		t.Error("production config with default secret keys is valid")
+	}
+}
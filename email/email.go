@@ -1,58 +1,103 @@
 package email
 
 import (
+	"context"
+	"embed"
+	"fmt"
 	"html/template"
 	"log"
-	"net/smtp"
-	"os"
+	"myproject/api-gateway/config"
 	"strings"
+	"time"
 )
 
+//go:embed format.html notice.html
+var templateFiles embed.FS
+
+// templates are parsed once, from files built into the binary, so sending
+// does not depend on the working directory.
+var templates = template.Must(template.ParseFS(templateFiles, "*.html"))
+
 type EmailPayload struct {
-	From     string
-	To       string
-	Password string
-	Code     string
-	Message  string
+	To      string
+	Code    string
+	Message string
+	// ExpiresAt is when Code stops working, zero when there is no code.
+	ExpiresAt time.Time
 }
 
-func SendVerificationCode(params EmailPayload) (string, error) {
-	htmlFile, err := os.ReadFile("./email/format.html")
-	if err != nil {
-		log.Println("Cannot read from file", htmlFile)
-		return "", err
+// Message is a rendered email. The sender address belongs to the Mailer.
+type Message struct {
+	To      string
+	Subject string
+	HTML    string
+	// ExpiresAt is when the email is useless, because its code expired. It
+	// is not sent after that. Zero means never.
+	ExpiresAt time.Time
+}
+
+// Mailer delivers rendered emails.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns the Mailer named by cfg.MailTransport. SMTP credentials have no
+// defaults, so smtp without them is an error rather than a guess.
+func New(cfg config.Config) (Mailer, error) {
+	switch cfg.MailTransport {
+	case "smtp":
+		if cfg.SMTPUsername == "" || cfg.SMTPPassword == "" {
+			return nil, fmt.Errorf("smtp transport needs SMTP_USERNAME and SMTP_PASSWORD")
+		}
+		return NewSMTP(SMTPConfig{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Security: cfg.SMTPSecurity,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SendEmailFrom,
+		})
+	case "maildir":
+		return NewMaildir(cfg.MailDir, cfg.SendEmailFrom)
+	case "memory":
+		return NewRecorder(), nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", cfg.MailTransport)
 	}
+}
 
-	temp, err := template.New("email").Parse(string(htmlFile))
+func SendVerificationCode(ctx context.Context, mailer Mailer, params EmailPayload) (string, error) {
+	err := send(ctx, mailer, params, "format.html", "Super-clinic app")
 	if err != nil {
-		log.Println("Cannot parse file", err)
+		log.Println("cannot send an email verification", err)
 		return "", err
 	}
 
-	var builder strings.Builder
-	err = temp.Execute(&builder, params)
+	return "a verification code was sent to your email, please check it", nil
+}
+
+// SendNotice sends params.Message as an email with the given subject.
+func SendNotice(ctx context.Context, mailer Mailer, params EmailPayload, subject string) error {
+	err := send(ctx, mailer, params, "notice.html", subject)
 	if err != nil {
-		log.Println("Cannot execute file", err)
-		return "", err
+		log.Println("cannot send a notice", err)
 	}
 
-	message := "From: " + params.From + "\n" +
-		"To: " + params.To + "\n" +
-		"Subject: Super-clinic app\n" +
-		"MIME-Version: 1.0\n" +
-		"Content-type: text/html; charset=\"UTF-8\"\n" +
-		"\n" +
-		builder.String()
-
-	err = smtp.SendMail("smtp.gmail.com:587",
-		smtp.PlainAuth("smtp", params.From, params.Password, "smtp.gmail.com"),
-		params.From, []string{params.To}, []byte(message),
-	)
+	return err
+}
 
+func send(ctx context.Context, mailer Mailer, params EmailPayload, templateName, subject string) error {
+	var builder strings.Builder
+	err := templates.ExecuteTemplate(&builder, templateName, params)
 	if err != nil {
-		log.Println("cannot send an email verification", err)
-		return "", err
+		log.Println("Cannot execute file", err)
+		return err
 	}
 
-	return "a verification code was sent to your email, please check it", nil
+	return mailer.Send(ctx, Message{
+		To:        params.To,
+		Subject:   subject,
+		HTML:      builder.String(),
+		ExpiresAt: params.ExpiresAt,
+	})
 }
@@ -0,0 +1,154 @@
+package email
+
+import (
+	"context"
+	"myproject/api-gateway/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+	}{
+		{
+			name: "memory",
+			cfg:  config.Config{MailTransport: "memory"},
+		},
+		{
+			name: "maildir",
+			cfg:  config.Config{MailTransport: "maildir", MailDir: t.TempDir(), SendEmailFrom: "no-reply@localhost"},
+		},
+		{
+			name: "smtp with credentials",
+			cfg: config.Config{
+				MailTransport: "smtp",
+				SMTPHost:      "mail.example.com",
+				SMTPPort:      587,
+				SMTPSecurity:  SecurityStartTLS,
+				SMTPUsername:  "mailer",
+				SMTPPassword:  "secret",
+			},
+		},
+		{
+			name: "smtp without credentials",
+			cfg: config.Config{
+				MailTransport: "smtp",
+				SMTPHost:      "mail.example.com",
+				SMTPPort:      587,
+				SMTPSecurity:  SecurityStartTLS,
+			},
+			wantErr: true,
+		},
+		{
+			name: "smtp without password",
+			cfg: config.Config{
+				MailTransport: "smtp",
+				SMTPHost:      "mail.example.com",
+				SMTPPort:      587,
+				SMTPSecurity:  SecurityStartTLS,
+				SMTPUsername:  "mailer",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown",
+			cfg:     config.Config{MailTransport: "pigeon"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSendRecordsRenderedMessage(t *testing.T) {
+	expiresAt := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name        string
+		send        func(Mailer) error
+		wantTo      string
+		wantSubject string
+		wantHTML    string
+		wantExpiry  time.Time
+	}{
+		{
+			name: "verification code",
+			send: func(m Mailer) error {
+				_, err := SendVerificationCode(context.Background(), m, EmailPayload{
+					To:        "ann@example.com",
+					Code:      "48151",
+					ExpiresAt: expiresAt,
+				})
+				return err
+			},
+			wantTo:      "ann@example.com",
+			wantSubject: "Super-clinic app",
+			wantHTML:    "48151",
+			wantExpiry:  expiresAt,
+		},
+		{
+			name: "notice",
+			send: func(m Mailer) error {
+				return SendNotice(context.Background(), m, EmailPayload{
+					To:      "bob@example.com",
+					Message: "Your email was changed",
+				}, "Heads up")
+			},
+			wantTo:      "bob@example.com",
+			wantSubject: "Heads up",
+			wantHTML:    "Your email was changed",
+		},
+		{
+			name: "notice is escaped",
+			send: func(m Mailer) error {
+				return SendNotice(context.Background(), m, EmailPayload{
+					To:      "eve@example.com",
+					Message: "<script>alert(1)</script>",
+				}, "Heads up")
+			},
+			wantTo:      "eve@example.com",
+			wantSubject: "Heads up",
+			wantHTML:    "&lt;script&gt;",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := NewRecorder()
+			if err := tt.send(recorder); err != nil {
+				t.Fatal(err)
+			}
+
+			messages := recorder.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("recorded %d messages, want 1", len(messages))
+			}
+			msg := messages[0]
+			if msg.To != tt.wantTo || msg.Subject != tt.wantSubject {
+				t.Errorf("message to %q about %q, want %q about %q", msg.To, msg.Subject, tt.wantTo, tt.wantSubject)
+			}
+			if !strings.Contains(msg.HTML, tt.wantHTML) {
+				t.Errorf("html does not contain %q", tt.wantHTML)
+			}
+			if !msg.ExpiresAt.Equal(tt.wantExpiry) {
+				t.Errorf("expires at %v, want %v", msg.ExpiresAt, tt.wantExpiry)
+			}
+
+			recorder.Reset()
+			if len(recorder.Messages()) != 0 {
+				t.Error("Reset kept messages")
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maildirMailer delivers into a maildir instead of sending, for development.
+// Any mail client that reads maildirs shows the messages.
+type maildirMailer struct {
+	dir  string
+	from string
+}
+
+func NewMaildir(dir, from string) (Mailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &maildirMailer{dir: dir, from: from}, nil
+}
+
+// Send writes into tmp and then moves to new, so readers never see a
+// partly written message.
+func (m *maildirMailer) Send(ctx context.Context, msg Message) error {
+	data, err := msg.bytes(m.from)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%s.%s", time.Now().Unix(), uuid.New().String(), hostname)
+
+	tmp := filepath.Join(m.dir, "tmp", name)
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(m.dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1 @@
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'admin', '/v1/metrics', 'GET');
@@ -0,0 +1,7 @@
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'user', '/v1/graphql', 'POST');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'user', '/v1/graphql/updateUser', 'MUTATION');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'user', '/v1/graphql/deleteUser', 'MUTATION');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'admin', '/v1/graphql/user', 'QUERY');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'admin', '/v1/graphql/users', 'QUERY');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'admin', '/v1/graphql/listUsers', 'QUERY');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'admin', '/v1/graphql/createUser', 'MUTATION');
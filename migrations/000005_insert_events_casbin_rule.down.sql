@@ -0,0 +1 @@
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v1 LIKE '/v1/events/%';
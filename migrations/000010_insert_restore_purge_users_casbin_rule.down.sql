@@ -0,0 +1,2 @@
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'admin' AND v1 = '/v1/users/{id}/restore' AND v2 = 'POST';
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'admin' AND v1 = '/v1/users/{id}/purge' AND v2 = 'DELETE';
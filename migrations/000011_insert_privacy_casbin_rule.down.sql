@@ -0,0 +1,7 @@
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'user' AND v1 = '/v1/me/data-export' AND v2 = 'POST';
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'unauthorized' AND v1 = '/v1/data-exports/{token}' AND v2 = 'GET';
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'user' AND v1 = '/v1/data-exports/{token}' AND v2 = 'GET';
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'user' AND v1 = '/v1/me/erasure' AND v2 = 'POST';
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'user' AND v1 = '/v1/me/erasure' AND v2 = 'DELETE';
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'admin' AND v1 = '/v1/users/{id}/erasure' AND v2 = 'POST';
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'admin' AND v1 = '/v1/users/{id}/erasure' AND v2 = 'DELETE';
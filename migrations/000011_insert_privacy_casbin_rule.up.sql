@@ -0,0 +1,7 @@
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'user', '/v1/me/data-export', 'POST');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'unauthorized', '/v1/data-exports/{token}', 'GET');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'user', '/v1/data-exports/{token}', 'GET');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'user', '/v1/me/erasure', 'POST');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'user', '/v1/me/erasure', 'DELETE');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'admin', '/v1/users/{id}/erasure', 'POST');
+INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'admin', '/v1/users/{id}/erasure', 'DELETE');
@@ -0,0 +1 @@
+UPDATE casbin_rule SET v2 = 'POST' WHERE ptype = 'p' AND v0 = 'unauthorized' AND v1 = '/v1/verify' AND v2 = 'GET';
@@ -0,0 +1,2 @@
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'admin' AND v1 = '/v1/admin/mail/dead' AND v2 = 'GET';
+DELETE FROM casbin_rule WHERE ptype = 'p' AND v0 = 'admin' AND v1 = '/v1/admin/mail/dead/{id}/retry' AND v2 = 'POST';
@@ -0,0 +1,136 @@
+// Package avatar turns uploaded pictures into the avatar images that are
+// stored and served.
+package avatar
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+var (
+	ErrUnsupported = errors.New("avatar should be a PNG, JPEG or WebP image")
+	ErrTooLarge    = errors.New("avatar has too many pixels")
+)
+
+// Size is one stored variant of an avatar. Square variants are cropped to
+// the center, the others keep the aspect ratio.
+type Size struct {
+	Name   string
+	Pixels int
+	Square bool
+}
+
+var Sizes = []Size{
+	{Name: "large", Pixels: 1024},
+	{Name: "medium", Pixels: 256, Square: true},
+	{Name: "small", Pixels: 64, Square: true},
+}
+
+// Result holds every size, encoded as Ext. Re-encoding keeps only the
+// pixels, so EXIF and other metadata of the upload are gone.
+type Result struct {
+	Ext         string
+	ContentType string
+	Images      map[string][]byte
+}
+
+// Process checks data by its content, not by the name or type it was sent
+// with, and renders every size. maxPixels is checked before decoding, so a
+// small file can not claim a huge canvas.
+func Process(data []byte, maxPixels int) (Result, error) {
+	var (
+		decode func([]byte) (image.Image, error)
+		config func([]byte) (image.Config, error)
+		result Result
+	)
+
+	switch http.DetectContentType(data) {
+	case "image/png":
+		decode = func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) }
+		config = func(b []byte) (image.Config, error) { return png.DecodeConfig(bytes.NewReader(b)) }
+		result.Ext, result.ContentType = "png", "image/png"
+	case "image/jpeg":
+		decode = func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) }
+		config = func(b []byte) (image.Config, error) { return jpeg.DecodeConfig(bytes.NewReader(b)) }
+		result.Ext, result.ContentType = "jpg", "image/jpeg"
+	case "image/webp":
+		// There is no WebP encoder in the standard library or x/image, so
+		// WebP is stored as PNG, which keeps its transparency.
+		decode = func(b []byte) (image.Image, error) { return webp.Decode(bytes.NewReader(b)) }
+		config = func(b []byte) (image.Config, error) { return webp.DecodeConfig(bytes.NewReader(b)) }
+		result.Ext, result.ContentType = "png", "image/png"
+	default:
+		return Result{}, ErrUnsupported
+	}
+
+	cfg, err := config(data)
+	if err != nil {
+		return Result{}, ErrUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return Result{}, ErrUnsupported
+	}
+	if maxPixels > 0 && cfg.Width*cfg.Height > maxPixels {
+		return Result{}, ErrTooLarge
+	}
+
+	img, err := decode(data)
+	if err != nil {
+		return Result{}, ErrUnsupported
+	}
+	if result.ContentType == "image/jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+
+	result.Images = make(map[string][]byte, len(Sizes))
+	for _, size := range Sizes {
+		var buf bytes.Buffer
+		resized := resize(img, size)
+		if result.ContentType == "image/jpeg" {
+			err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 90})
+		} else {
+			err = png.Encode(&buf, resized)
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		result.Images[size.Name] = buf.Bytes()
+	}
+
+	return result, nil
+}
+
+func resize(img image.Image, size Size) image.Image {
+	src := img.Bounds()
+
+	if size.Square {
+		side := src.Dx()
+		if src.Dy() < side {
+			side = src.Dy()
+		}
+		x := src.Min.X + (src.Dx()-side)/2
+		y := src.Min.Y + (src.Dy()-side)/2
+		src = image.Rect(x, y, x+side, y+side)
+	}
+
+	w, h := src.Dx(), src.Dy()
+	if w > size.Pixels || h > size.Pixels {
+		if w >= h {
+			w, h = size.Pixels, max(1, h*size.Pixels/w)
+		} else {
+			w, h = max(1, w*size.Pixels/h), size.Pixels
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+
+	return dst
+}
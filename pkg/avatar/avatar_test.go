@@ -0,0 +1,211 @@
+package avatar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withExif inserts an APP1 segment with orientation right after the start of
+// image marker of a JPEG.
+func withExif(data []byte, order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(payload)))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            []byte
+		maxPixels       int
+		wantErr         error
+		wantContentType string
+		// wantSizes are the width and height of each size.
+		wantSizes map[string][2]int
+	}{
+		{
+			name:            "png is not enlarged",
+			data:            encodePNG(t, 300, 200),
+			wantContentType: "image/png",
+			wantSizes: map[string][2]int{
+				"large":  {300, 200},
+				"medium": {200, 200},
+				"small":  {64, 64},
+			},
+		},
+		{
+			name:            "jpeg is scaled down",
+			data:            encodeJPEG(t, 2048, 1024),
+			wantContentType: "image/jpeg",
+			wantSizes: map[string][2]int{
+				"large":  {1024, 512},
+				"medium": {256, 256},
+				"small":  {64, 64},
+			},
+		},
+		{
+			name:            "jpeg is turned upright",
+			data:            withExif(encodeJPEG(t, 400, 100), binary.BigEndian, 6),
+			wantContentType: "image/jpeg",
+			wantSizes: map[string][2]int{
+				"large":  {100, 400},
+				"medium": {100, 100},
+				"small":  {64, 64},
+			},
+		},
+		{
+			name:      "too many pixels",
+			data:      encodePNG(t, 100, 100),
+			maxPixels: 9999,
+			wantErr:   ErrTooLarge,
+		},
+		{
+			name:    "gif",
+			data:    []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"),
+			wantErr: ErrUnsupported,
+		},
+		{
+			name:    "text named like a png",
+			data:    []byte("<svg xmlns=\"http://www.w3.org/2000/svg\"/>"),
+			wantErr: ErrUnsupported,
+		},
+		{
+			name:    "truncated png",
+			data:    encodePNG(t, 10, 10)[:40],
+			wantErr: ErrUnsupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Process(tt.data, tt.maxPixels)
+			if err != tt.wantErr {
+				t.Fatalf("Process() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if result.ContentType != tt.wantContentType {
+				t.Errorf("content type %q, want %q", result.ContentType, tt.wantContentType)
+			}
+
+			for name, want := range tt.wantSizes {
+				cfg, _, err := image.DecodeConfig(bytes.NewReader(result.Images[name]))
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if cfg.Width != want[0] || cfg.Height != want[1] {
+					t.Errorf("%s is %dx%d, want %dx%d", name, cfg.Width, cfg.Height, want[0], want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	plain := encodeJPEG(t, 4, 4)
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{name: "no exif", data: plain, want: 1},
+		{name: "big endian", data: withExif(plain, binary.BigEndian, 6), want: 6},
+		{name: "little endian", data: withExif(plain, binary.LittleEndian, 8), want: 8},
+		{name: "out of range", data: withExif(plain, binary.BigEndian, 9), want: 1},
+		{name: "not a jpeg", data: encodePNG(t, 4, 4), want: 1},
+		{name: "truncated segment", data: withExif(plain, binary.BigEndian, 3)[:12], want: 1},
+		{name: "empty", want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != tt.want {
+				t.Errorf("jpegOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrient(t *testing.T) {
+	marker := color.NRGBA{R: 255, A: 255}
+
+	// A 3x2 image with its top left pixel marked.
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	src.SetNRGBA(0, 0, marker)
+
+	tests := []struct {
+		orientation int
+		wantW       int
+		wantH       int
+		// wantX and wantY are where the marked pixel ends up.
+		wantX int
+		wantY int
+	}{
+		{orientation: 1, wantW: 3, wantH: 2, wantX: 0, wantY: 0},
+		{orientation: 2, wantW: 3, wantH: 2, wantX: 2, wantY: 0},
+		{orientation: 3, wantW: 3, wantH: 2, wantX: 2, wantY: 1},
+		{orientation: 4, wantW: 3, wantH: 2, wantX: 0, wantY: 1},
+		{orientation: 5, wantW: 2, wantH: 3, wantX: 0, wantY: 0},
+		{orientation: 6, wantW: 2, wantH: 3, wantX: 1, wantY: 0},
+		{orientation: 7, wantW: 2, wantH: 3, wantX: 1, wantY: 2},
+		{orientation: 8, wantW: 2, wantH: 3, wantX: 0, wantY: 2},
+	}
+
+	for _, tt := range tests {
+		got := orient(src, tt.orientation)
+		bounds := got.Bounds()
+		if bounds.Dx() != tt.wantW || bounds.Dy() != tt.wantH {
+			t.Errorf("orientation %d: %dx%d, want %dx%d", tt.orientation, bounds.Dx(), bounds.Dy(), tt.wantW, tt.wantH)
+			continue
+		}
+		if c := color.NRGBAModel.Convert(got.At(tt.wantX, tt.wantY)).(color.NRGBA); c != marker {
+			t.Errorf("orientation %d: marked pixel is not at (%d, %d)", tt.orientation, tt.wantX, tt.wantY)
+		}
+	}
+}
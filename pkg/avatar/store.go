@@ -0,0 +1,97 @@
+package avatar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"myproject/api-gateway/pkg/blob"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const keyPrefix = "avatars/"
+
+// Avatar is the current avatar of a user. It is kept in the blob store next
+// to its images, as "avatars/<user id>/current.json".
+type Avatar struct {
+	Version   string    `json:"version"`
+	Ext       string    `json:"ext"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Key of one size of the avatar. Every upload gets a new version, so the
+// content behind a key never changes.
+func (a Avatar) Key(userID, size string) string {
+	return keyPrefix + userID + "/" + a.Version + "/" + size + "." + a.Ext
+}
+
+// Save stores result as the new avatar of the user and removes the previous
+// one.
+func Save(ctx context.Context, store blob.Store, userID string, result Result) (Avatar, error) {
+	previous, err := Load(ctx, store, userID)
+	if err != nil {
+		return Avatar{}, err
+	}
+
+	current := Avatar{
+		Version:   uuid.New().String(),
+		Ext:       result.Ext,
+		UpdatedAt: time.Now().UTC(),
+	}
+	for name, data := range result.Images {
+		if err := store.Put(ctx, current.Key(userID, name), bytes.NewReader(data)); err != nil {
+			return Avatar{}, err
+		}
+	}
+
+	meta, err := json.Marshal(current)
+	if err != nil {
+		return Avatar{}, err
+	}
+	if err := store.Put(ctx, metaKey(userID), bytes.NewReader(meta)); err != nil {
+		return Avatar{}, err
+	}
+
+	if previous != nil {
+		// The new avatar is in place, a leftover version only wastes space.
+		_ = store.DeletePrefix(ctx, keyPrefix+userID+"/"+previous.Version)
+	}
+
+	return current, nil
+}
+
+// Load returns nil when the user has no avatar.
+func Load(ctx context.Context, store blob.Store, userID string) (*Avatar, error) {
+	r, err := store.Get(ctx, metaKey(userID))
+	if errors.Is(err, blob.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var current Avatar
+	if err := json.Unmarshal(data, &current); err != nil {
+		return nil, err
+	}
+
+	return &current, nil
+}
+
+// Delete removes every avatar blob of the user.
+func Delete(ctx context.Context, store blob.Store, userID string) error {
+	return store.DeletePrefix(ctx, keyPrefix+userID)
+}
+
+func metaKey(userID string) string {
+	return keyPrefix + userID + "/current.json"
+}
@@ -0,0 +1,23 @@
+// Package blob stores files such as avatars outside of the user service.
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("blob key is invalid")
+)
+
+// Store keeps blobs under slash separated keys, like "avatars/<id>/small.png".
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns ErrNotFound for a missing key. The caller closes the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// DeletePrefix deletes prefix and every key below it. Deleting what does
+	// not exist is not an error.
+	DeletePrefix(ctx context.Context, prefix string) error
+}
@@ -0,0 +1,53 @@
+package cursor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrInvalid = errors.New("cursor is invalid")
+
+// Encode returns an opaque cursor holding position, signed with key so
+// clients can not forge or edit it.
+func Encode(position interface{}, key string) (string, error) {
+	payload, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(encoded, key)), nil
+}
+
+// Decode verifies cursor and unmarshals its position.
+func Decode(cursor, key string, position interface{}) error {
+	encoded, signature, found := strings.Cut(cursor, ".")
+	if !found {
+		return ErrInvalid
+	}
+
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, sign(encoded, key)) {
+		return ErrInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrInvalid
+	}
+	if err := json.Unmarshal(payload, position); err != nil {
+		return ErrInvalid
+	}
+
+	return nil
+}
+
+func sign(encoded, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,96 @@
+package cursor
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+type position struct {
+	ID     string `json:"id"`
+	Offset int    `json:"offset"`
+}
+
+func TestEncodeDecode(t *testing.T) {
+	valid, err := Encode(position{ID: "u1", Offset: 20}, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(valid, ".")
+
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"id":"u1","offset":0}`))
+
+	tests := []struct {
+		name    string
+		cursor  string
+		key     string
+		want    position
+		wantErr bool
+	}{
+		{
+			name:   "round trip",
+			cursor: valid,
+			key:    "key",
+			want:   position{ID: "u1", Offset: 20},
+		},
+		{
+			name:    "another key",
+			cursor:  valid,
+			key:     "other",
+			wantErr: true,
+		},
+		{
+			name:    "edited payload",
+			cursor:  forged + "." + signature,
+			key:     "key",
+			wantErr: true,
+		},
+		{
+			name:    "no signature",
+			cursor:  payload,
+			key:     "key",
+			wantErr: true,
+		},
+		{
+			name:    "signature is not base64",
+			cursor:  payload + ".!!",
+			key:     "key",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			key:     "key",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got position
+			err := Decode(tt.cursor, tt.key, &got)
+			if tt.wantErr {
+				if err != ErrInvalid {
+					t.Fatalf("Decode() error = %v, want ErrInvalid", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Decode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsSignedGarbage(t *testing.T) {
+	// Signed with the right key but not JSON, as if the key had leaked.
+	encoded := base64.RawURLEncoding.EncodeToString([]byte("not json"))
+	cursor := encoded + "." + base64.RawURLEncoding.EncodeToString(sign(encoded, "key"))
+
+	var got position
+	if err := Decode(cursor, "key", &got); err != ErrInvalid {
+		t.Errorf("Decode() error = %v, want ErrInvalid", err)
+	}
+}
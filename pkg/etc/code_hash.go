@@ -0,0 +1,23 @@
+package etc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// HashCode hashes a one-time code with key, so codes read from storage are
+// useless without the key. Codes are short, a plain hash would be reversed
+// by trying them all.
+func HashCode(code, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(code))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CompareHashCode takes the same time however much of code matches.
+func CompareHashCode(hashed, code, key string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashed), []byte(HashCode(code, key))) == 1
+}
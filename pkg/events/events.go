@@ -0,0 +1,166 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/storage/repo"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	UserRegistered      = "user.registered"
+	UserVerified        = "user.verified"
+	UserUpdated         = "user.updated"
+	UserDeleted         = "user.deleted"
+	UserRestored        = "user.restored"
+	UserPurged          = "user.purged"
+	UserErased          = "user.erased"
+	UserPasswordChanged = "user.password_changed"
+	UserEmailChanged    = "user.email_changed"
+)
+
+// UserEventTypes lists every event a subscriber may ask for.
+var UserEventTypes = []string{UserRegistered, UserVerified, UserUpdated, UserDeleted, UserRestored, UserPurged, UserErased, UserPasswordChanged, UserEmailChanged}
+
+const (
+	userEventsChannel = "events:user"
+	subscriberBuffer  = 64
+)
+
+var eventMetrics = expvar.NewMap("user_events")
+
+type Event struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	UserID     string    `json:"user_id"`
+	RequestID  string    `json:"request_id,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// Broker publishes events to redis and delivers the events received from
+// redis to the subscribers connected to this replica.
+type Broker struct {
+	storage repo.InMemoryStorageI
+	log     logger.Logger
+
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	types  map[string]bool
+	events chan Event
+	broker *Broker
+	once   sync.Once
+}
+
+func NewBroker(storage repo.InMemoryStorageI, log logger.Logger) *Broker {
+	return &Broker{
+		storage:     storage,
+		log:         log,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+func (b *Broker) Publish(event Event) error {
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now().UTC()
+	}
+
+	message, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if err := b.storage.Publish(userEventsChannel, string(message)); err != nil {
+		return err
+	}
+	eventMetrics.Add("published", 1)
+
+	return nil
+}
+
+// Run listens to redis until ctx is done, reconnecting after failures.
+func (b *Broker) Run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := b.storage.Subscribe(ctx, userEventsChannel, b.dispatch)
+		if ctx.Err() != nil {
+			return
+		}
+
+		b.log.Error("user events subscription failed, reconnecting", logger.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (b *Broker) dispatch(message []byte) {
+	var event Event
+	if err := json.Unmarshal(message, &event); err != nil {
+		b.log.Error("cannot unmarshal user event", logger.Error(err))
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers {
+		if !sub.types[event.Type] {
+			continue
+		}
+
+		// A slow subscriber loses events instead of blocking everyone else.
+		select {
+		case sub.events <- event:
+		default:
+			eventMetrics.Add("dropped", 1)
+		}
+	}
+}
+
+// Subscribe registers a local subscriber for the given event types.
+func (b *Broker) Subscribe(types []string) *Subscription {
+	sub := &Subscription{
+		types:  make(map[string]bool),
+		events: make(chan Event, subscriberBuffer),
+		broker: b,
+	}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	eventMetrics.Add("subscribers", 1)
+
+	return sub
+}
+
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.broker.mu.Lock()
+		delete(s.broker.subscribers, s)
+		s.broker.mu.Unlock()
+		eventMetrics.Add("subscribers", -1)
+	})
+}
@@ -0,0 +1,64 @@
+package identity
+
+import (
+	"context"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Identity describes the caller of a gateway request, as forwarded to backends.
+type Identity struct {
+	RequestID string
+	UserID    string
+	Role      string
+	Tenant    string
+	ClientIP  string
+}
+
+type identityKey struct{}
+
+// adminRoles may act on any user, and see what is hidden from everyone else.
+var adminRoles = map[string]bool{
+	"admin":      true,
+	"superadmin": true,
+}
+
+func (id Identity) IsAdmin() bool {
+	return adminRoles[id.Role]
+}
+
+// CanActOn reports whether the caller may change the user with userID: their
+// own account, or any as an admin.
+func (id Identity) CanActOn(userID string) bool {
+	return id.IsAdmin() || (id.UserID != "" && id.UserID == userID)
+}
+
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// SignAssertion issues a short-lived token that backends can verify with the
+// shared internal key instead of re-parsing the client's access token.
+func SignAssertion(id Identity, signInKey string, timeOut time.Duration) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+
+	now := time.Now()
+	claims := token.Claims.(jwt.MapClaims)
+	claims["iss"] = "api-gateway"
+	claims["aud"] = "internal"
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(timeOut).Unix()
+	claims["sub"] = id.UserID
+	claims["role"] = id.Role
+	claims["tenant"] = id.Tenant
+	claims["request_id"] = id.RequestID
+	claims["client_ip"] = id.ClientIP
+
+	return token.SignedString([]byte(signInKey))
+}
@@ -0,0 +1,398 @@
+// Package outbox sends emails in the background. Handlers enqueue them to a
+// redis stream and carry on, workers deliver them through the real transport
+// and retry failures with exponential backoff until they are dead letters.
+// Bodies are sealed while they are in redis, because they may hold codes,
+// and emails with an expiry are dropped rather than sent late or kept.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/email"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/seal"
+	"myproject/api-gateway/storage/repo"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	streamKey = "mail:outbox"
+	group     = "mailers"
+	// retryKey is a sorted set of jobs, scored by the unix time they are
+	// tried again.
+	retryKey = "mail:outbox:retry"
+	deadKey  = "mail:outbox:dead"
+	// requeueLockPrefix keeps replicas from moving the same due job back to
+	// the stream twice.
+	requeueLockPrefix = "mail:outbox:requeue:"
+	requeueLockTTL    = 3600
+
+	readBlock    = 5 * time.Second
+	pollInterval = time.Second
+	claimCount   = 10
+)
+
+// ErrNotFound is returned by Retry for an unknown dead letter.
+var ErrNotFound = errors.New("dead letter not found")
+
+var outboxMetrics = expvar.NewMap("mail_outbox")
+
+// Job is an email on its way, with what its earlier attempts ran into.
+type Job struct {
+	ID      string `json:"id"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	// SealedHTML is the body encrypted with OutboxSealKey.
+	SealedHTML []byte    `json:"sealed_html"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error,omitempty"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	FailedAt   time.Time `json:"failed_at,omitempty"`
+}
+
+// expired reports whether the job is useless at now.
+func (j Job) expired(now time.Time) bool {
+	return !j.ExpiresAt.IsZero() && !now.Before(j.ExpiresAt)
+}
+
+// DeadLetter is a job that ran out of attempts. ID is its dead-letter id,
+// which Retry takes.
+type DeadLetter struct {
+	ID string
+	Job
+}
+
+// Outbox is an email.Mailer that only enqueues. Run delivers.
+type Outbox struct {
+	storage   repo.InMemoryStorageI
+	transport email.Mailer
+	cfg       config.Config
+	log       logger.Logger
+	consumer  string
+}
+
+func New(storage repo.InMemoryStorageI, transport email.Mailer, cfg config.Config, log logger.Logger) *Outbox {
+	hostname, _ := os.Hostname()
+
+	return &Outbox{
+		storage:   storage,
+		transport: transport,
+		cfg:       cfg,
+		log:       log,
+		consumer:  hostname + "-" + uuid.New().String()[:8],
+	}
+}
+
+// Send enqueues msg. It fails only when the outbox itself can not be
+// written, delivery failures are retried later.
+func (o *Outbox) Send(ctx context.Context, msg email.Message) error {
+	job := Job{
+		ID:         uuid.New().String(),
+		To:         msg.To,
+		Subject:    msg.Subject,
+		ExpiresAt:  msg.ExpiresAt,
+		EnqueuedAt: time.Now().UTC(),
+	}
+
+	sealed, err := seal.Seal([]byte(msg.HTML), o.cfg.OutboxSealKey, job.ID)
+	if err != nil {
+		return err
+	}
+	job.SealedHTML = sealed
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	if _, err := o.storage.XAdd(streamKey, string(data), 0); err != nil {
+		return err
+	}
+	outboxMetrics.Add("enqueued", 1)
+
+	return nil
+}
+
+// Run delivers enqueued emails with OutboxWorkers workers until ctx is done.
+// Jobs a crashed replica was sending are taken over after OutboxClaimIdle.
+func (o *Outbox) Run(ctx context.Context) {
+	for {
+		err := o.storage.XGroupCreate(streamKey, group)
+		if err == nil {
+			break
+		}
+		o.log.Error("cannot create mail outbox group", logger.Error(err))
+		if !sleep(ctx, readBlock) {
+			return
+		}
+	}
+
+	workers := o.cfg.OutboxWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go o.work(ctx, fmt.Sprintf("%s-%d", o.consumer, i))
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.requeueDue()
+			o.claimStale(ctx)
+		}
+	}
+}
+
+// Dead returns up to count dead letters, oldest first, after the one with
+// id after. An empty after starts from the oldest.
+func (o *Outbox) Dead(after string, count int) ([]DeadLetter, error) {
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+
+	entries, err := o.storage.XRange(deadKey, start, "+", count)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		var job Job
+		if err := json.Unmarshal([]byte(entry.Value), &job); err != nil {
+			return nil, err
+		}
+		letters = append(letters, DeadLetter{ID: entry.ID, Job: job})
+	}
+
+	return letters, nil
+}
+
+// Retry moves a dead letter back to the outbox with a fresh set of attempts.
+func (o *Outbox) Retry(id string) error {
+	entries, err := o.storage.XRange(deadKey, id, id, 1)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return ErrNotFound
+	}
+
+	var job Job
+	if err := json.Unmarshal([]byte(entries[0].Value), &job); err != nil {
+		return err
+	}
+	job.Attempts = 0
+	job.LastError = ""
+	job.FailedAt = time.Time{}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if _, err := o.storage.XAdd(streamKey, string(data), 0); err != nil {
+		return err
+	}
+	outboxMetrics.Add("revived", 1)
+
+	return o.storage.XDel(deadKey, id)
+}
+
+func (o *Outbox) work(ctx context.Context, consumer string) {
+	for ctx.Err() == nil {
+		entries, err := o.storage.XReadGroup(streamKey, group, consumer, 1, readBlock)
+		if err != nil {
+			o.log.Error("cannot read mail outbox", logger.Error(err))
+			sleep(ctx, readBlock)
+			continue
+		}
+
+		for _, entry := range entries {
+			o.deliver(ctx, entry)
+		}
+	}
+}
+
+func (o *Outbox) claimStale(ctx context.Context) {
+	idle := time.Second * time.Duration(o.cfg.OutboxClaimIdle)
+
+	entries, err := o.storage.XAutoClaim(streamKey, group, o.consumer, idle, claimCount)
+	if err != nil {
+		o.log.Error("cannot claim stale mail", logger.Error(err))
+		return
+	}
+
+	for _, entry := range entries {
+		o.deliver(ctx, entry)
+	}
+}
+
+// deliver acknowledges entry only once it is sent or its next step is
+// stored, so a crash in between sends it again rather than losing it.
+func (o *Outbox) deliver(ctx context.Context, entry repo.StreamEntry) {
+	var job Job
+	if err := json.Unmarshal([]byte(entry.Value), &job); err != nil {
+		// Unreadable, or deleted while pending: there is nothing to retry.
+		o.log.Error("dropping unreadable mail", logger.String("entry", entry.ID), logger.Error(err))
+		o.ack(entry.ID)
+		return
+	}
+
+	if job.expired(time.Now()) {
+		o.drop(entry.ID, job, "expired before it was sent")
+		return
+	}
+	html, err := seal.Open(job.SealedHTML, o.cfg.OutboxSealKey, job.ID)
+	if err != nil {
+		// Sealed with another key, it can never be sent.
+		o.drop(entry.ID, job, err.Error())
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(o.cfg.CtxTimeout))
+	err = o.transport.Send(sendCtx, email.Message{
+		To:        job.To,
+		Subject:   job.Subject,
+		HTML:      string(html),
+		ExpiresAt: job.ExpiresAt,
+	})
+	cancel()
+	if err == nil {
+		outboxMetrics.Add("sent", 1)
+		o.ack(entry.ID)
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	due := time.Now().Add(o.backoff(job.Attempts))
+
+	// An email with an expiry would be useless by the time someone retried
+	// it by hand, and its code is not kept around as a dead letter.
+	if !job.ExpiresAt.IsZero() && (job.Attempts >= o.cfg.OutboxMaxAttempts || job.expired(due)) {
+		o.drop(entry.ID, job, "expires before it can be retried")
+		return
+	}
+
+	if job.Attempts >= o.cfg.OutboxMaxAttempts {
+		job.FailedAt = time.Now().UTC()
+		data, err := json.Marshal(job)
+		if err == nil {
+			_, err = o.storage.XAdd(deadKey, string(data), o.cfg.OutboxDeadMaxLen)
+		}
+		if err != nil {
+			o.log.Error("cannot store dead mail", logger.String("job", job.ID), logger.Error(err))
+			return
+		}
+		o.log.Error("mail is dead after its last attempt", logger.String("job", job.ID), logger.String("error", job.LastError))
+		outboxMetrics.Add("dead", 1)
+	} else {
+		data, err := json.Marshal(job)
+		if err == nil {
+			err = o.storage.ZAdd(retryKey, due.Unix(), string(data))
+		}
+		if err != nil {
+			o.log.Error("cannot schedule mail retry", logger.String("job", job.ID), logger.Error(err))
+			return
+		}
+		outboxMetrics.Add("retried", 1)
+	}
+
+	o.ack(entry.ID)
+}
+
+// requeueDue moves jobs whose backoff is over back to the stream.
+func (o *Outbox) requeueDue() {
+	due, err := o.storage.ZRangeByScore(retryKey, time.Now().Unix())
+	if err != nil {
+		o.log.Error("cannot read due mail", logger.Error(err))
+		return
+	}
+
+	for _, member := range due {
+		var job Job
+		if err := json.Unmarshal([]byte(member), &job); err != nil {
+			o.log.Error("dropping unreadable mail retry", logger.Error(err))
+			o.removeDue(member)
+			continue
+		}
+
+		lock := requeueLockPrefix + job.ID + ":" + strconv.Itoa(job.Attempts)
+		locked, err := o.storage.SetNXWithTTL(lock, "1", requeueLockTTL)
+		if err != nil || !locked {
+			continue
+		}
+
+		if _, err := o.storage.XAdd(streamKey, member, 0); err != nil {
+			o.log.Error("cannot requeue mail", logger.String("job", job.ID), logger.Error(err))
+			if err := o.storage.Del(lock); err != nil {
+				o.log.Error("cannot release mail requeue lock", logger.Error(err))
+			}
+			continue
+		}
+		o.removeDue(member)
+	}
+}
+
+// backoff doubles from OutboxBackoff with every attempt, up to
+// OutboxMaxBackoff, with a little jitter so failed jobs do not retry in step.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := time.Second * time.Duration(o.cfg.OutboxBackoff)
+	limit := time.Second * time.Duration(o.cfg.OutboxMaxBackoff)
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(delay)/10+1))
+}
+
+// drop acknowledges entry without sending it or keeping it.
+func (o *Outbox) drop(entryID string, job Job, reason string) {
+	o.log.Warn("dropping mail", logger.String("job", job.ID), logger.String("reason", reason), logger.String("error", job.LastError))
+	outboxMetrics.Add("dropped", 1)
+	o.ack(entryID)
+}
+
+func (o *Outbox) ack(id string) {
+	if err := o.storage.XAckDel(streamKey, group, id); err != nil {
+		o.log.Error("cannot acknowledge mail", logger.String("entry", id), logger.Error(err))
+	}
+}
+
+func (o *Outbox) removeDue(member string) {
+	if err := o.storage.ZRem(retryKey, member); err != nil {
+		o.log.Error("cannot remove due mail", logger.Error(err))
+	}
+}
+
+// sleep reports false when ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
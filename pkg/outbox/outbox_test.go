@@ -0,0 +1,257 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/email"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/storage/memory"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyMailer fails its first fails sends, then records like email.Recorder.
+type flakyMailer struct {
+	*email.Recorder
+
+	mu    sync.Mutex
+	fails int
+	tries int
+}
+
+func (m *flakyMailer) Send(ctx context.Context, msg email.Message) error {
+	m.mu.Lock()
+	m.tries++
+	failing := m.tries <= m.fails
+	m.mu.Unlock()
+
+	if failing {
+		return errors.New("mail server is down")
+	}
+	return m.Recorder.Send(ctx, msg)
+}
+
+func newTestOutbox(t *testing.T, transport email.Mailer, maxAttempts int) (*Outbox, *memory.Storage) {
+	t.Helper()
+
+	storage := memory.New()
+	cfg := config.Config{
+		OutboxMaxAttempts: maxAttempts,
+		OutboxSealKey:     "test-seal-key",
+		CtxTimeout:        1,
+	}
+	o := New(storage, transport, cfg, logger.New("error", "test"))
+
+	if err := storage.XGroupCreate(streamKey, group); err != nil {
+		t.Fatal(err)
+	}
+	return o, storage
+}
+
+// drain delivers until the stream is empty, requeueing retries at once the
+// way Run would once their backoff is over.
+func drain(t *testing.T, o *Outbox, storage *memory.Storage) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		o.requeueDue()
+
+		entries, err := storage.XReadGroup(streamKey, group, "test", 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			return
+		}
+		for _, entry := range entries {
+			o.deliver(context.Background(), entry)
+		}
+	}
+	t.Fatal("outbox did not drain")
+}
+
+func TestOutboxDeliver(t *testing.T) {
+	tests := []struct {
+		name        string
+		fails       int
+		maxAttempts int
+		expiresIn   time.Duration
+		wantSent    int
+		wantTries   int
+		wantDead    int
+	}{
+		{
+			name:        "sent at once",
+			maxAttempts: 3,
+			wantSent:    1,
+			wantTries:   1,
+		},
+		{
+			name:        "sent after retries",
+			fails:       2,
+			maxAttempts: 3,
+			wantSent:    1,
+			wantTries:   3,
+		},
+		{
+			name:        "dead after the last attempt",
+			fails:       5,
+			maxAttempts: 3,
+			wantTries:   3,
+			wantDead:    1,
+		},
+		{
+			name:        "expiring mail is dropped instead of dead",
+			fails:       5,
+			maxAttempts: 3,
+			expiresIn:   time.Hour,
+			wantTries:   3,
+		},
+		{
+			name:        "expired before it was sent",
+			maxAttempts: 3,
+			expiresIn:   -time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &flakyMailer{Recorder: email.NewRecorder(), fails: tt.fails}
+			o, storage := newTestOutbox(t, transport, tt.maxAttempts)
+
+			msg := email.Message{To: "ann@example.com", Subject: "Hi", HTML: "<p>48151</p>"}
+			if tt.expiresIn != 0 {
+				msg.ExpiresAt = time.Now().Add(tt.expiresIn)
+			}
+			if err := o.Send(context.Background(), msg); err != nil {
+				t.Fatal(err)
+			}
+			drain(t, o, storage)
+
+			sent := transport.Messages()
+			if len(sent) != tt.wantSent {
+				t.Fatalf("sent %d emails, want %d", len(sent), tt.wantSent)
+			}
+			if len(sent) > 0 && sent[0].HTML != msg.HTML {
+				t.Errorf("sent html %q, want %q", sent[0].HTML, msg.HTML)
+			}
+			if transport.tries != tt.wantTries {
+				t.Errorf("tried %d times, want %d", transport.tries, tt.wantTries)
+			}
+
+			dead, err := o.Dead("", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dead) != tt.wantDead {
+				t.Fatalf("%d dead letters, want %d", len(dead), tt.wantDead)
+			}
+			if len(dead) > 0 && (dead[0].Attempts != tt.maxAttempts || dead[0].LastError == "") {
+				t.Errorf("dead letter after %d attempts with error %q", dead[0].Attempts, dead[0].LastError)
+			}
+			if pending := storage.Pending(streamKey, group); pending != 0 {
+				t.Errorf("%d entries left unacknowledged", pending)
+			}
+		})
+	}
+}
+
+func TestOutboxRetryDeadLetter(t *testing.T) {
+	transport := &flakyMailer{Recorder: email.NewRecorder(), fails: 2}
+	o, storage := newTestOutbox(t, transport, 2)
+
+	if err := o.Send(context.Background(), email.Message{To: "ann@example.com", Subject: "Hi", HTML: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	drain(t, o, storage)
+
+	dead, err := o.Dead("", 10)
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("Dead() = %v, %v, want one letter", dead, err)
+	}
+	if err := o.Retry("999-0"); err != ErrNotFound {
+		t.Errorf("Retry() of an unknown letter = %v, want ErrNotFound", err)
+	}
+	if err := o.Retry(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	drain(t, o, storage)
+
+	if got := len(transport.Messages()); got != 1 {
+		t.Errorf("sent %d emails after retry, want 1", got)
+	}
+	if dead, _ := o.Dead("", 10); len(dead) != 0 {
+		t.Errorf("%d dead letters left after retry", len(dead))
+	}
+}
+
+func TestOutboxDeadPages(t *testing.T) {
+	o, storage := newTestOutbox(t, email.NewRecorder(), 1)
+	for i := 0; i < 3; i++ {
+		if _, err := storage.XAdd(deadKey, `{"id":"job"}`, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := o.Dead("", 2)
+	if err != nil || len(first) != 2 {
+		t.Fatalf("first page = %v, %v, want 2 letters", first, err)
+	}
+	second, err := o.Dead(first[1].ID, 2)
+	if err != nil || len(second) != 1 {
+		t.Fatalf("second page = %v, %v, want 1 letter", second, err)
+	}
+	if second[0].ID == first[1].ID {
+		t.Error("second page repeats the last letter of the first")
+	}
+}
+
+func TestOutboxSealsBodies(t *testing.T) {
+	transport := email.NewRecorder()
+	o, storage := newTestOutbox(t, transport, 3)
+
+	if err := o.Send(context.Background(), email.Message{To: "ann@example.com", HTML: "code 48151"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := storage.XRange(streamKey, "-", "+", 10)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("XRange() = %v, %v, want one entry", entries, err)
+	}
+	if strings.Contains(entries[0].Value, "48151") {
+		t.Error("the code is readable in redis")
+	}
+
+	// Another key can not open it, so the job is dropped rather than retried.
+	o.cfg.OutboxSealKey = "another-key"
+	drain(t, o, storage)
+	if got := len(transport.Messages()); got != 0 {
+		t.Errorf("sent %d emails sealed with another key", got)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := New(memory.New(), email.NewRecorder(), config.Config{OutboxBackoff: 10, OutboxMaxBackoff: 60}, logger.New("error", "test"))
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 10 * time.Second},
+		{attempts: 2, want: 20 * time.Second},
+		{attempts: 3, want: 40 * time.Second},
+		{attempts: 4, want: 60 * time.Second},
+		{attempts: 20, want: 60 * time.Second},
+	}
+
+	for _, tt := range tests {
+		got := o.backoff(tt.attempts)
+		// Up to a tenth of jitter is added on top.
+		if got < tt.want || got > tt.want+tt.want/10 {
+			t.Errorf("backoff(%d) = %v, want %v plus up to 10%%", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package privacy
+
+import (
+	"encoding/json"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/storage/repo"
+	"time"
+)
+
+const (
+	sessionsKeyPrefix = "user:sessions:"
+	auditKeyPrefix    = "user:audit:"
+	// activityMaxLen is about how many sign-ins and audit entries are kept
+	// per user, older ones are trimmed away.
+	activityMaxLen = 200
+)
+
+// Session is a sign-in that issued tokens to a user.
+type Session struct {
+	Method    string    `json:"method"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AuditEntry is a change made to a user, as announced by its event.
+type AuditEntry struct {
+	EventID    string    `json:"event_id"`
+	Type       string    `json:"type"`
+	RequestID  string    `json:"request_id,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// RecordSession keeps session in the sign-in history of userID.
+func RecordSession(storage repo.InMemoryStorageI, userID string, session Session) error {
+	return appendActivity(storage, sessionsKeyPrefix+userID, session)
+}
+
+// RecordAudit keeps event in the audit log of its user.
+func RecordAudit(storage repo.InMemoryStorageI, event events.Event) error {
+	return appendActivity(storage, auditKeyPrefix+event.UserID, AuditEntry{
+		EventID:    event.ID,
+		Type:       event.Type,
+		RequestID:  event.RequestID,
+		OccurredAt: event.OccurredAt,
+	})
+}
+
+// Sessions returns the sign-in history of userID, oldest first.
+func Sessions(storage repo.InMemoryStorageI, userID string) ([]Session, error) {
+	var sessions []Session
+	err := readActivity(storage, sessionsKeyPrefix+userID, func(data []byte) error {
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			return err
+		}
+		sessions = append(sessions, session)
+		return nil
+	})
+
+	return sessions, err
+}
+
+// AuditEntries returns the audit log of userID, oldest first.
+func AuditEntries(storage repo.InMemoryStorageI, userID string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := readActivity(storage, auditKeyPrefix+userID, func(data []byte) error {
+		var entry AuditEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+
+	return entries, err
+}
+
+func deleteActivity(storage repo.InMemoryStorageI, userID string) error {
+	return storage.Del(sessionsKeyPrefix+userID, auditKeyPrefix+userID)
+}
+
+func appendActivity(storage repo.InMemoryStorageI, key string, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = storage.XAdd(key, string(data), activityMaxLen)
+	return err
+}
+
+func readActivity(storage repo.InMemoryStorageI, key string, onRecord func([]byte) error) error {
+	// Trimming is approximate, so a few more than activityMaxLen may be left.
+	entries, err := storage.XRange(key, "-", "+", 2*activityMaxLen)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := onRecord([]byte(entry.Value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
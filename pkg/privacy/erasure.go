@@ -0,0 +1,323 @@
+package privacy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/email"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/avatar"
+	"myproject/api-gateway/pkg/blob"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/pkg/tombstone"
+	"myproject/api-gateway/services"
+	"myproject/api-gateway/storage/repo"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	erasureKeyPrefix     = "user:erasure:"
+	erasureLockKeyPrefix = "user:erasure:lock:"
+	// erasureDueKey is a sorted set of user ids, scored by the unix time
+	// their erasure is due.
+	erasureDueKey  = "user:erasure:due"
+	erasureLockTTL = 300
+)
+
+// ErrErasureRunning is returned when another gateway is erasing the user.
+var ErrErasureRunning = errors.New("erasure is already running")
+
+// ErasureRequest is a pending erasure. The email is kept so the user can be
+// told once the account is gone.
+type ErasureRequest struct {
+	UserID       string    `json:"user_id"`
+	Email        string    `json:"email"`
+	FirstName    string    `json:"first_name"`
+	RequestedAt  time.Time `json:"requested_at"`
+	ExecuteAfter time.Time `json:"execute_after"`
+}
+
+// Erasures schedules erasure requests and carries them out once their
+// cooling-off period is over.
+type Erasures struct {
+	storage        repo.InMemoryStorageI
+	blobs          blob.Store
+	mailer         email.Mailer
+	serviceManager services.IServiceManager
+	events         *events.Broker
+	cfg            config.Config
+	log            logger.Logger
+}
+
+func NewErasures(storage repo.InMemoryStorageI, blobs blob.Store, mailer email.Mailer, serviceManager services.IServiceManager, broker *events.Broker, cfg config.Config, log logger.Logger) *Erasures {
+	return &Erasures{
+		storage:        storage,
+		blobs:          blobs,
+		mailer:         mailer,
+		serviceManager: serviceManager,
+		events:         broker,
+		cfg:            cfg,
+		log:            log,
+	}
+}
+
+// Request schedules the erasure of user after the cooling-off period. Asking
+// again keeps the first schedule.
+func (e *Erasures) Request(ctx context.Context, user *pbu.User) (ErasureRequest, error) {
+	existing, err := e.Get(user.Id)
+	if err != nil {
+		return ErasureRequest{}, err
+	}
+	if existing != nil {
+		return *existing, nil
+	}
+
+	now := time.Now().UTC()
+	request := ErasureRequest{
+		UserID:       user.Id,
+		Email:        user.Email,
+		FirstName:    user.FirstName,
+		RequestedAt:  now,
+		ExecuteAfter: now.Add(time.Second * time.Duration(e.cfg.ErasureCoolingOff)),
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return ErasureRequest{}, err
+	}
+	if err := e.storage.Set(erasureKeyPrefix+user.Id, string(data)); err != nil {
+		return ErasureRequest{}, err
+	}
+	if err := e.storage.ZAdd(erasureDueKey, request.ExecuteAfter.Unix(), user.Id); err != nil {
+		return ErasureRequest{}, err
+	}
+
+	e.notify(ctx, request.Email, "Your erasure request", fmt.Sprintf(
+		"Hi %s, we received your request to erase your account and personal data. It will be carried out after %s. Sign in and cancel the request before then if you change your mind.",
+		request.FirstName, request.ExecuteAfter.Format("2 January 2006 15:04 MST"),
+	))
+
+	return request, nil
+}
+
+// Get returns nil when the user has no pending erasure.
+func (e *Erasures) Get(userID string) (*ErasureRequest, error) {
+	data, err := redis.Bytes(e.storage.Get(erasureKeyPrefix + userID))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var request ErasureRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// Cancel reports whether there was a pending erasure to cancel. It fails
+// with ErrErasureRunning once the erasure has started.
+func (e *Erasures) Cancel(ctx context.Context, userID string) (bool, error) {
+	unlock, err := e.lock(userID)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	request, err := e.Get(userID)
+	if err != nil || request == nil {
+		return false, err
+	}
+
+	if err := e.storage.ZRem(erasureDueKey, userID); err != nil {
+		return false, err
+	}
+	if err := e.storage.Del(erasureKeyPrefix + userID); err != nil {
+		return false, err
+	}
+
+	e.notify(ctx, request.Email, "Your erasure request was cancelled", fmt.Sprintf(
+		"Hi %s, your request to erase your account was cancelled and your data is kept.", request.FirstName,
+	))
+
+	return true, nil
+}
+
+// Execute erases the user now, whether or not they asked for it and whether
+// or not the cooling-off period is over. It is for admins, scheduled
+// erasures go through executeScheduled.
+func (e *Erasures) Execute(ctx context.Context, userID string) error {
+	unlock, err := e.lock(userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	request, err := e.Get(userID)
+	if err != nil {
+		return err
+	}
+
+	return e.erase(ctx, userID, request)
+}
+
+// executeScheduled erases the user only if their request is still there and
+// due once the lock is held. The due list may be stale by then: the user may
+// have cancelled, or another gateway may have erased them already.
+func (e *Erasures) executeScheduled(ctx context.Context, userID string) error {
+	unlock, err := e.lock(userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	request, err := e.Get(userID)
+	if err != nil {
+		return err
+	}
+	if request == nil || time.Now().Before(request.ExecuteAfter) {
+		return nil
+	}
+
+	return e.erase(ctx, userID, request)
+}
+
+// lock keeps one erasure step per user running at a time, across gateways.
+func (e *Erasures) lock(userID string) (func(), error) {
+	locked, err := e.storage.SetNXWithTTL(erasureLockKeyPrefix+userID, "1", erasureLockTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrErasureRunning
+	}
+
+	return func() {
+		if err := e.storage.Del(erasureLockKeyPrefix + userID); err != nil {
+			e.log.Error("cannot release erasure lock", logger.String("user_id", userID), logger.Error(err))
+		}
+	}, nil
+}
+
+// erase runs with the lock held. request is nil for users who did not ask.
+func (e *Erasures) erase(ctx context.Context, userID string, request *ErasureRequest) error {
+
+	user, err := e.serviceManager.UserService().GetUserById(ctx, &pbu.GetUserReqById{
+		UserId: userID,
+	})
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.NotFound:
+		// Purged already, only the gateway's own records are left.
+		user = nil
+	default:
+		return err
+	}
+
+	if user != nil {
+		if err := tombstone.SetPurged(e.storage, e.cfg, userID); err != nil {
+			return err
+		}
+		_, err = e.serviceManager.UserService().DeleteUser(ctx, &pbu.DeleteUserReq{
+			UserId: userID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := avatar.Delete(ctx, e.blobs, userID); err != nil {
+		return err
+	}
+	if err := deleteExport(e.storage, userID); err != nil {
+		return err
+	}
+	if err := deleteActivity(e.storage, userID); err != nil {
+		return err
+	}
+	if err := e.storage.ZRem(erasureDueKey, userID); err != nil {
+		return err
+	}
+	if err := e.storage.Del(erasureKeyPrefix + userID); err != nil {
+		return err
+	}
+
+	if err := e.events.Publish(events.Event{Type: events.UserErased, UserID: userID}); err != nil {
+		e.log.Error("cannot publish user event", logger.String("type", events.UserErased), logger.Error(err))
+	}
+
+	to, name := "", ""
+	if user != nil {
+		to, name = user.Email, user.FirstName
+	} else if request != nil {
+		to, name = request.Email, request.FirstName
+	}
+	if to != "" {
+		e.notify(ctx, to, "Your account was erased", fmt.Sprintf(
+			"Hi %s, your account and personal data were erased.", name,
+		))
+	}
+
+	return nil
+}
+
+// Run carries out due erasures every ErasureCheckInterval seconds until ctx
+// is done.
+func (e *Erasures) Run(ctx context.Context) {
+	interval := time.Second * time.Duration(e.cfg.ErasureCheckInterval)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.executeDue(ctx)
+		}
+	}
+}
+
+func (e *Erasures) executeDue(ctx context.Context) {
+	due, err := e.storage.ZRangeByScore(erasureDueKey, time.Now().Unix())
+	if err != nil {
+		e.log.Error("cannot read due erasures", logger.Error(err))
+		return
+	}
+
+	for _, userID := range due {
+		callCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(e.cfg.CtxTimeout))
+		err := e.executeScheduled(callCtx, userID)
+		cancel()
+
+		if err != nil && err != ErrErasureRunning {
+			e.log.Error("cannot erase user", logger.String("user_id", userID), logger.Error(err))
+		}
+	}
+}
+
+// notify does not fail the erasure step it belongs to, the step is recorded
+// either way.
+func (e *Erasures) notify(ctx context.Context, to, subject, message string) {
+	err := email.SendNotice(ctx, e.mailer, email.EmailPayload{
+		To:      to,
+		Message: message,
+	}, subject)
+	if err != nil {
+		e.log.Error("cannot send erasure email", logger.String("subject", subject), logger.Error(err))
+	}
+}
@@ -0,0 +1,336 @@
+package privacy
+
+import (
+	"context"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/email"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/blob"
+	"myproject/api-gateway/pkg/events"
+	"myproject/api-gateway/pkg/logger"
+	"myproject/api-gateway/storage/memory"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeUserService keeps users in a map, so a test can see who was deleted.
+type fakeUserService struct {
+	pbu.UserServiceClient
+
+	mu    sync.Mutex
+	users map[string]*pbu.User
+}
+
+func (s *fakeUserService) GetUserById(ctx context.Context, in *pbu.GetUserReqById, opts ...grpc.CallOption) (*pbu.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[in.UserId]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return user, nil
+}
+
+func (s *fakeUserService) DeleteUser(ctx context.Context, in *pbu.DeleteUserReq, opts ...grpc.CallOption) (*empty.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users, in.UserId)
+	return &empty.Empty{}, nil
+}
+
+func (s *fakeUserService) exists(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.users[id]
+	return ok
+}
+
+type fakeServiceManager struct {
+	users *fakeUserService
+}
+
+func (m fakeServiceManager) UserService() pbu.UserServiceClient {
+	return m.users
+}
+
+type erasureFixture struct {
+	erasures *Erasures
+	storage  *memory.Storage
+	users    *fakeUserService
+	mailer   *email.Recorder
+}
+
+func newErasureFixture(t *testing.T, coolingOff int) erasureFixture {
+	t.Helper()
+
+	blobs, err := blob.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.New()
+	users := &fakeUserService{users: map[string]*pbu.User{
+		"u1": {Id: "u1", Email: "ann@example.com", FirstName: "Ann"},
+	}}
+	mailer := email.NewRecorder()
+	log := logger.New("error", "test")
+	cfg := config.Config{ErasureCoolingOff: coolingOff, CtxTimeout: 1}
+
+	return erasureFixture{
+		erasures: NewErasures(storage, blobs, mailer, fakeServiceManager{users}, events.NewBroker(storage, log), cfg, log),
+		storage:  storage,
+		users:    users,
+		mailer:   mailer,
+	}
+}
+
+func (f erasureFixture) request(t *testing.T) ErasureRequest {
+	t.Helper()
+
+	request, err := f.erasures.Request(context.Background(), f.users.users["u1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func (f erasureFixture) due(t *testing.T) []string {
+	t.Helper()
+
+	due, err := f.storage.ZRangeByScore(erasureDueKey, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return due
+}
+
+func (f erasureFixture) holdLock(t *testing.T) {
+	t.Helper()
+
+	if _, err := f.erasures.lock("u1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErasureRequestKeepsFirstSchedule(t *testing.T) {
+	f := newErasureFixture(t, 60)
+
+	first := f.request(t)
+	second := f.request(t)
+
+	if !second.ExecuteAfter.Equal(first.ExecuteAfter) {
+		t.Errorf("second request moved the schedule from %v to %v", first.ExecuteAfter, second.ExecuteAfter)
+	}
+	if due := f.due(t); len(due) != 1 || due[0] != "u1" {
+		t.Errorf("due list %v, want [u1]", due)
+	}
+	if got := len(f.mailer.Messages()); got != 1 {
+		t.Errorf("sent %d emails, want 1", got)
+	}
+}
+
+func TestErasureCancel(t *testing.T) {
+	tests := []struct {
+		name          string
+		setup         func(*testing.T, erasureFixture)
+		wantCancelled bool
+		wantErr       error
+		wantDue       int
+	}{
+		{
+			name:  "nothing to cancel",
+			setup: func(*testing.T, erasureFixture) {},
+		},
+		{
+			name:          "pending",
+			setup:         func(t *testing.T, f erasureFixture) { f.request(t) },
+			wantCancelled: true,
+		},
+		{
+			name: "running",
+			setup: func(t *testing.T, f erasureFixture) {
+				f.request(t)
+				f.holdLock(t)
+			},
+			wantErr: ErrErasureRunning,
+			wantDue: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newErasureFixture(t, 60)
+			tt.setup(t, f)
+
+			cancelled, err := f.erasures.Cancel(context.Background(), "u1")
+			if err != tt.wantErr {
+				t.Fatalf("Cancel() error = %v, want %v", err, tt.wantErr)
+			}
+			if cancelled != tt.wantCancelled {
+				t.Errorf("Cancel() = %v, want %v", cancelled, tt.wantCancelled)
+			}
+			if due := f.due(t); len(due) != tt.wantDue {
+				t.Errorf("due list %v, want %d entries", due, tt.wantDue)
+			}
+			if tt.wantErr == nil {
+				if request, _ := f.erasures.Get("u1"); request != nil {
+					t.Error("request is still pending")
+				}
+			}
+		})
+	}
+}
+
+func TestErasureExecute(t *testing.T) {
+	tests := []struct {
+		name       string
+		coolingOff int
+		setup      func(*testing.T, erasureFixture)
+		execute    func(*Erasures) error
+		wantErr    error
+		wantErased bool
+	}{
+		{
+			name:       "admin without request",
+			setup:      func(*testing.T, erasureFixture) {},
+			execute:    func(e *Erasures) error { return e.Execute(context.Background(), "u1") },
+			wantErased: true,
+		},
+		{
+			name:       "admin before cooling-off is over",
+			coolingOff: 60,
+			setup:      func(t *testing.T, f erasureFixture) { f.request(t) },
+			execute:    func(e *Erasures) error { return e.Execute(context.Background(), "u1") },
+			wantErased: true,
+		},
+		{
+			name: "admin while running",
+			setup: func(t *testing.T, f erasureFixture) {
+				f.holdLock(t)
+			},
+			execute: func(e *Erasures) error { return e.Execute(context.Background(), "u1") },
+			wantErr: ErrErasureRunning,
+		},
+		{
+			name:       "scheduled and due",
+			setup:      func(t *testing.T, f erasureFixture) { f.request(t) },
+			execute:    func(e *Erasures) error { return e.executeScheduled(context.Background(), "u1") },
+			wantErased: true,
+		},
+		{
+			name:       "scheduled before cooling-off is over",
+			coolingOff: 60,
+			setup:      func(t *testing.T, f erasureFixture) { f.request(t) },
+			execute:    func(e *Erasures) error { return e.executeScheduled(context.Background(), "u1") },
+		},
+		{
+			name: "scheduled but cancelled",
+			setup: func(t *testing.T, f erasureFixture) {
+				f.request(t)
+				if _, err := f.erasures.Cancel(context.Background(), "u1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			execute: func(e *Erasures) error { return e.executeScheduled(context.Background(), "u1") },
+		},
+		{
+			name: "scheduled but erased already",
+			setup: func(t *testing.T, f erasureFixture) {
+				f.request(t)
+				if err := f.erasures.Execute(context.Background(), "u1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			execute:    func(e *Erasures) error { return e.executeScheduled(context.Background(), "u1") },
+			wantErased: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newErasureFixture(t, tt.coolingOff)
+			tt.setup(t, f)
+
+			err := tt.execute(f.erasures)
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if erased := !f.users.exists("u1"); erased != tt.wantErased {
+				t.Errorf("erased = %v, want %v", erased, tt.wantErased)
+			}
+			if tt.wantErased {
+				if due := f.due(t); len(due) != 0 {
+					t.Errorf("due list %v, want empty", due)
+				}
+				if request, _ := f.erasures.Get("u1"); request != nil {
+					t.Error("request is still pending")
+				}
+			}
+
+			// The lock is released unless the test holds it.
+			if tt.wantErr == nil {
+				unlock, err := f.erasures.lock("u1")
+				if err != nil {
+					t.Fatalf("lock was not released: %v", err)
+				}
+				unlock()
+			}
+		})
+	}
+}
+
+func TestErasureExecuteDue(t *testing.T) {
+	f := newErasureFixture(t, 0)
+	f.users.users["u2"] = &pbu.User{Id: "u2", Email: "bob@example.com", FirstName: "Bob"}
+	f.request(t)
+
+	// u2 is in the due list but cancelled meanwhile, so only u1 goes.
+	if err := f.storage.ZAdd(erasureDueKey, time.Now().Unix(), "u2"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.erasures.executeDue(context.Background())
+
+	if f.users.exists("u1") {
+		t.Error("due user u1 was not erased")
+	}
+	if !f.users.exists("u2") {
+		t.Error("u2 without a request was erased")
+	}
+}
+
+func TestErasureDeletesActivity(t *testing.T) {
+	f := newErasureFixture(t, 0)
+
+	if err := RecordSession(f.storage, "u1", Session{Method: "password", IP: "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordAudit(f.storage, events.Event{ID: "e1", Type: events.UserUpdated, UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.erasures.Execute(context.Background(), "u1"); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := Sessions(f.storage, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := AuditEntries(f.storage, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 || len(audit) != 0 {
+		t.Errorf("kept %d sessions and %d audit entries after erasure", len(sessions), len(audit))
+	}
+}
@@ -0,0 +1,31 @@
+// Package privacy keeps the personal data exports of users and runs their
+// erasure requests.
+package privacy
+
+import (
+	"myproject/api-gateway/storage/repo"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const exportKeyPrefix = "user:data-export:"
+
+// SaveExport stores the data export archive of a user, replacing the previous
+// one, so only the latest download link works.
+func SaveExport(storage repo.InMemoryStorageI, userID string, archive []byte, ttl int) error {
+	return storage.SetWithTTL(exportKeyPrefix+userID, string(archive), ttl)
+}
+
+// LoadExport returns nil when the user has no export or it expired.
+func LoadExport(storage repo.InMemoryStorageI, userID string) ([]byte, error) {
+	archive, err := redis.Bytes(storage.Get(exportKeyPrefix + userID))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	return archive, err
+}
+
+func deleteExport(storage repo.InMemoryStorageI, userID string) error {
+	return storage.Del(exportKeyPrefix + userID)
+}
@@ -0,0 +1,60 @@
+// Package seal encrypts values kept in redis that must not be readable by
+// whoever can read redis, such as email bodies and replayed responses.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+var ErrInvalid = errors.New("sealed value is invalid")
+
+// Seal encrypts value with key. The same binding has to be given to Open, so
+// a sealed value can not be moved to another record.
+func Seal(value []byte, key, binding string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, value, []byte(binding)), nil
+}
+
+// Open decrypts a value sealed with key and binding.
+func Open(sealed []byte, key, binding string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	size := aead.NonceSize()
+	if len(sealed) < size {
+		return nil, ErrInvalid
+	}
+
+	value, err := aead.Open(nil, sealed[:size], sealed[size:], []byte(binding))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	return value, nil
+}
+
+func newAEAD(key string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,65 @@
+// Package tombstone remembers which users are deleted, so their tokens can
+// be rejected without asking the user service on every request.
+package tombstone
+
+import (
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/storage/repo"
+	"time"
+)
+
+const (
+	keyPrefix = "user:deleted:"
+	// indexKey is a sorted set of the users that are soft deleted, scored by
+	// when, so they can be counted. Purged users are no longer in it.
+	indexKey = "user:deleted-index"
+)
+
+// Set marks id as deleted. A ttl of zero keeps the mark until Clear and
+// counts id as soft deleted; with a ttl the user is gone from the backend.
+func Set(storage repo.InMemoryStorageI, id string, ttl int) error {
+	if ttl > 0 {
+		if err := storage.SetWithTTL(keyPrefix+id, "1", ttl); err != nil {
+			return err
+		}
+		return storage.ZRem(indexKey, id)
+	}
+
+	if err := storage.Set(keyPrefix+id, "1"); err != nil {
+		return err
+	}
+	return storage.ZAdd(indexKey, time.Now().Unix(), id)
+}
+
+// SetPurged marks a purged user until every token issued before the purge
+// has expired.
+func SetPurged(storage repo.InMemoryStorageI, cfg config.Config, id string) error {
+	ttl := cfg.AccessTokenTimeOut
+	if cfg.RefreshTokenTimeOut > ttl {
+		ttl = cfg.RefreshTokenTimeOut
+	}
+
+	return Set(storage, id, ttl)
+}
+
+func Clear(storage repo.InMemoryStorageI, id string) error {
+	if err := storage.Del(keyPrefix + id); err != nil {
+		return err
+	}
+
+	return storage.ZRem(indexKey, id)
+}
+
+// Count returns how many users are soft deleted.
+func Count(storage repo.InMemoryStorageI) (int64, error) {
+	return storage.ZCard(indexKey)
+}
+
+func Exists(storage repo.InMemoryStorageI, id string) (bool, error) {
+	value, err := storage.Get(keyPrefix + id)
+	if err != nil {
+		return false, err
+	}
+
+	return value != nil, nil
+}
@@ -0,0 +1,40 @@
+package services
+
+import (
+	"context"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"sync"
+)
+
+// GetUsersByIds fans out GetUserById calls, running at most concurrency of them
+// at a time. users[i] and errs[i] belong to ids[i].
+func GetUsersByIds(ctx context.Context, client pbu.UserServiceClient, ids []string, concurrency int) ([]*pbu.User, []error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		users = make([]*pbu.User, len(ids))
+		errs  = make([]error, len(ids))
+		sem   = make(chan struct{}, concurrency)
+		wg    sync.WaitGroup
+	)
+
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			users[i], errs[i] = client.GetUserById(ctx, &pbu.GetUserReqById{
+				UserId: id,
+			})
+		}(i, id)
+	}
+	wg.Wait()
+
+	return users, errs
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"context"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// The backend has no RPCs for soft deletes, so deleted_at is set and cleared
+// with an UpdateUser that only names deleted_at in its update mask. DeleteUser
+// stays the irreversible purge.
+
+// SoftDeleteUser marks user as deleted at the given time.
+func SoftDeleteUser(ctx context.Context, client pbu.UserServiceClient, user *pbu.User, at time.Time) (*pbu.User, error) {
+	return setDeletedAt(ctx, client, user, at.UTC().Format(time.RFC3339))
+}
+
+// RestoreUser clears the deleted_at of a soft deleted user.
+func RestoreUser(ctx context.Context, client pbu.UserServiceClient, user *pbu.User) (*pbu.User, error) {
+	return setDeletedAt(ctx, client, user, "")
+}
+
+func setDeletedAt(ctx context.Context, client pbu.UserServiceClient, user *pbu.User, deletedAt string) (*pbu.User, error) {
+	ctx, err := WithUpdateMask(ctx, &fieldmaskpb.FieldMask{Paths: []string{"deleted_at"}})
+	if err != nil {
+		return nil, err
+	}
+
+	updated := proto.Clone(user).(*pbu.User)
+	updated.DeletedAt = deletedAt
+
+	return client.UpdateUser(ctx, updated)
+}
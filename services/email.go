@@ -0,0 +1,23 @@
+package services
+
+import (
+	"context"
+	pbu "myproject/api-gateway/genproto/user-service"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// ChangeEmail sets the email of user and nothing else. Callers check that
+// the address is unique and owned by the user first.
+func ChangeEmail(ctx context.Context, client pbu.UserServiceClient, user *pbu.User, email string) (*pbu.User, error) {
+	ctx, err := WithUpdateMask(ctx, &fieldmaskpb.FieldMask{Paths: []string{"email"}})
+	if err != nil {
+		return nil, err
+	}
+
+	updated := proto.Clone(user).(*pbu.User)
+	updated.Email = email
+
+	return client.UpdateUser(ctx, updated)
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"context"
+	"myproject/api-gateway/config"
+	"myproject/api-gateway/pkg/identity"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	MetadataRequestID         = "x-request-id"
+	MetadataUserID            = "x-user-id"
+	MetadataUserRoles         = "x-user-roles"
+	MetadataTenantID          = "x-tenant-id"
+	MetadataClientIP          = "x-client-ip"
+	MetadataIdentityAssertion = "x-identity-assertion"
+	MetadataUpdateMask        = "x-update-mask-bin"
+)
+
+// WithUpdateMask sends the fields changed by a partial update along with the
+// next call, as a serialized google.protobuf.FieldMask. The backend UpdateUser
+// RPC still receives the whole merged user, so backends that ignore the mask
+// keep working.
+func WithUpdateMask(ctx context.Context, mask *fieldmaskpb.FieldMask) (context.Context, error) {
+	data, err := proto.Marshal(mask)
+	if err != nil {
+		return ctx, err
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, MetadataUpdateMask, string(data)), nil
+}
+
+// identityInterceptor forwards the caller identity stored in the request
+// context by the HTTP middlewares as outgoing gRPC metadata.
+func identityInterceptor(cfg config.Config) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		id, ok := identity.FromContext(ctx)
+		if !ok {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		pairs := []string{
+			MetadataRequestID, id.RequestID,
+			MetadataClientIP, id.ClientIP,
+		}
+		if id.UserID != "" {
+			pairs = append(pairs, MetadataUserID, id.UserID)
+		}
+		if id.Role != "" {
+			pairs = append(pairs, MetadataUserRoles, id.Role)
+		}
+		if id.Tenant != "" {
+			pairs = append(pairs, MetadataTenantID, id.Tenant)
+		}
+
+		assertion, err := identity.SignAssertion(id, cfg.InternalSignInKey, time.Second*time.Duration(cfg.IdentityAssertionTimeOut))
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, MetadataIdentityAssertion, assertion)
+
+		return invoker(metadata.AppendToOutgoingContext(ctx, pairs...), method, req, reply, cc, opts...)
+	}
+}
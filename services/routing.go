@@ -0,0 +1,292 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/pkg/identity"
+	"net/http"
+	"os"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var targetMetrics = expvar.NewMap("user_service_targets")
+
+// RoutingConfig splits user service traffic between target groups, e.g. the
+// stable version and a canary. Rules are tried in order and the first match
+// wins, everything else is split by target weight.
+type RoutingConfig struct {
+	Targets []RoutingTarget `json:"targets"`
+	Rules   []RoutingRule   `json:"rules"`
+}
+
+type RoutingTarget struct {
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	ServerName string `json:"server_name"`
+	Weight     int    `json:"weight"`
+}
+
+// RoutingRule matches when all of its non-empty conditions do. UserPercent
+// matches a stable share of callers, picked by hashing the user id. Target is
+// required, so callers can not pick a target by naming it in a header.
+type RoutingRule struct {
+	Header      string `json:"header"`
+	Value       string `json:"value"`
+	Role        string `json:"role"`
+	Tenant      string `json:"tenant"`
+	UserPercent int    `json:"user_percent"`
+	Target      string `json:"target"`
+}
+
+// LoadRoutingConfig reads the target groups from a JSON file. A missing file
+// returns nil, and the single USER_SERVICE_HOST backend is used.
+func LoadRoutingConfig(path string) (*RoutingConfig, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var routing RoutingConfig
+	if err := json.Unmarshal(data, &routing); err != nil {
+		return nil, fmt.Errorf("cannot parse user service routing %s: %w", path, err)
+	}
+
+	if err := routing.validate(); err != nil {
+		return nil, fmt.Errorf("user service routing %s: %w", path, err)
+	}
+
+	return &routing, nil
+}
+
+func (r *RoutingConfig) validate() error {
+	if len(r.Targets) == 0 {
+		return fmt.Errorf("no targets")
+	}
+
+	names := make(map[string]bool)
+	for _, target := range r.Targets {
+		if target.Name == "" || target.Host == "" || target.Port <= 0 {
+			return fmt.Errorf("target %q needs a name, host and port", target.Name)
+		}
+		if target.Weight < 0 {
+			return fmt.Errorf("target %s: weight should not be negative", target.Name)
+		}
+		if names[target.Name] {
+			return fmt.Errorf("duplicate target %s", target.Name)
+		}
+		names[target.Name] = true
+	}
+
+	for i, rule := range r.Rules {
+		if rule.Header == "" && rule.Role == "" && rule.Tenant == "" && rule.UserPercent == 0 {
+			return fmt.Errorf("rule %d has no conditions", i)
+		}
+		if rule.UserPercent < 0 || rule.UserPercent > 100 {
+			return fmt.Errorf("rule %d: user_percent should be between 0 and 100", i)
+		}
+		if rule.Target == "" {
+			return fmt.Errorf("rule %d has no target", i)
+		}
+		if !names[rule.Target] {
+			return fmt.Errorf("rule %d: unknown target %s", i, rule.Target)
+		}
+	}
+
+	return nil
+}
+
+type requestHeaderKey struct{}
+
+// WithRequestHeader keeps the headers of the HTTP request, so routing rules
+// can match on them.
+func WithRequestHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, requestHeaderKey{}, header)
+}
+
+type routedTarget struct {
+	name   string
+	weight int
+	client pbu.UserServiceClient
+}
+
+// routingUserService picks a target for every call and records per target
+// request and error counts, so versions can be compared before promoting.
+type routingUserService struct {
+	targets map[string]*routedTarget
+	ordered []*routedTarget
+	rules   []RoutingRule
+	total   int
+}
+
+func newRoutingUserService(routing *RoutingConfig, clients map[string]pbu.UserServiceClient) *routingUserService {
+	r := &routingUserService{
+		targets: make(map[string]*routedTarget),
+		rules:   routing.Rules,
+	}
+	for _, target := range routing.Targets {
+		t := &routedTarget{name: target.Name, weight: target.Weight, client: clients[target.Name]}
+		r.targets[t.name] = t
+		r.ordered = append(r.ordered, t)
+		r.total += t.weight
+	}
+
+	return r
+}
+
+// stickyKey identifies the caller, so the same user lands on the same target
+// as long as weights do not change.
+func stickyKey(id identity.Identity) string {
+	if id.UserID != "" {
+		return id.UserID
+	}
+	if id.ClientIP != "" {
+		return id.ClientIP
+	}
+
+	return id.RequestID
+}
+
+func bucket(key string, size int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(size))
+}
+
+func (r *routingUserService) pick(ctx context.Context) *routedTarget {
+	id, _ := identity.FromContext(ctx)
+	header, _ := ctx.Value(requestHeaderKey{}).(http.Header)
+	key := stickyKey(id)
+
+	for _, rule := range r.rules {
+		if rule.Header != "" {
+			value := header.Get(rule.Header)
+			if value == "" || rule.Value != "" && value != rule.Value {
+				continue
+			}
+		}
+		if rule.Role != "" && rule.Role != id.Role {
+			continue
+		}
+		if rule.Tenant != "" && rule.Tenant != id.Tenant {
+			continue
+		}
+		if rule.UserPercent > 0 && bucket(key, 100) >= rule.UserPercent {
+			continue
+		}
+
+		if t, ok := r.targets[rule.Target]; ok {
+			return t
+		}
+	}
+
+	// Targets take consecutive ranges of buckets in the configured order, so
+	// raising the weight of the last target only moves users onto it.
+	if r.total > 0 {
+		b := bucket(key, r.total)
+		for _, t := range r.ordered {
+			if b < t.weight {
+				return t
+			}
+			b -= t.weight
+		}
+	}
+
+	return r.ordered[0]
+}
+
+func (r *routingUserService) call(ctx context.Context, invoke func(pbu.UserServiceClient) error) error {
+	target := r.pick(ctx)
+	targetMetrics.Add(target.name+".requests", 1)
+
+	err := invoke(target.client)
+	if err != nil {
+		targetMetrics.Add(target.name+".errors", 1)
+		targetMetrics.Add(target.name+".errors."+status.Code(err).String(), 1)
+	}
+
+	return err
+}
+
+func (r *routingUserService) CreateUser(ctx context.Context, in *pbu.User, opts ...grpc.CallOption) (resp *pbu.User, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.CreateUser(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r *routingUserService) UpdateUser(ctx context.Context, in *pbu.User, opts ...grpc.CallOption) (resp *pbu.User, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.UpdateUser(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r *routingUserService) GetUserById(ctx context.Context, in *pbu.GetUserReqById, opts ...grpc.CallOption) (resp *pbu.User, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.GetUserById(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r *routingUserService) GetAllUsers(ctx context.Context, in *pbu.ListUsersReq, opts ...grpc.CallOption) (resp *pbu.ListUsersResp, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.GetAllUsers(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r *routingUserService) DeleteUser(ctx context.Context, in *pbu.DeleteUserReq, opts ...grpc.CallOption) (resp *empty.Empty, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.DeleteUser(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r *routingUserService) CheckField(ctx context.Context, in *pbu.CheckFieldReq, opts ...grpc.CallOption) (resp *pbu.CheckFieldResp, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.CheckField(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r *routingUserService) IfExists(ctx context.Context, in *pbu.IfExistsReq, opts ...grpc.CallOption) (resp *pbu.IfExistsResp, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.IfExists(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r *routingUserService) ChangePassword(ctx context.Context, in *pbu.ChangeUserPasswordReq, opts ...grpc.CallOption) (resp *pbu.ChangeUserPasswordResp, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.ChangePassword(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (r *routingUserService) UpdateRefreshToken(ctx context.Context, in *pbu.UpdateRefreshTokenReq, opts ...grpc.CallOption) (resp *pbu.UpdateRefreshTokenResp, err error) {
+	err = r.call(ctx, func(c pbu.UserServiceClient) error {
+		resp, err = c.UpdateRefreshToken(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"myproject/api-gateway/pkg/identity"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRoutingConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			json: `{"targets":[{"name":"stable","host":"a","port":1,"weight":1},{"name":"canary","host":"b","port":1}],
+				"rules":[{"header":"X-Backend-Version","value":"canary","target":"canary"}]}`,
+		},
+		{
+			name:    "no targets",
+			json:    `{"targets":[]}`,
+			wantErr: "no targets",
+		},
+		{
+			name:    "target without host",
+			json:    `{"targets":[{"name":"stable","port":1}]}`,
+			wantErr: "needs a name, host and port",
+		},
+		{
+			name:    "negative weight",
+			json:    `{"targets":[{"name":"stable","host":"a","port":1,"weight":-1}]}`,
+			wantErr: "weight should not be negative",
+		},
+		{
+			name:    "duplicate target",
+			json:    `{"targets":[{"name":"stable","host":"a","port":1},{"name":"stable","host":"b","port":1}]}`,
+			wantErr: "duplicate target",
+		},
+		{
+			name:    "rule without conditions",
+			json:    `{"targets":[{"name":"stable","host":"a","port":1}],"rules":[{"target":"stable"}]}`,
+			wantErr: "has no conditions",
+		},
+		{
+			name:    "rule without target",
+			json:    `{"targets":[{"name":"stable","host":"a","port":1}],"rules":[{"header":"X-Backend-Version"}]}`,
+			wantErr: "has no target",
+		},
+		{
+			name:    "rule with unknown target",
+			json:    `{"targets":[{"name":"stable","host":"a","port":1}],"rules":[{"role":"tester","target":"canary"}]}`,
+			wantErr: "unknown target canary",
+		},
+		{
+			name:    "user percent out of range",
+			json:    `{"targets":[{"name":"stable","host":"a","port":1}],"rules":[{"user_percent":101,"target":"stable"}]}`,
+			wantErr: "user_percent should be between 0 and 100",
+		},
+		{
+			name:    "not json",
+			json:    `targets`,
+			wantErr: "cannot parse",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routing.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			routing, err := LoadRoutingConfig(path)
+			if tt.wantErr == "" {
+				if err != nil || routing == nil {
+					t.Fatalf("LoadRoutingConfig() = %v, %v", routing, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadRoutingConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadRoutingConfigMissingFile(t *testing.T) {
+	routing, err := LoadRoutingConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if routing != nil || err != nil {
+		t.Errorf("LoadRoutingConfig() = %v, %v, want nil, nil", routing, err)
+	}
+}
+
+// userInBucket returns a user id whose user_percent bucket is below percent,
+// or at least percent when inside is false.
+func userInBucket(t *testing.T, percent int, inside bool) string {
+	t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("user-%d", i)
+		if (bucket(id, 100) < percent) == inside {
+			return id
+		}
+	}
+	t.Fatal("no user id found")
+	return ""
+}
+
+func TestRoutingPick(t *testing.T) {
+	routing, err := LoadRoutingConfig("../config/user_service_routing.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Weights alone send everyone to stable, so a canary pick comes from a rule.
+	routing.Targets[0].Weight, routing.Targets[1].Weight = 100, 0
+	r := newRoutingUserService(routing, nil)
+
+	tests := []struct {
+		name   string
+		id     identity.Identity
+		header http.Header
+		want   string
+	}{
+		{
+			name: "no rule matches",
+			id:   identity.Identity{UserID: "u1", Role: "user"},
+			want: "stable",
+		},
+		{
+			name:   "header with the rule's value",
+			id:     identity.Identity{UserID: "u1"},
+			header: http.Header{"X-Backend-Version": {"canary"}},
+			want:   "canary",
+		},
+		{
+			name:   "header can not name another target",
+			id:     identity.Identity{UserID: "u1"},
+			header: http.Header{"X-Backend-Version": {"stable"}},
+			want:   "stable",
+		},
+		{
+			name: "role",
+			id:   identity.Identity{UserID: "u1", Role: "tester"},
+			want: "canary",
+		},
+		{
+			name: "tenant inside the user percent",
+			id:   identity.Identity{UserID: userInBucket(t, 20, true), Tenant: "acme"},
+			want: "canary",
+		},
+		{
+			name: "tenant outside the user percent",
+			id:   identity.Identity{UserID: userInBucket(t, 20, false), Tenant: "acme"},
+			want: "stable",
+		},
+		{
+			name: "user percent of another tenant",
+			id:   identity.Identity{UserID: userInBucket(t, 20, true), Tenant: "globex"},
+			want: "stable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := identity.WithIdentity(context.Background(), tt.id)
+			if tt.header != nil {
+				ctx = WithRequestHeader(ctx, tt.header)
+			}
+
+			if got := r.pick(ctx).name; got != tt.want {
+				t.Errorf("pick() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoutingPickByWeight(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights [2]int
+		// wantCanary bounds how many of 1000 users land on canary.
+		wantCanary [2]int
+	}{
+		{name: "all stable", weights: [2]int{100, 0}, wantCanary: [2]int{0, 0}},
+		{name: "all canary", weights: [2]int{0, 100}, wantCanary: [2]int{1000, 1000}},
+		{name: "even split", weights: [2]int{50, 50}, wantCanary: [2]int{400, 600}},
+		{name: "no weights goes to the first target", weights: [2]int{0, 0}, wantCanary: [2]int{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRoutingUserService(&RoutingConfig{Targets: []RoutingTarget{
+				{Name: "stable", Weight: tt.weights[0]},
+				{Name: "canary", Weight: tt.weights[1]},
+			}}, nil)
+
+			canary := 0
+			for i := 0; i < 1000; i++ {
+				ctx := identity.WithIdentity(context.Background(), identity.Identity{UserID: fmt.Sprintf("user-%d", i)})
+				first := r.pick(ctx).name
+				if again := r.pick(ctx).name; again != first {
+					t.Fatalf("user-%d moved from %s to %s", i, first, again)
+				}
+				if first == "canary" {
+					canary++
+				}
+			}
+
+			if canary < tt.wantCanary[0] || canary > tt.wantCanary[1] {
+				t.Errorf("%d users on canary, want %d to %d", canary, tt.wantCanary[0], tt.wantCanary[1])
+			}
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 	pbu "myproject/api-gateway/genproto/user-service"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/resolver"
 )
 
@@ -25,12 +24,61 @@ func (s *serviceManager) UserService() pbu.UserServiceClient {
 func NewServiceManager(cfg config.Config) (IServiceManager, error) {
 	resolver.SetDefaultScheme("dns")
 
+	if cfg.Environment == "production" && !cfg.UserServiceTLS.Enabled {
+		return nil, fmt.Errorf("user service: TLS is required in production, set USER_SERVICE_TLS_ENABLED")
+	}
+
+	routing, err := LoadRoutingConfig(cfg.UserServiceRoutingFile)
+	if err != nil {
+		return nil, err
+	}
+	if routing == nil {
+		userService, err := dialUserService(cfg, cfg.UserServiceHost, cfg.UserServicePort, cfg.UserServiceTLS.ServerName)
+		if err != nil {
+			return nil, err
+		}
+
+		return &serviceManager{userService: userService}, nil
+	}
+
+	clients := make(map[string]pbu.UserServiceClient)
+	for _, target := range routing.Targets {
+		serverName := target.ServerName
+		if serverName == "" {
+			serverName = cfg.UserServiceTLS.ServerName
+		}
+
+		client, err := dialUserService(cfg, target.Host, target.Port, serverName)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", target.Name, err)
+		}
+		clients[target.Name] = client
+	}
+
+	return &serviceManager{userService: newRoutingUserService(routing, clients)}, nil
+}
+
+func dialUserService(cfg config.Config, host string, port int, serverName string) (pbu.UserServiceClient, error) {
+	// Without a configured name the certificate has to be valid for the
+	// dialled host, which may be an IP address.
+	if serverName == "" {
+		serverName = host
+	}
+	tlsConfig := cfg.UserServiceTLS
+	tlsConfig.ServerName = serverName
+
+	userCreds, err := newTransportCredentials(tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("user service: %v", err)
+	}
+
 	connUser, err := grpc.Dial(
-		fmt.Sprintf("%s:%d", cfg.UserServiceHost, cfg.UserServicePort),
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
+		fmt.Sprintf("%s:%d", host, port),
+		grpc.WithTransportCredentials(userCreds),
+		grpc.WithChainUnaryInterceptor(identityInterceptor(cfg)))
 	if err != nil {
-		return nil, fmt.Errorf("user service dial error, %s:%s:%v", cfg.UserServiceHost, cfg.UserServicePort, err)
+		return nil, fmt.Errorf("user service dial error, %s:%d:%v", host, port, err)
 	}
 
-	return &serviceManager{userService: pbu.NewUserServiceClient(connUser)}, nil
+	return pbu.NewUserServiceClient(connUser), nil
 }
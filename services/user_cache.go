@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"myproject/api-gateway/config"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/storage/repo"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	rd "github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	userCacheKeyPrefix      = "user:cache:"
+	userCacheEmailKeyPrefix = "user:cache:email:"
+	// userCacheGenKeyPrefix holds a token that every invalidation replaces,
+	// so a fill that overlapped a write can tell and undo itself.
+	userCacheGenKeyPrefix = "user:cache:gen:"
+	userCacheNotFound     = "null"
+)
+
+var userCacheMetrics = expvar.NewMap("user_cache")
+
+// cachedUserService is a read-through cache for GetUserById. Writes go straight
+// to the backend and invalidate the cached entry afterwards.
+type cachedUserService struct {
+	pbu.UserServiceClient
+
+	storage     repo.InMemoryStorageI
+	ttl         int
+	negativeTTL int
+	timeout     time.Duration
+	group       singleflight.Group
+}
+
+type cachedServiceManager struct {
+	IServiceManager
+	userService pbu.UserServiceClient
+}
+
+func (s *cachedServiceManager) UserService() pbu.UserServiceClient {
+	return s.userService
+}
+
+// WithUserCache wraps the user service of manager with a redis backed cache.
+// A zero USER_CACHE_TTL disables caching. Cached users have no password hash
+// or tokens.
+func WithUserCache(manager IServiceManager, storage repo.InMemoryStorageI, cfg config.Config) IServiceManager {
+	if cfg.UserCacheTTL <= 0 {
+		return manager
+	}
+
+	return &cachedServiceManager{
+		IServiceManager: manager,
+		userService: &cachedUserService{
+			UserServiceClient: manager.UserService(),
+			storage:           storage,
+			ttl:               cfg.UserCacheTTL,
+			negativeTTL:       cfg.UserCacheNegativeTTL,
+			timeout:           time.Second * time.Duration(cfg.CtxTimeout),
+		},
+	}
+}
+
+func (s *cachedUserService) GetUserById(ctx context.Context, in *pbu.GetUserReqById, opts ...grpc.CallOption) (*pbu.User, error) {
+	if user, found, ok := s.lookup(in.UserId); ok {
+		userCacheMetrics.Add("hits", 1)
+		if !found {
+			userCacheMetrics.Add("negative_hits", 1)
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return user, nil
+	}
+	userCacheMetrics.Add("misses", 1)
+
+	// Concurrent misses share one RPC. It runs detached from the first caller,
+	// so one client going away does not fail the others.
+	result := s.group.DoChan(in.UserId, func() (interface{}, error) {
+		callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.timeout)
+		defer cancel()
+
+		generation := s.generation(in.UserId)
+		user, err := s.UserServiceClient.GetUserById(callCtx, in, opts...)
+		switch {
+		case status.Code(err) == codes.NotFound:
+			s.store(in.UserId, nil, generation)
+		case err == nil:
+			s.store(in.UserId, user, generation)
+		}
+		return user, err
+	})
+
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		// Every caller of the shared RPC gets its own copy to change.
+		return proto.Clone(res.Val.(*pbu.User)).(*pbu.User), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// UpdateUser puts back the secrets missing from a user that was read from the
+// cache, so backends that ignore the update mask do not clear them.
+func (s *cachedUserService) UpdateUser(ctx context.Context, in *pbu.User, opts ...grpc.CallOption) (*pbu.User, error) {
+	if in.Password == "" || in.AccessToken == "" || in.RefreshToken == "" {
+		current, err := s.UserServiceClient.GetUserById(ctx, &pbu.GetUserReqById{UserId: in.Id}, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		in = proto.Clone(in).(*pbu.User)
+		if in.Password == "" {
+			in.Password = current.Password
+		}
+		if in.AccessToken == "" {
+			in.AccessToken = current.AccessToken
+		}
+		if in.RefreshToken == "" {
+			in.RefreshToken = current.RefreshToken
+		}
+	}
+
+	user, err := s.UserServiceClient.UpdateUser(ctx, in, opts...)
+	s.Invalidate(in.Id)
+	return user, err
+}
+
+func (s *cachedUserService) DeleteUser(ctx context.Context, in *pbu.DeleteUserReq, opts ...grpc.CallOption) (*empty.Empty, error) {
+	resp, err := s.UserServiceClient.DeleteUser(ctx, in, opts...)
+	s.Invalidate(in.UserId)
+	return resp, err
+}
+
+func (s *cachedUserService) ChangePassword(ctx context.Context, in *pbu.ChangeUserPasswordReq, opts ...grpc.CallOption) (*pbu.ChangeUserPasswordResp, error) {
+	resp, err := s.UserServiceClient.ChangePassword(ctx, in, opts...)
+	if id, lookupErr := rd.String(s.storage.Get(userCacheEmailKeyPrefix + in.Email)); lookupErr == nil {
+		s.Invalidate(id)
+	}
+	return resp, err
+}
+
+// Invalidate drops the cached entries of the given users. Their generation
+// changes first, so fills that were running meanwhile drop what they store.
+func (s *cachedUserService) Invalidate(ids ...string) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		_ = s.storage.SetWithTTL(userCacheGenKeyPrefix+id, uuid.New().String(), s.generationTTL())
+		keys = append(keys, userCacheKeyPrefix+id)
+	}
+
+	if err := s.storage.Del(keys...); err == nil {
+		userCacheMetrics.Add("invalidations", int64(len(ids)))
+	}
+}
+
+// lookup reports ok=false on a cache miss and found=false for a cached
+// not-found entry.
+func (s *cachedUserService) lookup(id string) (user *pbu.User, found bool, ok bool) {
+	value, err := rd.Bytes(s.storage.Get(userCacheKeyPrefix + id))
+	if err != nil {
+		return nil, false, false
+	}
+
+	if string(value) == userCacheNotFound {
+		return nil, false, true
+	}
+
+	user = &pbu.User{}
+	if err := json.Unmarshal(value, user); err != nil {
+		return nil, false, false
+	}
+	return user, true, true
+}
+
+// generation returns the token of id's last invalidation, empty when there
+// was none lately.
+func (s *cachedUserService) generation(id string) string {
+	value, _ := rd.String(s.storage.Get(userCacheGenKeyPrefix + id))
+	return value
+}
+
+// generationTTL keeps a generation for longer than any fill can run.
+func (s *cachedUserService) generationTTL() int {
+	return s.ttl + int(s.timeout/time.Second)
+}
+
+// store caches user, or a not-found entry for nil, as read at generation. An
+// invalidation between that read and now may have missed the entry, so it is
+// dropped again when the generation moved.
+func (s *cachedUserService) store(id string, user *pbu.User, generation string) {
+	defer func() {
+		if s.generation(id) != generation {
+			userCacheMetrics.Add("stale_fills", 1)
+			_ = s.storage.Del(userCacheKeyPrefix + id)
+		}
+	}()
+
+	if user == nil {
+		if s.negativeTTL > 0 {
+			_ = s.storage.SetWithTTL(userCacheKeyPrefix+id, userCacheNotFound, s.negativeTTL)
+		}
+		return
+	}
+
+	// Secrets stay out of redis.
+	cached := proto.Clone(user).(*pbu.User)
+	cached.Password = ""
+	cached.AccessToken = ""
+	cached.RefreshToken = ""
+
+	value, err := json.Marshal(cached)
+	if err != nil {
+		return
+	}
+
+	_ = s.storage.SetWithTTL(userCacheKeyPrefix+id, string(value), s.ttl)
+	if user.Email != "" {
+		_ = s.storage.SetWithTTL(userCacheEmailKeyPrefix+user.Email, id, s.ttl)
+	}
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	pbu "myproject/api-gateway/genproto/user-service"
+	"myproject/api-gateway/storage/memory"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// slowUserService is a backend whose reads wait for release, after telling
+// read what they found, so a test can write in between.
+type slowUserService struct {
+	pbu.UserServiceClient
+
+	mu      sync.Mutex
+	user    *pbu.User
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s *slowUserService) GetUserById(ctx context.Context, in *pbu.GetUserReqById, opts ...grpc.CallOption) (*pbu.User, error) {
+	s.mu.Lock()
+	user := proto.Clone(s.user).(*pbu.User)
+	s.mu.Unlock()
+
+	if s.read != nil {
+		s.read <- struct{}{}
+		<-s.release
+	}
+	return user, nil
+}
+
+func (s *slowUserService) UpdateUser(ctx context.Context, in *pbu.User, opts ...grpc.CallOption) (*pbu.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user = proto.Clone(in).(*pbu.User)
+	return in, nil
+}
+
+func TestUserCacheFillOverlappingWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		// write runs while the fill holds the user it read.
+		write     func(cache *cachedUserService, user *pbu.User)
+		wantFirst string
+	}{
+		{
+			name:      "no write",
+			write:     func(*cachedUserService, *pbu.User) {},
+			wantFirst: "Ann",
+		},
+		{
+			name: "update",
+			write: func(cache *cachedUserService, user *pbu.User) {
+				user.FirstName = "Anna"
+				if _, err := cache.UpdateUser(context.Background(), user); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantFirst: "Anna",
+		},
+		{
+			name: "invalidate",
+			write: func(cache *cachedUserService, user *pbu.User) {
+				cache.UserServiceClient.(*slowUserService).UpdateUser(context.Background(), &pbu.User{Id: user.Id, FirstName: "Anna"})
+				cache.Invalidate(user.Id)
+			},
+			wantFirst: "Anna",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &pbu.User{Id: "u1", FirstName: "Ann", Password: "hash", AccessToken: "a", RefreshToken: "r"}
+			backend := &slowUserService{
+				user:    proto.Clone(user).(*pbu.User),
+				read:    make(chan struct{}),
+				release: make(chan struct{}),
+			}
+			storage := memory.New()
+			cache := &cachedUserService{UserServiceClient: backend, storage: storage, ttl: 60, timeout: time.Second}
+
+			done := make(chan *pbu.User)
+			go func() {
+				got, err := cache.GetUserById(context.Background(), &pbu.GetUserReqById{UserId: user.Id})
+				if err != nil {
+					t.Error(err)
+				}
+				done <- got
+			}()
+
+			<-backend.read
+			backend.read = nil
+			tt.write(cache, user)
+			close(backend.release)
+			<-done
+
+			got, err := cache.GetUserById(context.Background(), &pbu.GetUserReqById{UserId: user.Id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.FirstName != tt.wantFirst {
+				t.Errorf("cached first name %q, want %q", got.FirstName, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestUserCacheKeepsSecretsOut(t *testing.T) {
+	storage := memory.New()
+	backend := &slowUserService{user: &pbu.User{Id: "u1", Password: "hash", AccessToken: "a", RefreshToken: "r"}}
+	cache := &cachedUserService{UserServiceClient: backend, storage: storage, ttl: 60}
+
+	if _, err := cache.GetUserById(context.Background(), &pbu.GetUserReqById{UserId: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, found, ok := cache.lookup("u1")
+	if !ok || !found {
+		t.Fatal("user was not cached")
+	}
+	if cached.Password != "" || cached.AccessToken != "" || cached.RefreshToken != "" {
+		t.Errorf("cached user has secrets: %v", cached)
+	}
+}
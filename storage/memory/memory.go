@@ -0,0 +1,488 @@
+// Package memory keeps InMemoryStorageI data in the process, for tests. It
+// follows the redis commands the real storage runs closely enough for
+// handlers and workers, but keeps everything until the process exits.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"myproject/api-gateway/storage/repo"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type value struct {
+	data      string
+	expiresAt time.Time
+}
+
+type pending struct {
+	consumer    string
+	deliveredAt time.Time
+}
+
+type group struct {
+	// next is the sequence of the first entry not delivered to the group.
+	next    int64
+	pending map[int64]pending
+}
+
+type stream struct {
+	seq     int64
+	entries map[int64]string
+	groups  map[string]*group
+}
+
+// Storage is safe for concurrent use. Now may be replaced to move time on
+// without sleeping.
+type Storage struct {
+	Now func() time.Time
+
+	mu          sync.Mutex
+	values      map[string]value
+	sets        map[string]map[string]int64
+	streams     map[string]*stream
+	subscribers map[string][]chan []byte
+}
+
+func New() *Storage {
+	return &Storage{
+		Now:         time.Now,
+		values:      make(map[string]value),
+		sets:        make(map[string]map[string]int64),
+		streams:     make(map[string]*stream),
+		subscribers: make(map[string][]chan []byte),
+	}
+}
+
+var _ repo.InMemoryStorageI = (*Storage)(nil)
+
+// get returns the live value at key. It needs s.mu.
+func (s *Storage) get(key string) (value, bool) {
+	v, ok := s.values[key]
+	if ok && !v.expiresAt.IsZero() && !s.Now().Before(v.expiresAt) {
+		delete(s.values, key)
+		return value{}, false
+	}
+
+	return v, ok
+}
+
+func (s *Storage) expiry(seconds int) time.Time {
+	return s.Now().Add(time.Second * time.Duration(seconds))
+}
+
+func (s *Storage) Set(key, data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] = value{data: data}
+	return nil
+}
+
+func (s *Storage) SetWithTTL(key, data string, seconds int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] = value{data: data, expiresAt: s.expiry(seconds)}
+	return nil
+}
+
+func (s *Storage) SetNXWithTTL(key, data string, seconds int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.get(key); ok {
+		return false, nil
+	}
+	s.values[key] = value{data: data, expiresAt: s.expiry(seconds)}
+	return true, nil
+}
+
+// Get returns []byte like redigo does for a bulk string, and nil for a
+// missing key.
+func (s *Storage) Get(key string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.get(key)
+	if !ok {
+		return nil, nil
+	}
+	return []byte(v.data), nil
+}
+
+func (s *Storage) IncrWithTTL(key string, seconds int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.get(key)
+	if !ok {
+		v = value{data: "0", expiresAt: s.expiry(seconds)}
+	}
+	n, err := strconv.ParseInt(v.data, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value at %s is not an integer", key)
+	}
+
+	n++
+	v.data = strconv.FormatInt(n, 10)
+	s.values[key] = v
+	return n, nil
+}
+
+func (s *Storage) Del(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.values, key)
+		delete(s.sets, key)
+		delete(s.streams, key)
+	}
+	return nil
+}
+
+func (s *Storage) DelIfEqual(key, data string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.get(key); !ok || v.data != data {
+		return false, nil
+	}
+	delete(s.values, key)
+	return true, nil
+}
+
+// TTL returns how long key has left, zero for a key without expiry and -1
+// for a missing key.
+func (s *Storage) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.get(key)
+	switch {
+	case !ok:
+		return -1
+	case v.expiresAt.IsZero():
+		return 0
+	}
+	return v.expiresAt.Sub(s.Now())
+}
+
+// Keys returns the live keys that start with prefix, sorted.
+func (s *Storage) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.values {
+		if _, ok := s.get(key); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Storage) ZAdd(key string, score int64, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sets[key] == nil {
+		s.sets[key] = make(map[string]int64)
+	}
+	s.sets[key][member] = score
+	return nil
+}
+
+func (s *Storage) ZRangeByScore(key string, max int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var members []string
+	for member, score := range s.sets[key] {
+		if score <= max {
+			members = append(members, member)
+		}
+	}
+	set := s.sets[key]
+	sort.Slice(members, func(i, j int) bool {
+		if set[members[i]] != set[members[j]] {
+			return set[members[i]] < set[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members, nil
+}
+
+func (s *Storage) ZRem(key string, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sets[key], member)
+	return nil
+}
+
+func (s *Storage) ZCard(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return int64(len(s.sets[key])), nil
+}
+
+// stream returns the stream at key, creating it. It needs s.mu.
+func (s *Storage) stream(key string) *stream {
+	st, ok := s.streams[key]
+	if !ok {
+		st = &stream{entries: make(map[int64]string), groups: make(map[string]*group)}
+		s.streams[key] = st
+	}
+	return st
+}
+
+func streamID(seq int64) string {
+	return strconv.FormatInt(seq, 10) + "-0"
+}
+
+// parseStreamID reads the ids made by streamID, and "-" and "+". XRange
+// takes care of the "(" of exclusive ranges.
+func parseStreamID(id string) (int64, error) {
+	switch id {
+	case "-":
+		return 0, nil
+	case "+":
+		return 1<<63 - 1, nil
+	}
+
+	ms, _, _ := strings.Cut(id, "-")
+	return strconv.ParseInt(ms, 10, 64)
+}
+
+func (s *Storage) XGroupCreate(key, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.stream(key)
+	if _, ok := st.groups[name]; !ok {
+		st.groups[name] = &group{next: 1, pending: make(map[int64]pending)}
+	}
+	return nil
+}
+
+func (s *Storage) XAdd(key, data string, maxLen int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.stream(key)
+	st.seq++
+	st.entries[st.seq] = data
+
+	if maxLen > 0 {
+		for _, seq := range st.sorted() {
+			if len(st.entries) <= maxLen {
+				break
+			}
+			delete(st.entries, seq)
+		}
+	}
+	return streamID(st.seq), nil
+}
+
+func (st *stream) sorted() []int64 {
+	seqs := make([]int64, 0, len(st.entries))
+	for seq := range st.entries {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// XReadGroup does not block: with nothing to read it waits for block, up to
+// a few milliseconds, so polling workers do not spin.
+func (s *Storage) XReadGroup(key, name, consumer string, count int, block time.Duration) ([]repo.StreamEntry, error) {
+	s.mu.Lock()
+	entries, err := s.readGroup(key, name, consumer, count)
+	s.mu.Unlock()
+
+	if err == nil && len(entries) == 0 && block > 0 {
+		if block > 5*time.Millisecond {
+			block = 5 * time.Millisecond
+		}
+		time.Sleep(block)
+	}
+	return entries, err
+}
+
+func (s *Storage) readGroup(key, name, consumer string, count int) ([]repo.StreamEntry, error) {
+	st := s.stream(key)
+	g, ok := st.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("NOGROUP no group %s on stream %s", name, key)
+	}
+
+	var entries []repo.StreamEntry
+	for seq := g.next; seq <= st.seq && len(entries) < count; seq++ {
+		g.next = seq + 1
+		data, ok := st.entries[seq]
+		if !ok {
+			continue
+		}
+		g.pending[seq] = pending{consumer: consumer, deliveredAt: s.Now()}
+		entries = append(entries, repo.StreamEntry{ID: streamID(seq), Value: data})
+	}
+	return entries, nil
+}
+
+func (s *Storage) XAutoClaim(key, name, consumer string, minIdle time.Duration, count int) ([]repo.StreamEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.stream(key)
+	g, ok := st.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("NOGROUP no group %s on stream %s", name, key)
+	}
+
+	seqs := make([]int64, 0, len(g.pending))
+	for seq := range g.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var entries []repo.StreamEntry
+	for _, seq := range seqs {
+		if len(entries) == count {
+			break
+		}
+		if s.Now().Sub(g.pending[seq].deliveredAt) < minIdle {
+			continue
+		}
+		g.pending[seq] = pending{consumer: consumer, deliveredAt: s.Now()}
+		// Entries deleted while pending come back empty, as in redis.
+		entries = append(entries, repo.StreamEntry{ID: streamID(seq), Value: st.entries[seq]})
+	}
+	return entries, nil
+}
+
+func (s *Storage) XAckDel(key, name string, ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.stream(key)
+	for _, id := range ids {
+		seq, err := parseStreamID(id)
+		if err != nil {
+			return err
+		}
+		if g, ok := st.groups[name]; ok {
+			delete(g.pending, seq)
+		}
+		delete(st.entries, seq)
+	}
+	return nil
+}
+
+func (s *Storage) XRange(key, start, end string, count int) ([]repo.StreamEntry, error) {
+	from, err := parseStreamID(strings.TrimPrefix(start, "("))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(start, "(") {
+		from++
+	}
+	to, err := parseStreamID(strings.TrimPrefix(end, "("))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(end, "(") {
+		to--
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.stream(key)
+	var entries []repo.StreamEntry
+	for _, seq := range st.sorted() {
+		if seq < from || seq > to {
+			continue
+		}
+		if count > 0 && len(entries) == count {
+			break
+		}
+		entries = append(entries, repo.StreamEntry{ID: streamID(seq), Value: st.entries[seq]})
+	}
+	return entries, nil
+}
+
+func (s *Storage) XDel(key string, ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.stream(key)
+	for _, id := range ids {
+		seq, err := parseStreamID(id)
+		if err != nil {
+			return err
+		}
+		delete(st.entries, seq)
+	}
+	return nil
+}
+
+// Pending returns how many entries of the stream at key the group read and
+// did not acknowledge.
+func (s *Storage) Pending(key, name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if g, ok := s.stream(key).groups[name]; ok {
+		return len(g.pending)
+	}
+	return 0
+}
+
+func (s *Storage) Publish(channel, message string) error {
+	s.mu.Lock()
+	subscribers := append([]chan []byte(nil), s.subscribers[channel]...)
+	s.mu.Unlock()
+
+	for _, ch := range subscribers {
+		ch <- []byte(message)
+	}
+	return nil
+}
+
+func (s *Storage) Subscribe(ctx context.Context, channel string, onMessage func([]byte)) error {
+	ch := make(chan []byte, 16)
+
+	s.mu.Lock()
+	s.subscribers[channel] = append(s.subscribers[channel], ch)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		subscribers := s.subscribers[channel]
+		for i, c := range subscribers {
+			if c == ch {
+				s.subscribers[channel] = append(subscribers[:i], subscribers[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	for {
+		select {
+		case message := <-ch:
+			onMessage(message)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package redis
 
 import (
+	"context"
+	"fmt"
 	rd "github.com/gomodule/redigo/redis"
 	"myproject/api-gateway/storage/repo"
+	"strings"
+	"time"
 )
 
 type redisRepo struct {
@@ -29,9 +33,244 @@ func (r *redisRepo) SetWithTTL(key, value string, seconds int) (err error) {
 	return err
 }
 
+func (r *redisRepo) SetNXWithTTL(key, value string, seconds int) (bool, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	reply, err := rd.String(conn.Do("SET", key, value, "EX", seconds, "NX"))
+	if err == rd.ErrNil {
+		return false, nil
+	}
+
+	return reply == "OK", err
+}
+
 func (r *redisRepo) Get(key string) (interface{}, error) {
 	conn := r.reds.Get()
 	defer conn.Close()
 
 	return conn.Do("GET", key)
 }
+
+// incrWithTTL runs as a script, so a counter never exists without its TTL.
+var incrWithTTL = rd.NewScript(1, `
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("EXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+func (r *redisRepo) IncrWithTTL(key string, seconds int) (int64, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	return rd.Int64(incrWithTTL.Do(conn, key, seconds))
+}
+
+func (r *redisRepo) Del(keys ...string) (err error) {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", rd.Args{}.AddFlat(keys)...)
+	return err
+}
+
+var delIfEqual = rd.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (r *redisRepo) DelIfEqual(key, value string) (bool, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	deleted, err := rd.Int(delIfEqual.Do(conn, key, value))
+	return deleted == 1, err
+}
+
+func (r *redisRepo) ZAdd(key string, score int64, member string) (err error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("ZADD", key, score, member)
+	return err
+}
+
+func (r *redisRepo) ZRangeByScore(key string, max int64) ([]string, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	return rd.Strings(conn.Do("ZRANGEBYSCORE", key, "-inf", max))
+}
+
+func (r *redisRepo) ZRem(key string, member string) (err error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("ZREM", key, member)
+	return err
+}
+
+func (r *redisRepo) ZCard(key string) (int64, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	return rd.Int64(conn.Do("ZCARD", key))
+}
+
+// streamField is the one field of the stream entries written by XAdd.
+const streamField = "v"
+
+func (r *redisRepo) XGroupCreate(stream, group string) error {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("XGROUP", "CREATE", stream, group, "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+func (r *redisRepo) XAdd(stream, value string, maxLen int) (string, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	args := rd.Args{stream}
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	return rd.String(conn.Do("XADD", args.Add("*", streamField, value)...))
+}
+
+func (r *redisRepo) XReadGroup(stream, group, consumer string, count int, block time.Duration) ([]repo.StreamEntry, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	reply, err := rd.Values(conn.Do("XREADGROUP", "GROUP", group, consumer, "COUNT", count,
+		"BLOCK", block.Milliseconds(), "STREAMS", stream, ">"))
+	if err == rd.ErrNil {
+		return nil, nil
+	}
+	if err != nil || len(reply) == 0 {
+		return nil, err
+	}
+
+	// The reply is a list of [stream, entries] pairs, one per stream read.
+	streamReply, err := rd.Values(reply[0], nil)
+	if err != nil || len(streamReply) != 2 {
+		return nil, err
+	}
+	return streamEntries(streamReply[1], nil)
+}
+
+func (r *redisRepo) XAutoClaim(stream, group, consumer string, minIdle time.Duration, count int) ([]repo.StreamEntry, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	// The reply starts with the cursor to continue from, then the entries.
+	reply, err := rd.Values(conn.Do("XAUTOCLAIM", stream, group, consumer, minIdle.Milliseconds(), "0", "COUNT", count))
+	if err != nil || len(reply) < 2 {
+		return nil, err
+	}
+	return streamEntries(reply[1], nil)
+}
+
+func (r *redisRepo) XAckDel(stream, group string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("XACK", rd.Args{stream, group}.AddFlat(ids)...); err != nil {
+		return err
+	}
+	_, err := conn.Do("XDEL", rd.Args{stream}.AddFlat(ids)...)
+	return err
+}
+
+func (r *redisRepo) XRange(stream, start, end string, count int) ([]repo.StreamEntry, error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	return streamEntries(conn.Do("XRANGE", stream, start, end, "COUNT", count))
+}
+
+func (r *redisRepo) XDel(stream string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("XDEL", rd.Args{stream}.AddFlat(ids)...)
+	return err
+}
+
+// streamEntries parses a list of [id, [field, value, ...]] entries. Entries
+// deleted while pending come back without fields and keep an empty value.
+func streamEntries(reply interface{}, err error) ([]repo.StreamEntry, error) {
+	values, err := rd.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]repo.StreamEntry, 0, len(values))
+	for _, value := range values {
+		entry, err := rd.Values(value, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %v", value)
+		}
+
+		id, err := rd.String(entry[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := rd.StringMap(entry[1], nil)
+		if err != nil && err != rd.ErrNil {
+			return nil, err
+		}
+
+		entries = append(entries, repo.StreamEntry{ID: id, Value: fields[streamField]})
+	}
+
+	return entries, nil
+}
+
+func (r *redisRepo) Publish(channel, message string) (err error) {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", channel, message)
+	return err
+}
+
+func (r *redisRepo) Subscribe(ctx context.Context, channel string, onMessage func([]byte)) error {
+	conn := r.reds.Get()
+	defer conn.Close()
+
+	psc := rd.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(channel); err != nil {
+		return err
+	}
+	defer psc.Unsubscribe(channel)
+
+	for {
+		switch v := psc.ReceiveContext(ctx).(type) {
+		case rd.Message:
+			onMessage(v.Data)
+		case error:
+			return v
+		}
+	}
+}
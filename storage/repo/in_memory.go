@@ -1,7 +1,56 @@
 package repo
 
+import (
+	"context"
+	"time"
+)
+
 type InMemoryStorageI interface {
 	Set(key, value string) error
 	SetWithTTL(key, value string, seconds int) error
+	// SetNXWithTTL sets key only if it does not exist and reports whether it did.
+	SetNXWithTTL(key, value string, seconds int) (bool, error)
 	Get(key string) (interface{}, error)
+	// IncrWithTTL increments the counter at key and returns its new value.
+	// The TTL is set when the counter is created and left alone after that.
+	IncrWithTTL(key string, seconds int) (int64, error)
+	Del(keys ...string) error
+	// DelIfEqual deletes key only if it holds value and reports whether it
+	// did, so of several callers holding the same value only one wins.
+	DelIfEqual(key, value string) (bool, error)
+	// ZAdd adds member to the sorted set key with score, or updates its score.
+	ZAdd(key string, score int64, member string) error
+	// ZRangeByScore returns the members of key with a score of at most max.
+	ZRangeByScore(key string, max int64) ([]string, error)
+	ZRem(key string, member string) error
+	// ZCard returns the number of members of the sorted set key.
+	ZCard(key string) (int64, error)
+	// XGroupCreate creates group on stream, and stream if it is missing. A
+	// group that exists already is not an error.
+	XGroupCreate(stream, group string) error
+	// XAdd appends value to stream and returns its id. With maxLen > 0 the
+	// stream is trimmed to about maxLen entries.
+	XAdd(stream, value string, maxLen int) (string, error)
+	// XReadGroup returns up to count entries no consumer of group has read,
+	// waiting up to block for the first one.
+	XReadGroup(stream, group, consumer string, count int, block time.Duration) ([]StreamEntry, error)
+	// XAutoClaim hands to consumer up to count entries that other consumers
+	// read more than minIdle ago without acknowledging them.
+	XAutoClaim(stream, group, consumer string, minIdle time.Duration, count int) ([]StreamEntry, error)
+	// XAckDel acknowledges ids for group and deletes them from stream.
+	XAckDel(stream, group string, ids ...string) error
+	// XRange returns up to count entries from start to end, both included.
+	// "-" and "+" are the first and the last entry.
+	XRange(stream, start, end string, count int) ([]StreamEntry, error)
+	XDel(stream string, ids ...string) error
+	Publish(channel, message string) error
+	// Subscribe blocks, calling onMessage for every message on channel, until
+	// ctx is done or the connection fails.
+	Subscribe(ctx context.Context, channel string, onMessage func([]byte)) error
+}
+
+// StreamEntry is an entry of a stream written by XAdd.
+type StreamEntry struct {
+	ID    string
+	Value string
 }